@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var abortTagName string
+
+var abortCmd = &cobra.Command{
+	Use:   "abort",
+	Short: "Abort the in-progress canary release of the given tag, which fails its health check and rolls back.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		state, err := lib.NewStater(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		if err := state.AbortCanaryRelease(abortTagName); err != nil {
+			slog.Error(fmt.Sprintf("failed to abort canary release: %s", err))
+			os.Exit(1)
+		}
+		slog.Info("canary release aborted", "tag", abortTagName, "expires_in", lib.CanaryLockTTL(config))
+	},
+}
+
+func init() {
+	abortCmd.Flags().StringVar(&abortTagName, "tag", "", "release tag to abort")
+	abortCmd.MarkFlagRequired("tag")
+	rootCmd.AddCommand(abortCmd)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var checkRedisCmd = &cobra.Command{
+	Use:   "check-redis",
+	Short: "Check connectivity and permissions of the operations used against Redis.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		state, err := lib.NewState(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		failed := false
+		for _, r := range state.CheckOperations() {
+			if r.Err != nil {
+				failed = true
+				fmt.Printf("NG %s: %s\n", r.Operation, r.Err)
+				continue
+			}
+			fmt.Printf("OK %s\n", r.Operation)
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkRedisCmd)
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var clearAvoidTag string
+
+var clearAvoidCmd = &cobra.Command{
+	Use:   "clear-avoid",
+	Short: "Remove the tag from the avoid tags so that it can be deployed again.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		state, err := lib.NewStater(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		if err := state.RemoveAvoidReleaseTag(clearAvoidTag); err != nil {
+			slog.Error(fmt.Sprintf("failed to remove avoid tag: %s", err))
+			os.Exit(1)
+		}
+		slog.Info("avoid tag cleared", "tag", clearAvoidTag)
+	},
+}
+
+func init() {
+	clearAvoidCmd.Flags().StringVar(&clearAvoidTag, "tag", "", "tag to remove from the avoid tags")
+	clearAvoidCmd.MarkFlagRequired("tag")
+	rootCmd.AddCommand(clearAvoidCmd)
+}
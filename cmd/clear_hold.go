@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var clearHoldCmd = &cobra.Command{
+	Use:   "clear-hold",
+	Short: "Resume canary release and rollout on this node held by on_failure=hold.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		state, err := lib.NewStater(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		tag, err := state.HeldTag()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to get held tag: %s", err))
+			os.Exit(1)
+		}
+
+		if err := state.ClearHold(); err != nil {
+			slog.Error(fmt.Sprintf("failed to clear hold: %s", err))
+			os.Exit(1)
+		}
+		slog.Info("hold cleared", "tag", tag)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(clearHoldCmd)
+}
@@ -0,0 +1,241 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/tj/assert"
+)
+
+// fakeClock is a Clock which moves only by Advance.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	d       time.Duration
+	next    time.Time
+	once    bool
+	stopped bool
+}
+
+// newFakeClock starts far from the real time so that a time not taken from the clock shows up.
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NewTicker(d time.Duration) lib.Ticker {
+	return f.newTicker(d, false)
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	return f.newTicker(d, true).c
+}
+
+// Sleep returns at once after advancing the clock.
+func (f *fakeClock) Sleep(d time.Duration) {
+	f.Advance(d)
+}
+
+func (f *fakeClock) newTicker(d time.Duration, once bool) *fakeTicker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{clock: f, c: make(chan time.Time, 1), d: d, next: f.now.Add(d), once: once}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance moves the clock and fires the tickers which are due. Like time.Ticker,
+// a tick is dropped when the previous one isn't received yet.
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for _, t := range f.tickers {
+		for !t.stopped && !t.next.After(f.now) {
+			select {
+			case t.c <- f.now:
+			default:
+			}
+			t.next = t.next.Add(t.d)
+			t.stopped = t.once
+		}
+	}
+}
+
+// waitTickers waits until n tickers are running.
+func (f *fakeClock) waitTickers(t *testing.T, n int) {
+	assert.Eventually(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		running := 0
+		for _, t := range f.tickers {
+			if !t.stopped {
+				running++
+			}
+		}
+		return running >= n
+	}, time.Second, time.Millisecond)
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+func TestRunHealthCheckFakeClock(t *testing.T) {
+	fake := newFakeClock()
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		HealthCheckCommand:  "echo ok >> " + t.TempDir() + "/checks",
+		HealthCheckInterval: time.Minute,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Hour,
+		Clock:               fake,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		_, err := runHealthCheck(context.Background(), config, state, "v1.1.0", "v1.0.0", "assetfile")
+		done <- err
+	}()
+	fake.waitTickers(t, 2)
+
+	fake.Advance(30 * time.Minute)
+	select {
+	case err := <-done:
+		t.Fatalf("health check returned before the canary window: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fake.Advance(30 * time.Minute)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("health check didn't return after the canary window")
+	}
+}
+
+func TestCheckDeployBackoffFakeClock(t *testing.T) {
+	fake := newFakeClock()
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		RepositryPollingInterval: time.Minute,
+		DeployBackoffMax:         time.Hour,
+		Clock:                    fake,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		state.ClearDeployFailure()
+	})
+
+	recordDeployResult(config, state, "v1.0.0", errors.New("failed"))
+	assert.True(t, errors.Is(checkDeployBackoff(config, state, "v1.0.0"), lib.ErrDeployBackoff))
+
+	fake.Advance(lib.DeployBackoff(config, 1) + time.Second)
+	assert.NoError(t, checkDeployBackoff(config, state, "v1.0.0"))
+}
+
+// rolloutTimingState is a lib.Stater which reports every rollout cycle.
+type rolloutTimingState struct {
+	lib.Stater
+	rollouts chan struct{}
+}
+
+func (s *rolloutTimingState) SaveMemberState() error {
+	return nil
+}
+
+func (s *rolloutTimingState) HeldTag() (string, error) {
+	return "", nil
+}
+
+func (s *rolloutTimingState) CurrentStableTag() (string, error) {
+	s.rollouts <- struct{}{}
+	return "", nil
+}
+
+func TestRunRepoRolloutWindowFakeClock(t *testing.T) {
+	fake := newFakeClock()
+	notCanary := false
+	config := &lib.Config{
+		Repo:                     "foo/bar",
+		RepositryPollingInterval: time.Hour,
+		RolloutWindow:            10 * time.Minute,
+		IsCanary:                 &notCanary,
+		Clock:                    fake,
+	}
+	state := &rolloutTimingState{rollouts: make(chan struct{}, 10)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- runRepo(ctx, ctx, config, &MockGitHuber{}, state, nil)
+	}()
+	fake.waitTickers(t, 2)
+
+	for i := 0; i < 2; i++ {
+		fake.Advance(5 * time.Minute)
+		select {
+		case <-state.rollouts:
+			t.Fatal("rollout ran before the rollout window")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		fake.Advance(5 * time.Minute)
+		select {
+		case <-state.rollouts:
+		case <-time.After(time.Second):
+			t.Fatal("rollout didn't run after the rollout window")
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("runRepo didn't return on shutdown")
+	}
+}
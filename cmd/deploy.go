@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var deployTagName string
+var deployForce bool
+
+var deployCmd = &cobra.Command{
+	Use:   "deploy",
+	Short: "Deploy the given release tag on this node and save it as the stable tag after the health check passes.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		state, err := lib.NewStater(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		github, err := lib.NewGitHuber(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init github: %s", err))
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
+		if err := deployTag(ctx, config, deployTagName, deployForce, state, github); err != nil {
+			slog.Error(fmt.Sprintf("failed to deploy %s: %s", deployTagName, err))
+			os.Exit(1)
+		}
+		slog.Info("deploy success and saved as the stable tag", "tag", deployTagName)
+	},
+}
+
+// deployTag deploys the pinned tag regardless of the latest release. The avoid tags are
+// respected unless force is set, which also removes the tag from the avoid tags after
+// the health check passes.
+// When the post deploy command fails, the previous tag is deployed back.
+// The config is checked as the server does, because the tag is saved as the stable tag
+// of the fleet after the deploy and the health check.
+func deployTag(ctx context.Context, config *lib.Config, tag string, force bool, state lib.Stater, github lib.GitHuber) error {
+	if err := validateServerConfig(config); err != nil {
+		return err
+	}
+
+	if !force {
+		if err := state.IsAvoidReleaseTag(tag); err != nil {
+			return errors.Wrap(err, "use --force to deploy it")
+		}
+	}
+
+	previousTag, err := state.GetLastInstalledTag()
+	if err != nil {
+		return fmt.Errorf("can't get current version:%s", err)
+	}
+
+	_, filename, err := deploy(ctx, config, config.DeployCommand, tag, state, github)
+	switch {
+	case errors.Is(err, ErrDeploySkipped):
+		slog.Info("release is already deployed and skip health check", "tag", tag)
+	case errors.Is(err, ErrPostDeploy) && previousTag != "":
+		// the release is already deployed, so the node goes back to the previous tag
+		slog.Error("post deploy command failed", slog.String("err", err.Error()))
+		if rerr := handleRollback(ctx, previousTag, fmt.Sprintf("post deploy command of %s failed", tag), config, state, github); !errors.Is(rerr, ErrRollback) {
+			return rerr
+		}
+		return errors.Wrap(err, "deploy command failed and rolled back")
+	case err != nil:
+		return errors.Wrap(err, "deploy command failed")
+	default:
+		slog.Info("deploy command success and start health check", "tag", tag, "cmd", config.HealthCheckCommand, "url", config.HealthCheckHTTP.URL)
+		if out, err := runHealthCheck(ctx, config, state, tag, previousTag, filename); err != nil {
+			slog.Error("health check command failed", slog.String("err", err.Error()), slog.String("out", out))
+			return errors.Wrap(err, "health check failed")
+		}
+	}
+
+	if err := state.SaveStableReleaseTag(tag); err != nil {
+		return fmt.Errorf("can't save stable tag:%s", err)
+	}
+	if force {
+		if err := state.RemoveAvoidReleaseTag(tag); err != nil {
+			return fmt.Errorf("can't remove avoid tag:%s", err)
+		}
+	}
+	if err := state.SaveMemberState(); err != nil {
+		slog.Error(fmt.Sprintf("failed to save state: %s", err))
+	}
+	return nil
+}
+
+func init() {
+	deployCmd.Flags().StringVar(&deployTagName, "tag", "", "release tag to deploy")
+	deployCmd.Flags().BoolVar(&deployForce, "force", false, "deploy the tag even if it is avoided, and remove it from the avoid tags")
+	deployCmd.MarkFlagRequired("tag")
+	rootCmd.AddCommand(deployCmd)
+}
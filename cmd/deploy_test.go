@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/pyama86/git-assets-canary-releaser/testutils"
+	"github.com/tj/assert"
+)
+
+func TestDeployTag(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	keys := []string{"foo/bar_stable_release_tag", "foo/bar_avoid_release_tag", "foo/bar_release_history"}
+	redisClient.Del(context.Background(), keys...)
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), keys...)
+	})
+
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		DeployCommand:       "../testdata/always_succes.sh",
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/always_succes.sh",
+		HealthCheckInterval: time.Nanosecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Nanosecond,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	assert.NoError(t, state.SaveAvoidReleaseTag("v1.0.0", "health check failed", ""))
+
+	mockGitHub := new(MockGitHuber)
+
+	// the tag isn't saved as stable without the deploy command or the health check
+	for _, c := range []lib.Config{
+		{Repo: "foo/bar", HealthCheckCommand: config.HealthCheckCommand},
+		{Repo: "foo/bar", DeployCommand: config.DeployCommand},
+	} {
+		assert.Error(t, deployTag(context.Background(), &c, "v1.0.0", true, state, mockGitHub))
+	}
+	stableTag, err := state.CurrentStableTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "", stableTag)
+
+	err = deployTag(context.Background(), config, "v1.0.0", false, state, mockGitHub)
+	assert.True(t, errors.Is(err, lib.ErrAvoidReleaseTag))
+	mockGitHub.AssertNotCalled(t, "DownloadReleaseAssets", "v1.0.0")
+
+	mockGitHub.On("DownloadReleaseAssets", "v1.0.0").Return("v1.0.0", []string{"assetfile"}, nil)
+
+	// the tag stays avoided when the health check of the forced deploy fails
+	failing := *config
+	failing.HealthCheckCommand = "../testdata/always_fail.sh"
+	assert.Error(t, deployTag(context.Background(), &failing, "v1.0.0", true, state, mockGitHub))
+	assert.Equal(t, lib.ErrAvoidReleaseTag, state.IsAvoidReleaseTag("v1.0.0"))
+
+	assert.NoError(t, deployTag(context.Background(), config, "v1.0.0", true, state, mockGitHub))
+	assert.NoError(t, state.IsAvoidReleaseTag("v1.0.0"))
+	stableTag, err = state.CurrentStableTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", stableTag)
+	mockGitHub.AssertExpectations(t)
+}
+
+func TestDeployTagPostDeployRollback(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	keys := []string{"foo/bar_stable_release_tag", "foo/bar_avoid_release_tag", "foo/bar_release_history"}
+	redisClient.Del(context.Background(), keys...)
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), keys...)
+	})
+	t.Setenv("TEST_VERSION", "v1.0.0")
+
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	log := filepath.Join(t.TempDir(), "log")
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		DeployCommand:       "../testdata/always_succes.sh",
+		RollbackCommand:     fmt.Sprintf(`echo "rollback $RELEASE_TAG" >> %s`, log),
+		PostDeployCommand:   `test "$RELEASE_TAG" != v1.1.0`,
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/always_succes.sh",
+		HealthCheckInterval: time.Nanosecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Nanosecond,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("DownloadReleaseAssets", "v1.1.0").Return("v1.1.0", []string{"assetfile"}, nil)
+	mockGitHub.On("DownloadReleaseAssets", "v1.0.0").Return("v1.0.0", []string{"assetfile"}, nil)
+
+	err = deployTag(context.Background(), config, "v1.1.0", false, state, mockGitHub)
+	assert.True(t, errors.Is(err, ErrPostDeploy))
+	b, err := os.ReadFile(log)
+	assert.NoError(t, err)
+	assert.Equal(t, "rollback v1.0.0\n", string(b))
+	stableTag, err := state.CurrentStableTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "", stableTag)
+	mockGitHub.AssertExpectations(t)
+}
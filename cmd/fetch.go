@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var fetchTag string
+var fetchOutput string
+
+var fetchCmd = &cobra.Command{
+	Use:   "fetch",
+	Short: "Download the asset of the given release tag without deploying it.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		if fetchOutput != "" {
+			if err := os.MkdirAll(fetchOutput, 0755); err != nil {
+				slog.Error(fmt.Sprintf("failed to create output directory: %s", err))
+				os.Exit(1)
+			}
+			config.SaveAssetsPath = fetchOutput
+		}
+
+		github, err := lib.NewGitHuber(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init github: %s", err))
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
+		_, files, err := github.DownloadReleaseAssets(ctx, fetchTag)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to download release asset: %s", err))
+			os.Exit(1)
+		}
+		for _, file := range files {
+			fmt.Println(file)
+		}
+	},
+}
+
+func init() {
+	fetchCmd.Flags().StringVar(&fetchTag, "tag", "", "release tag to fetch")
+	fetchCmd.Flags().StringVar(&fetchOutput, "output", "", "directory to save the asset (default is save_assets_path)")
+	fetchCmd.MarkFlagRequired("tag")
+	rootCmd.AddCommand(fetchCmd)
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+)
+
+// healthCheckTagPlaceholder in healthcheck_http.url is replaced with the release tag
+const healthCheckTagPlaceholder = "${RELEASE_TAG}"
+
+// maxHealthCheckBodyLen limits the response body read for body_contains and the failure output
+const maxHealthCheckBodyLen = 1024 * 1024
+
+// healthCheck runs healthcheck_http when the url is set, otherwise healthcheck_command.
+func healthCheck(ctx context.Context, config *lib.Config, tag, previousTag, file string) ([]byte, error) {
+	if config.HealthCheckHTTP.URL == "" {
+		out, err := executeCommand(ctx, config, config.HealthCheckCommand, tag, file, config.HealthCheckTimeout, previousTagEnv(previousTag))
+		if err != nil {
+			return out, fmt.Errorf("health check command failed: %s, %s", err.Error(), string(out))
+		}
+		return out, nil
+	}
+	return httpHealthCheck(ctx, config.HealthCheckHTTP, tag, config.HealthCheckTimeout)
+}
+
+func httpHealthCheck(ctx context.Context, hc lib.HealthCheckHTTPConfig, tag string, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	u := strings.ReplaceAll(hc.URL, healthCheckTagPlaceholder, url.PathEscape(tag))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check url %s:%s", u, err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("health check request failed: %s", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHealthCheckBodyLen))
+	if err != nil {
+		return nil, fmt.Errorf("can't read health check response: %s", err)
+	}
+
+	expected := hc.ExpectedStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if res.StatusCode != expected {
+		return body, fmt.Errorf("health check %s returned status %d, expected %d, %s", u, res.StatusCode, expected, string(body))
+	}
+	if hc.BodyContains != "" && !strings.Contains(string(body), hc.BodyContains) {
+		return body, fmt.Errorf("health check %s response doesn't contain %q, %s", u, hc.BodyContains, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/tj/assert"
+)
+
+func TestHTTPHealthCheck(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":"ok"}`)
+	})
+	mux.HandleFunc("/health/v2.0.0", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"status":"ng"}`)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name    string
+		config  lib.HealthCheckHTTPConfig
+		tag     string
+		wantErr bool
+	}{
+		{
+			name:   "ok",
+			config: lib.HealthCheckHTTPConfig{URL: srv.URL + "/health/${RELEASE_TAG}"},
+			tag:    "v1.0.0",
+		},
+		{
+			name:    "unexpected status",
+			config:  lib.HealthCheckHTTPConfig{URL: srv.URL + "/health/${RELEASE_TAG}"},
+			tag:     "v2.0.0",
+			wantErr: true,
+		},
+		{
+			name:   "expected status",
+			config: lib.HealthCheckHTTPConfig{URL: srv.URL + "/health/${RELEASE_TAG}", ExpectedStatus: http.StatusServiceUnavailable},
+			tag:    "v2.0.0",
+		},
+		{
+			name:   "body contains",
+			config: lib.HealthCheckHTTPConfig{URL: srv.URL + "/health/${RELEASE_TAG}", BodyContains: `"ok"`},
+			tag:    "v1.0.0",
+		},
+		{
+			name:    "body doesn't contain",
+			config:  lib.HealthCheckHTTPConfig{URL: srv.URL + "/health/${RELEASE_TAG}", BodyContains: `"ready"`},
+			tag:     "v1.0.0",
+			wantErr: true,
+		},
+		{
+			name:    "timeout",
+			config:  lib.HealthCheckHTTPConfig{URL: srv.URL + "/slow"},
+			tag:     "v1.0.0",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := httpHealthCheck(context.Background(), tt.config, tt.tag, 100*time.Millisecond)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
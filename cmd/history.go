@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var historyLimit int
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show the history of the stable tags and the rollbacks, newest first.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		state, err := lib.NewStater(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		history, err := state.GetReleaseHistory(historyLimit)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to get release history: %s", err))
+			os.Exit(1)
+		}
+
+		for _, h := range history {
+			fmt.Printf("%s %s %s %s %s\n", h.At.Format(time.RFC3339), h.Host, h.Action, h.Tag, h.Reason)
+		}
+	},
+}
+
+func init() {
+	historyCmd.Flags().IntVar(&historyLimit, "limit", 20, "number of entries to show(0 shows all)")
+	rootCmd.AddCommand(historyCmd)
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+func TestLogFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gacr.log")
+	l, err := openLogFile(path)
+	assert.NoError(t, err)
+
+	_, err = l.Write([]byte("before\n"))
+	assert.NoError(t, err)
+
+	// logrotate renames the file and sends SIGHUP
+	assert.NoError(t, os.Rename(path, path+".1"))
+	assert.NoError(t, l.reopen())
+	_, err = l.Write([]byte("after\n"))
+	assert.NoError(t, err)
+
+	b, err := os.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, "before\n", string(b))
+	b, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "after\n", string(b))
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	deployedTagGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gacr_deployed_tag",
+		Help: "The release tag deployed on this node, the value is always 1.",
+	}, []string{"repo", "tag"})
+	rolloutInstalledGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gacr_rollout_installed_nodes",
+		Help: "The number of nodes which installed the stable release.",
+	}, []string{"repo"})
+	rolloutTotalGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gacr_rollout_total_nodes",
+		Help: "The number of nodes reporting their state.",
+	}, []string{"repo"})
+	canaryReleaseCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gacr_canary_releases_total",
+		Help: "The number of canary releases on this node by result.",
+	}, []string{"repo", "result"})
+	rollbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gacr_rollbacks_total",
+		Help: "The number of rollbacks on this node.",
+	}, []string{"repo"})
+	healthCheckFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gacr_healthcheck_failures_total",
+		Help: "The number of failed health checks on this node.",
+	}, []string{"repo"})
+	rolloutStallCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gacr_rollout_stalls_total",
+		Help: "The number of stalled rollouts detected by this node.",
+	}, []string{"repo"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		deployedTagGauge,
+		rolloutInstalledGauge,
+		rolloutTotalGauge,
+		canaryReleaseCounter,
+		rollbackCounter,
+		healthCheckFailureCounter,
+		rolloutStallCounter,
+	)
+}
+
+// setDeployedTagMetric replaces the deployed tag of the repository, the other repositories keep their tag.
+func setDeployedTagMetric(repo, tag string) {
+	deployedTagGauge.DeletePartialMatch(prometheus.Labels{"repo": repo})
+	deployedTagGauge.WithLabelValues(repo, tag).Set(1)
+}
+
+func setRolloutProgressMetric(repo string, installed, all int) {
+	rolloutInstalledGauge.WithLabelValues(repo).Set(float64(installed))
+	rolloutTotalGauge.WithLabelValues(repo).Set(float64(all))
+}
+
+func countCanaryReleaseMetric(repo string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	canaryReleaseCounter.WithLabelValues(repo, result).Inc()
+}
+
+func newMetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+func startMetricsServer(ctx context.Context, config *lib.Config) error {
+	l, err := net.Listen("tcp", config.MetricsAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen metrics: %s", err)
+	}
+
+	srv := &http.Server{
+		Handler:           newMetricsHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(fmt.Sprintf("metrics server stopped: %s", err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	slog.Info("metrics server started", "addr", l.Addr().String())
+	return nil
+}
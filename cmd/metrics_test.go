@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	setDeployedTagMetric("pyama86/foo", "v1.0.0")
+	setDeployedTagMetric("pyama86/foo", "v1.1.0")
+	setRolloutProgressMetric("pyama86/foo", 2, 3)
+	countCanaryReleaseMetric("pyama86/foo", true)
+
+	rec := httptest.NewRecorder()
+	newMetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	assert.Contains(t, body, `gacr_deployed_tag{repo="pyama86/foo",tag="v1.1.0"} 1`)
+	assert.NotContains(t, body, `gacr_deployed_tag{repo="pyama86/foo",tag="v1.0.0"}`)
+	assert.Contains(t, body, `gacr_rollout_installed_nodes{repo="pyama86/foo"} 2`)
+	assert.Contains(t, body, `gacr_rollout_total_nodes{repo="pyama86/foo"} 3`)
+	assert.Contains(t, body, `gacr_canary_releases_total{repo="pyama86/foo",result="success"}`)
+}
+
+func TestMetricsHandlerMultipleRepos(t *testing.T) {
+	setDeployedTagMetric("pyama86/bar", "v1.0.0")
+	setDeployedTagMetric("pyama86/baz", "v2.0.0")
+	setDeployedTagMetric("pyama86/bar", "v1.1.0")
+	setRolloutProgressMetric("pyama86/bar", 1, 3)
+	setRolloutProgressMetric("pyama86/baz", 3, 3)
+
+	rec := httptest.NewRecorder()
+	newMetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	assert.Contains(t, body, `gacr_deployed_tag{repo="pyama86/bar",tag="v1.1.0"} 1`)
+	assert.NotContains(t, body, `gacr_deployed_tag{repo="pyama86/bar",tag="v1.0.0"}`)
+	assert.Contains(t, body, `gacr_deployed_tag{repo="pyama86/baz",tag="v2.0.0"} 1`)
+	assert.Contains(t, body, `gacr_rollout_installed_nodes{repo="pyama86/bar"} 1`)
+	assert.Contains(t, body, `gacr_rollout_installed_nodes{repo="pyama86/baz"} 3`)
+}
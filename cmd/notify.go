@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/slack-go/slack"
+)
+
+const (
+	eventCanarySuccess  = "canary_success"
+	eventRolloutSuccess = "rollout_success"
+	eventRolloutStalled = "rollout_stalled"
+	eventRollback       = "rollback"
+	eventError          = "error"
+)
+
+// notification is the payload posted to notify_webhook_url.
+type notification struct {
+	Event     string    `json:"event"`
+	Repo      string    `json:"repo,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+	Host      string    `json:"host"`
+	Message   string    `json:"message,omitempty"`
+	Installed int       `json:"installed,omitempty"`
+	All       int       `json:"all,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// Notifier sends the release events to a chat or a webhook.
+type Notifier interface {
+	Notify(n notification) error
+}
+
+// notifiers sends the events to all of the notifiers like slogmulti.Fanout.
+type notifiers []Notifier
+
+func (ns notifiers) Notify(n notification) error {
+	var errs []error
+	for _, notifier := range ns {
+		if err := notifier.Notify(n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newNotifier returns the notifiers configured with the webhook URLs.
+func newNotifier(config *lib.Config) notifiers {
+	var ns notifiers
+	if config.SlackWebhookURL != "" {
+		ns = append(ns, &slackNotifier{
+			url:     config.SlackWebhookURL,
+			channel: config.SlackChannel,
+			mention: slackEventMention(config),
+		})
+	}
+	if config.DiscordWebhookURL != "" {
+		ns = append(ns, &discordNotifier{url: config.DiscordWebhookURL})
+	}
+	if config.TeamsWebhookURL != "" {
+		ns = append(ns, &teamsNotifier{url: config.TeamsWebhookURL})
+	}
+	if config.NotifyWebhookURL != "" {
+		ns = append(ns, &webhookNotifier{url: config.NotifyWebhookURL})
+	}
+	return ns
+}
+
+// notify sends the event to the notifiers. A failure is only logged
+// so that it doesn't stop the release.
+func notify(config *lib.Config, n notification) {
+	ns := newNotifier(config)
+	if len(ns) == 0 {
+		return
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Warn("failed to get hostname for notification", "err", err)
+	}
+	n.Host = hostname
+	n.Repo = config.Repo
+	n.Time = lib.ClockOf(config).Now().UTC()
+
+	if err := ns.Notify(n); err != nil {
+		slog.Warn("failed to notify", "event", n.Event, "err", err)
+	}
+}
+
+func postJSON(u string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		// the webhook URL in the error is the secret
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			uerr.URL = lib.RedactURL(uerr.URL)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// title returns the headline of the event for chat.
+func (n *notification) title() string {
+	switch n.Event {
+	case eventCanarySuccess:
+		return fmt.Sprintf("Canary release of %s succeeded", n.Tag)
+	case eventRolloutSuccess:
+		return fmt.Sprintf("Rollout of %s succeeded (%d/%d)", n.Tag, n.Installed, n.All)
+	case eventRolloutStalled:
+		return fmt.Sprintf("Rollout of %s stalled (%d/%d)", n.Tag, n.Installed, n.All)
+	case eventRollback:
+		return fmt.Sprintf("Rolled back to %s", n.Tag)
+	}
+	if n.Tag != "" {
+		return fmt.Sprintf("Release of %s failed", n.Tag)
+	}
+	return "Release failed"
+}
+
+// color returns the color of the event in RGB.
+func (n *notification) color() int {
+	switch n.Event {
+	case eventCanarySuccess, eventRolloutSuccess:
+		return 0x2eb67d
+	case eventRolloutStalled, eventRollback:
+		return 0xecb22e
+	}
+	return 0xe01e5a
+}
+
+func (n *notification) text() string {
+	ret := fmt.Sprintf("host: %s", n.Host)
+	if n.Repo != "" {
+		ret = fmt.Sprintf("repo: %s\n%s", n.Repo, ret)
+	}
+	if n.Message == "" {
+		return ret
+	}
+	return fmt.Sprintf("%s\n%s", n.Message, ret)
+}
+
+// webhookNotifier posts the event as it is.
+type webhookNotifier struct {
+	url string
+}
+
+func (w *webhookNotifier) Notify(n notification) error {
+	return postJSON(w.url, &n)
+}
+
+// slackNotifier posts the event to a Slack webhook as an attachment.
+type slackNotifier struct {
+	url     string
+	channel string
+	mention func(n *notification) string
+}
+
+func (s *slackNotifier) Notify(n notification) error {
+	text := n.title()
+	if m := s.mention(&n); m != "" {
+		text = fmt.Sprintf("%s %s", m, text)
+	}
+	return postJSON(s.url, &slack.WebhookMessage{
+		Channel: s.channel,
+		Text:    text,
+		Attachments: []slack.Attachment{
+			{
+				Color: fmt.Sprintf("#%06x", n.color()),
+				Title: n.title(),
+				Text:  n.text(),
+				Ts:    json.Number(fmt.Sprint(n.Time.Unix())),
+			},
+		},
+	})
+}
+
+// discordNotifier posts the event to a Discord webhook as an embed.
+type discordNotifier struct {
+	url string
+}
+
+func (d *discordNotifier) Notify(n notification) error {
+	return postJSON(d.url, map[string]any{
+		"embeds": []map[string]any{
+			{
+				"title":       n.title(),
+				"description": n.text(),
+				"color":       n.color(),
+				"timestamp":   n.Time.Format(time.RFC3339),
+			},
+		},
+	})
+}
+
+// teamsNotifier posts the event to a Microsoft Teams incoming webhook as a MessageCard.
+type teamsNotifier struct {
+	url string
+}
+
+func (t *teamsNotifier) Notify(n notification) error {
+	facts := []map[string]string{{"name": "host", "value": n.Host}}
+	if n.Repo != "" {
+		facts = append(facts, map[string]string{"name": "repo", "value": n.Repo})
+	}
+	if n.Tag != "" {
+		facts = append(facts, map[string]string{"name": "tag", "value": n.Tag})
+	}
+	if n.Event == eventRolloutSuccess || n.Event == eventRolloutStalled {
+		facts = append(facts, map[string]string{"name": "progress", "value": fmt.Sprintf("%d/%d", n.Installed, n.All)})
+	}
+	return postJSON(t.url, map[string]any{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    n.title(),
+		"themeColor": fmt.Sprintf("%06X", n.color()),
+		"title":      n.title(),
+		"text":       n.Message,
+		"sections":   []map[string]any{{"facts": facts}},
+	})
+}
+
+// slackEventMention returns the mention of the event so that rollback and failure alerts page someone.
+func slackEventMention(config *lib.Config) func(n *notification) string {
+	return func(n *notification) string {
+		switch n.Event {
+		case eventError:
+			return config.SlackMentionOnError
+		case eventRolloutStalled, eventRollback:
+			return config.SlackMentionOnWarn
+		}
+		return ""
+	}
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/tj/assert"
+)
+
+func TestNotify(t *testing.T) {
+	var got notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	t.Cleanup(srv.Close)
+
+	notify(&lib.Config{Repo: "foo/bar", NotifyWebhookURL: srv.URL}, notification{Event: eventRolloutSuccess, Tag: "v1.0.0", Installed: 2, All: 3})
+	assert.Equal(t, eventRolloutSuccess, got.Event)
+	assert.Equal(t, "foo/bar", got.Repo)
+	assert.Equal(t, "v1.0.0", got.Tag)
+	assert.Equal(t, 2, got.Installed)
+	assert.Equal(t, 3, got.All)
+	assert.NotEmpty(t, got.Host)
+	assert.False(t, got.Time.IsZero())
+}
+
+func TestNotifyDiscordAndTeams(t *testing.T) {
+	got := map[string]map[string]any{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := map[string]any{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&v))
+		got[r.URL.Path] = v
+	}))
+	t.Cleanup(srv.Close)
+
+	notify(&lib.Config{
+		Repo:              "foo/bar",
+		DiscordWebhookURL: srv.URL + "/discord",
+		TeamsWebhookURL:   srv.URL + "/teams",
+	}, notification{Event: eventRollback, Tag: "v1.0.0", Message: "health check of v1.1.0 failed"})
+
+	embed := got["/discord"]["embeds"].([]any)[0].(map[string]any)
+	assert.Equal(t, "Rolled back to v1.0.0", embed["title"])
+	assert.Contains(t, embed["description"], "health check of v1.1.0 failed")
+	assert.Contains(t, embed["description"], "repo: foo/bar")
+	assert.Equal(t, float64(0xecb22e), embed["color"])
+
+	card := got["/teams"]
+	assert.Equal(t, "MessageCard", card["@type"])
+	assert.Equal(t, "Rolled back to v1.0.0", card["title"])
+	assert.Equal(t, "ECB22E", card["themeColor"])
+	assert.Equal(t, "health check of v1.1.0 failed", card["text"])
+	facts := card["sections"].([]any)[0].(map[string]any)["facts"].([]any)
+	assert.Contains(t, facts, map[string]any{"name": "repo", "value": "foo/bar"})
+}
+
+func TestNotifySlack(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	t.Cleanup(srv.Close)
+
+	notify(&lib.Config{
+		Repo:               "foo/bar",
+		SlackWebhookURL:    srv.URL,
+		SlackChannel:       "#release",
+		SlackMentionOnWarn: "<!here>",
+	}, notification{Event: eventRollback, Tag: "v1.0.0", Message: "health check of v1.1.0 failed"})
+
+	assert.Equal(t, "#release", got["channel"])
+	assert.Equal(t, "<!here> Rolled back to v1.0.0", got["text"])
+	attachment := got["attachments"].([]any)[0].(map[string]any)
+	assert.Equal(t, "Rolled back to v1.0.0", attachment["title"])
+	assert.Equal(t, "#ecb22e", attachment["color"])
+	assert.Contains(t, attachment["text"], "health check of v1.1.0 failed")
+	assert.Contains(t, attachment["text"], "repo: foo/bar")
+}
+
+func TestNotifySlackOncePerEvent(t *testing.T) {
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+	}))
+	t.Cleanup(srv.Close)
+
+	config := &lib.Config{
+		Repo:            "foo/bar",
+		SlackWebhookURL: srv.URL,
+		LogStderr:       true,
+	}
+	logger, err := getLogger(config, "info")
+	assert.NoError(t, err)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	repoLogger(config).Warn("rollback success", "tag", "v1.0.0")
+	notify(config, notification{Event: eventRollback, Tag: "v1.0.0"})
+	// the log records would be posted in the background
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), posts.Load())
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var promotePendingCmd = &cobra.Command{
+	Use:   "promote-pending",
+	Short: "Allow the pending release tag to be deployed when hold-new-release is enabled.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		state, err := lib.NewStater(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		tag, err := state.PromotePendingReleaseTag()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to promote pending tag: %s", err))
+			os.Exit(1)
+		}
+		slog.Info("pending release promoted", "tag", tag)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(promotePendingCmd)
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+)
+
+// deploysInProgress counts the canary releases, rollouts and rollbacks running on this node
+// by repository, so that a deploy of a repository doesn't make the others unready.
+var (
+	deployMu          sync.Mutex
+	deploysInProgress = map[string]int{}
+)
+
+// startDeploy marks a deploy of repo in progress until the returned func is called.
+func startDeploy(repo string) func() {
+	deployMu.Lock()
+	defer deployMu.Unlock()
+	deploysInProgress[repo]++
+	return func() {
+		deployMu.Lock()
+		defer deployMu.Unlock()
+		deploysInProgress[repo]--
+	}
+}
+
+func deployInProgress(repo string) bool {
+	deployMu.Lock()
+	defer deployMu.Unlock()
+	return deploysInProgress[repo] > 0
+}
+
+type readiness struct {
+	Ready      bool   `json:"ready"`
+	CurrentTag string `json:"current_tag"`
+	TargetTag  string `json:"target_tag"`
+	InProgress bool   `json:"in_progress"`
+	Error      string `json:"error,omitempty"`
+}
+
+// newReadinessHandler returns 200 only when this node runs the stable tag and no deploy is in progress.
+func newReadinessHandler(repo string, state lib.Stater) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ret := readiness{InProgress: deployInProgress(repo)}
+		current, err := state.GetLastInstalledTag()
+		if err == nil {
+			ret.CurrentTag = current
+			ret.TargetTag, err = state.CurrentStableTag()
+		}
+		if err != nil {
+			ret.Error = err.Error()
+		}
+		ret.Ready = err == nil && !ret.InProgress && ret.CurrentTag != "" && ret.CurrentTag == ret.TargetTag
+
+		code := http.StatusOK
+		if !ret.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(ret); err != nil {
+			slog.Debug("failed to write readiness", "err", err)
+		}
+	})
+}
+
+// startReadinessServer serves the readiness of each repository on /readyz/<repo>,
+// and on /readyz too without repos.
+func startReadinessServer(ctx context.Context, config *lib.Config, configs []*lib.Config, states []lib.Stater) error {
+	mux := http.NewServeMux()
+	for i, c := range configs {
+		mux.Handle("/readyz/"+c.Repo, newReadinessHandler(c.Repo, states[i]))
+	}
+	if len(configs) == 1 {
+		mux.Handle("/readyz", newReadinessHandler(configs[0].Repo, states[0]))
+	}
+
+	l, err := net.Listen("tcp", config.ReadinessAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen readiness: %s", err)
+	}
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(fmt.Sprintf("readiness server stopped: %s", err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	slog.Info("readiness server started", "addr", l.Addr().String())
+	return nil
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/pyama86/git-assets-canary-releaser/testutils"
+	"github.com/tj/assert"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisClient.Del(context.Background(), "foo/bar_stable_release_tag")
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), "foo/bar_stable_release_tag")
+		os.Unsetenv("TEST_VERSION")
+	})
+
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	state, err := lib.NewState(&lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		VersionCommand: "../testdata/echo_version.sh",
+	})
+	assert.NoError(t, err)
+	os.Setenv("TEST_VERSION", "v1.0.0")
+
+	get := func() (int, readiness) {
+		rec := httptest.NewRecorder()
+		newReadinessHandler("foo/bar", state).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var ret readiness
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+		return rec.Code, ret
+	}
+
+	redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "v1.1.0", 0)
+	code, ret := get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, readiness{CurrentTag: "v1.0.0", TargetTag: "v1.1.0"}, ret)
+
+	redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "v1.0.0", 0)
+	code, ret = get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, ret.Ready)
+
+	// a deploy of another repository doesn't affect the readiness
+	done := startDeploy("foo/baz")
+	code, _ = get()
+	assert.Equal(t, http.StatusOK, code)
+	done()
+
+	done = startDeploy("foo/bar")
+	code, ret = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.True(t, ret.InProgress)
+	done()
+	code, _ = get()
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+)
+
+type failureAction int
+
+const (
+	// actionDefault keeps the built-in behavior of the phase
+	actionDefault failureAction = iota
+	actionRetry
+	actionAbort
+	actionRollback
+)
+
+func (a failureAction) String() string {
+	switch a {
+	case actionRetry:
+		return "retry"
+	case actionAbort:
+		return "abort"
+	case actionRollback:
+		return "rollback"
+	}
+	return "default"
+}
+
+// env values larger than this are rejected by execve
+const maxFailureOutputLen = 64 * 1024
+
+// decideFailureAction runs retry_decision_command with the failure context.
+// exit 0 means retry, 1 abort, 2 rollback and others keep the default behavior.
+func decideFailureAction(ctx context.Context, config *lib.Config, phase, tag string, attempt uint, failure error) failureAction {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(failure, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+
+	output := failure.Error()
+	if len(output) > maxFailureOutputLen {
+		output = output[len(output)-maxFailureOutputLen:]
+	}
+
+	out, err := executeCommand(ctx, config, config.RetryDecisionCommand, tag, "", time.Minute,
+		fmt.Sprintf("FAILURE_PHASE=%s", phase),
+		fmt.Sprintf("FAILURE_EXIT_CODE=%d", exitCode),
+		fmt.Sprintf("FAILURE_ATTEMPT=%d", attempt),
+		fmt.Sprintf("FAILURE_OUTPUT=%s", output),
+	)
+
+	action := actionDefault
+	if err == nil {
+		action = actionRetry
+	} else if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case 1:
+			action = actionAbort
+		case 2:
+			action = actionRollback
+		}
+	} else {
+		repoLogger(config).Warn("retry decision command failed", slog.String("err", err.Error()), slog.String("out", string(out)))
+	}
+	repoLogger(config).Info("retry decision", "phase", phase, "tag", tag, "attempt", attempt, "action", action.String())
+	return action
+}
+
+// withRetryDecision runs f and asks retry_decision_command what to do when it fails.
+// f is retried while the command asks to retry, up to retry_decision_max_attempts.
+func withRetryDecision(ctx context.Context, config *lib.Config, phase, tag string, f func() error) (failureAction, error) {
+	for attempt := uint(1); ; attempt++ {
+		err := f()
+		if err == nil || config.RetryDecisionCommand == "" || ctx.Err() != nil || errors.Is(err, lib.ErrCanaryAborted) {
+			return actionDefault, err
+		}
+
+		action := decideFailureAction(ctx, config, phase, tag, attempt, err)
+		if action != actionRetry {
+			return action, err
+		}
+		if attempt >= config.RetryDecisionMaxAttempts {
+			repoLogger(config).Warn("retry decision attempts exhausted", "phase", phase, "tag", tag, "attempt", attempt)
+			return actionDefault, err
+		}
+		repoLogger(config).Warn("retry by retry decision command", "phase", phase, "tag", tag, "attempt", attempt)
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/tj/assert"
+)
+
+func TestWithRetryDecision(t *testing.T) {
+	tests := []struct {
+		name       string
+		command    string
+		failTimes  int
+		wantAction failureAction
+		wantCalls  int
+		wantErr    bool
+	}{
+		{
+			name:       "no decision command",
+			command:    "",
+			failTimes:  1,
+			wantAction: actionDefault,
+			wantCalls:  1,
+			wantErr:    true,
+		},
+		{
+			name:       "retry until success",
+			command:    "exit 0",
+			failTimes:  1,
+			wantAction: actionDefault,
+			wantCalls:  2,
+		},
+		{
+			name:       "retry exhausted",
+			command:    "exit 0",
+			failTimes:  10,
+			wantAction: actionDefault,
+			wantCalls:  3,
+			wantErr:    true,
+		},
+		{
+			name:       "abort",
+			command:    "exit 1",
+			failTimes:  10,
+			wantAction: actionAbort,
+			wantCalls:  1,
+			wantErr:    true,
+		},
+		{
+			name:       "rollback",
+			command:    `test "$FAILURE_PHASE" = deploy && exit 2`,
+			failTimes:  10,
+			wantAction: actionRollback,
+			wantCalls:  1,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &lib.Config{
+				RetryDecisionCommand:     tt.command,
+				RetryDecisionMaxAttempts: 3,
+			}
+			calls := 0
+			action, err := withRetryDecision(context.Background(), config, "deploy", "v1.0.0", func() error {
+				calls++
+				if calls <= tt.failTimes {
+					return errors.New("failed")
+				}
+				return nil
+			})
+			assert.Equal(t, tt.wantAction, action)
+			assert.Equal(t, tt.wantCalls, calls)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
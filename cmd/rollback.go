@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var rollbackTagName string
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Roll back this node to the previous stable tag (or the given tag) and save it as the stable tag.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		state, err := lib.NewStater(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		github, err := lib.NewGitHuber(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init github: %s", err))
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
+		tag, err := rollbackRelease(ctx, config, rollbackTagName, state, github)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to rollback: %s", err))
+			os.Exit(1)
+		}
+		slog.Info("rollback success and saved as the stable tag", "tag", tag)
+	},
+}
+
+// rollbackRelease reverts to tag, or the previous stable tag in the release history when tag is empty.
+// The current stable tag is avoided so that the canary release doesn't pick it up again.
+func rollbackRelease(ctx context.Context, config *lib.Config, tag string, state lib.Stater, github lib.GitHuber) (string, error) {
+	if config.RollbackCommand == "" {
+		return "", errors.Wrap(ErrNoRollback, "rollback_command is not set")
+	}
+
+	stableTag, err := state.CurrentStableTag()
+	if err != nil {
+		return "", err
+	}
+	if tag == "" {
+		tag, err = previousStableTag(state, stableTag)
+		if err != nil {
+			return "", err
+		}
+	}
+	if tag == stableTag {
+		return "", fmt.Errorf("%s is already the stable tag", tag)
+	}
+
+	err = handleRollback(ctx, tag, fmt.Sprintf("manual rollback from %s", stableTag), config, state, github)
+	if !errors.Is(err, ErrRollback) {
+		return "", err
+	}
+
+	if err := state.SaveStableReleaseTag(tag); err != nil {
+		return "", fmt.Errorf("can't save stable tag:%s", err)
+	}
+	if stableTag != "" {
+		if err := state.SaveAvoidReleaseTag(stableTag, fmt.Sprintf("manual rollback to %s", tag), ""); err != nil {
+			return "", fmt.Errorf("can't save avoid tag:%s", err)
+		}
+	}
+	if err := state.SaveMemberState(); err != nil {
+		slog.Error(fmt.Sprintf("failed to save state: %s", err))
+	}
+	return tag, nil
+}
+
+// previousStableTag finds the newest stable tag in the release history other than the current one.
+func previousStableTag(state lib.Stater, stableTag string) (string, error) {
+	history, err := state.GetReleaseHistory(0)
+	if err != nil {
+		return "", err
+	}
+	for _, h := range history {
+		if h.Action == lib.ReleaseActionStable && h.Tag != stableTag {
+			return h.Tag, nil
+		}
+	}
+	return "", errors.New("previous stable tag is not found in the release history, specify --tag")
+}
+
+func init() {
+	rollbackCmd.Flags().StringVar(&rollbackTagName, "tag", "", "release tag to roll back to (default is the previous stable tag)")
+	rootCmd.AddCommand(rollbackCmd)
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/pyama86/git-assets-canary-releaser/testutils"
+	"github.com/tj/assert"
+)
+
+func TestRollbackRelease(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	keys := []string{"foo/bar_stable_release_tag", "foo/bar_avoid_release_tag", "foo/bar_release_history"}
+	redisClient.Del(context.Background(), keys...)
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), keys...)
+	})
+
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		VersionCommand: "../testdata/echo_version.sh",
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	assert.NoError(t, state.SaveStableReleaseTag("v1.0.0"))
+	assert.NoError(t, state.SaveStableReleaseTag("v1.1.0"))
+
+	mockGitHub := new(MockGitHuber)
+	_, err = rollbackRelease(context.Background(), config, "", state, mockGitHub)
+	assert.True(t, errors.Is(err, ErrNoRollback))
+
+	config.RollbackCommand = "../testdata/always_succes.sh"
+	mockGitHub.On("DownloadReleaseAssets", "v1.0.0").Return("v1.0.0", []string{"assetfile"}, nil)
+	tag, err := rollbackRelease(context.Background(), config, "", state, mockGitHub)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+	assert.Equal(t, float64(1), testutil.ToFloat64(deployedTagGauge.WithLabelValues(config.Repo, "v1.0.0")))
+	mockGitHub.AssertExpectations(t)
+
+	stableTag, err := state.CurrentStableTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", stableTag)
+	assert.Equal(t, lib.ErrAvoidReleaseTag, state.IsAvoidReleaseTag("v1.1.0"))
+
+	history, err := state.GetReleaseHistory(2)
+	assert.NoError(t, err)
+	assert.Equal(t, lib.ReleaseActionStable, history[0].Action)
+	assert.Equal(t, lib.ReleaseActionRollback, history[1].Action)
+	assert.Equal(t, "manual rollback from v1.1.0", history[1].Reason)
+
+	_, err = rollbackRelease(context.Background(), config, "v1.0.0", state, mockGitHub)
+	assert.Error(t, err)
+}
@@ -4,15 +4,21 @@ Copyright © 2023 pyama86 <www.kazu.com@gmail.com>
 package cmd
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/avast/retry-go"
@@ -20,14 +26,18 @@ import (
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/pyama86/git-assets-canary-releaser/lib"
-	slogmulti "github.com/samber/slog-multi"
-	slogslack "github.com/samber/slog-slack/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
-var cfgFile string
+var cfgFiles []string
+
+// isCanaryFlag is looked up by loadConfig because is_canary is not bound to viper.
+var isCanaryFlag *pflag.Flag
 
 var rootCmd = &cobra.Command{
 	Use:   "git-assets-canary-releaser",
@@ -40,6 +50,18 @@ var rootCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		configs, err := config.RepoConfigs()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+		for _, c := range configs {
+			if err := validateServerConfig(c); err != nil {
+				slog.Error(fmt.Sprintf("failed to validate config of %s: %s", c.Repo, err))
+				os.Exit(1)
+			}
+		}
+
 		logger, err := getLogger(config, config.LogLevel)
 		if err != nil {
 			slog.Error(fmt.Sprintf("failed to init logger: %s", err))
@@ -49,41 +71,192 @@ var rootCmd = &cobra.Command{
 
 		if err := runServer(config); err != nil {
 			slog.Error(fmt.Sprintf("failed to run server: %s", err))
-			// wait for slack notification
-			// https://github.com/samber/slog-slack/blob/main/handler.go#L89
-			if config.SlackWebhookURL != "" {
-				time.Sleep(3 * time.Second)
-			}
+			notify(config, notification{Event: eventError, Message: fmt.Sprintf("failed to run server: %s", err)})
 			os.Exit(1)
 		}
 	},
 }
 
-func deploy(cmd, targetTag string, state *lib.State, github lib.GitHuber) (string, string, error) {
-	tag, downloadFile, err := github.DownloadReleaseAsset(targetTag)
+func deploy(ctx context.Context, config *lib.Config, cmd, targetTag string, state lib.Stater, github lib.GitHuber) (tag string, file string, err error) {
+	ctx, span := tracer.Start(ctx, "deploy", trace.WithAttributes(attribute.String("tag", targetTag), attribute.String("command", cmd)))
+	defer func() { endSpan(span, err) }()
+
+	if config.DeployFromStdin {
+		return deployFromStdin(ctx, config, cmd, targetTag, state, github)
+	}
+
+	_, downloadSpan := tracer.Start(ctx, "download", trace.WithAttributes(attribute.String("tag", targetTag)))
+	tag, downloadFiles, err := github.DownloadReleaseAssets(ctx, targetTag)
+	endSpan(downloadSpan, err)
 	if err != nil {
-		return "", "", fmt.Errorf("can't get release asset:%s %s", tag, err)
+		return "", "", fmt.Errorf("can't get release asset:%s %w", tag, err)
 	}
+	downloadFile := downloadFiles[0]
 
 	currentVersion, err := state.GetLastInstalledTag()
 	if err != nil {
 		return "", "", fmt.Errorf("can't get current version:%s", err)
 	}
 
-	slog.Info("deploy version info", slog.String("current_version", currentVersion), slog.String("new_version", tag))
+	repoLogger(config).Info("deploy version info", slog.String("current_version", currentVersion), slog.String("new_version", tag))
 
-	out, err := executeCommand(cmd, tag, downloadFile, 5*time.Minute)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to execute command: %s, %s", err, out)
+	env := []string{fmt.Sprintf("ASSET_FILES=%s", strings.Join(downloadFiles, "\n")), previousTagEnv(currentVersion)}
+	if config.Snapshot && !config.DryRun {
+		dir, err := lib.SaveSnapshot(config.SaveAssetsPath, tag, downloadFiles...)
+		if err != nil {
+			return "", "", err
+		}
+		env = append(env,
+			fmt.Sprintf("SNAPSHOT_DIR=%s", dir),
+			fmt.Sprintf("CURRENT_LINK=%s", lib.SnapshotCurrentLink(config.SaveAssetsPath)),
+		)
+	}
+	if config.ExtractAssets && !config.DryRun {
+		dir, err := lib.ExtractAssets(config.SaveAssetsPath, tag, downloadFiles...)
+		if err != nil {
+			return "", "", err
+		}
+		env = append(env, fmt.Sprintf("ASSET_DIR=%s", dir))
+	}
+
+	if config.DryRun {
+		repoLogger(config).Info("dry run: skip deploy", "command", cmd, "tag", tag, "asset_file", downloadFile, "env", env)
+		return tag, downloadFile, nil
+	}
+
+	if err := runDeployHook(ctx, config, "pre deploy", config.PreDeployCommand, tag, downloadFile, env...); err != nil {
+		return "", "", err
+	}
+	out, err := executeCommand(ctx, config, cmd, tag, downloadFile, 5*time.Minute, env...)
+	state.ForgetInstalledTag()
+	skipped := deploySkipped(config, err)
+	if err != nil && !skipped {
+		return "", "", fmt.Errorf("failed to execute command: %w, %s", err, out)
 	}
+	if err := runDeployHook(ctx, config, "post deploy", config.PostDeployCommand, tag, downloadFile, env...); err != nil {
+		return "", "", fmt.Errorf("%w: %s", ErrPostDeploy, err)
+	}
+	if skipped {
+		repoLogger(config).Info("deploy command reported the release is already deployed", "tag", tag)
+		setDeployedTagMetric(config.Repo, tag)
+		return tag, downloadFile, ErrDeploySkipped
+	}
+
+	if config.Snapshot {
+		if err := lib.SwitchSnapshot(config.SaveAssetsPath, tag); err != nil {
+			return "", "", err
+		}
+	}
+	if config.ExtractAssets {
+		if err := lib.PruneExtracted(config.SaveAssetsPath, tag); err != nil {
+			repoLogger(config).Error(fmt.Sprintf("failed to prune extracted assets: %s", err))
+		}
+	}
+	saveDeployRecord(state, tag)
+	setDeployedTagMetric(config.Repo, tag)
+	pruneAssets(config, state, tag, downloadFiles)
 	return tag, downloadFile, nil
 }
 
-func handleRollout(config *lib.Config, github lib.GitHuber, state *lib.State) error {
+// deployFromStdin streams the asset to stdin of the command so that nothing is written to disk.
+// ASSET_FILE is set to "-".
+func deployFromStdin(ctx context.Context, config *lib.Config, cmd, targetTag string, state lib.Stater, github lib.GitHuber) (string, string, error) {
+	_, downloadSpan := tracer.Start(ctx, "download", trace.WithAttributes(attribute.String("tag", targetTag)))
+	tag, body, err := github.OpenReleaseAsset(ctx, targetTag)
+	endSpan(downloadSpan, err)
+	if err != nil {
+		return "", "", fmt.Errorf("can't get release asset:%s %w", tag, err)
+	}
+	defer body.Close()
+
+	currentVersion, err := state.GetLastInstalledTag()
+	if err != nil {
+		return "", "", fmt.Errorf("can't get current version:%s", err)
+	}
+
+	repoLogger(config).Info("deploy version info", slog.String("current_version", currentVersion), slog.String("new_version", tag))
+
+	if config.DryRun {
+		repoLogger(config).Info("dry run: skip deploy", "command", cmd, "tag", tag, "asset_file", stdinAssetFile)
+		return tag, stdinAssetFile, nil
+	}
+
+	env := previousTagEnv(currentVersion)
+	if err := runDeployHook(ctx, config, "pre deploy", config.PreDeployCommand, tag, stdinAssetFile, env); err != nil {
+		return "", "", err
+	}
+	out, err := executeCommandWithStdin(ctx, config, body, cmd, tag, stdinAssetFile, 5*time.Minute, env)
+	state.ForgetInstalledTag()
+	skipped := deploySkipped(config, err)
+	if err != nil && !skipped {
+		return "", "", fmt.Errorf("failed to execute command: %w, %s", err, out)
+	}
+	if err := runDeployHook(ctx, config, "post deploy", config.PostDeployCommand, tag, stdinAssetFile, env); err != nil {
+		return "", "", fmt.Errorf("%w: %s", ErrPostDeploy, err)
+	}
+	if skipped {
+		repoLogger(config).Info("deploy command reported the release is already deployed", "tag", tag)
+		setDeployedTagMetric(config.Repo, tag)
+		return tag, stdinAssetFile, ErrDeploySkipped
+	}
+	saveDeployRecord(state, tag)
+	setDeployedTagMetric(config.Repo, tag)
+	return tag, stdinAssetFile, nil
+}
+
+// pruneAssets only logs on failure because the deploy itself has already succeeded.
+// The deployed and the stable assets are kept.
+func pruneAssets(config *lib.Config, state lib.Stater, tag string, files []string) {
+	if config.KeepAssets <= 0 {
+		return
+	}
+	stableTag, err := state.CurrentStableTag()
+	if err != nil {
+		repoLogger(config).Error(fmt.Sprintf("failed to get stable tag, skip pruning assets: %s", err))
+		return
+	}
+	if _, err := lib.PruneAssets(config, files, tag, stableTag); err != nil {
+		repoLogger(config).Error(fmt.Sprintf("failed to prune assets: %s", err))
+	}
+}
+
+// runDeployHook runs pre_deploy_command or post_deploy_command around the deploy and
+// rollback commands with the same environment variables.
+func runDeployHook(ctx context.Context, config *lib.Config, name, command, tag, file string, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	out, err := executeCommand(ctx, config, command, tag, file, 5*time.Minute, env...)
+	if err != nil {
+		return fmt.Errorf("%s command failed: %w, %s", name, err, out)
+	}
+	repoLogger(config).Info(name+" command success", "tag", tag)
+	return nil
+}
+
+// deploySkipped reports whether the command exited with deploy_skip_exit_code, which means
+// the release is already deployed and nothing was done.
+func deploySkipped(config *lib.Config, err error) bool {
+	var exitErr *exec.ExitError
+	return config.DeploySkipExitCode > 0 && errors.As(err, &exitErr) && exitErr.ExitCode() == config.DeploySkipExitCode
+}
+
+// saveDeployRecord only logs on failure because the deploy itself has already succeeded.
+func saveDeployRecord(state lib.Stater, tag string) {
+	if err := state.SaveDeployRecord(tag); err != nil {
+		slog.Error(fmt.Sprintf("failed to save deploy record: %s", err), "tag", tag)
+	}
+}
+
+func handleRollout(ctx context.Context, config *lib.Config, github lib.GitHuber, state lib.Stater) error {
 	if err := state.SaveMemberState(); err != nil {
 		return err
 	}
 
+	if err := checkHeld(state); err != nil {
+		return err
+	}
+
 	tag, err := state.CurrentStableTag()
 	if err != nil {
 		return err
@@ -93,37 +266,300 @@ func handleRollout(config *lib.Config, github lib.GitHuber, state *lib.State) er
 		return nil
 	}
 
+	checkRolloutStall(config, state, tag)
+
 	if err := state.CanInstallTag(tag); err != nil {
 		return err
 	}
+	if err := checkDeployBackoff(config, state, tag); err != nil {
+		return err
+	}
 	got, err := state.TryRolloutLock(tag)
 	if err != nil {
 		return err
 	}
 	if got {
-		slog.Info("lock success and start rollout", "tag", tag)
-		if _, _, err := deploy(config.DeployCommand, tag, state, github); err != nil {
+		repoLogger(config).Info("lock success and start rollout", "tag", tag)
+		defer startDeploy(config.Repo)()
+		stopKeepLock := keepLock(ctx, config, "rollout", state.ExtendRolloutLock, lib.RolloutLockTTL(config))
+		defer stopKeepLock()
+		// release the lock when shutdown aborted the rollout so that other nodes can take over,
+		// and the place in the rollout batch when the deploy failed or rolled back
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if ctx.Err() != nil {
+				repoLogger(config).Info("release rollout lock on shutdown", "tag", tag)
+				if err := state.UnlockRollout(); err != nil {
+					repoLogger(config).Error(fmt.Sprintf("failed to unlock rollout: %s", err))
+				}
+				return
+			}
+			if err := state.ReleaseRolloutBatch(); err != nil {
+				repoLogger(config).Error(fmt.Sprintf("failed to release rollout batch: %s", err))
+			}
+		}()
+		if config.NotifyRolloutStart {
+			first, err := state.MarkRolloutStarted(tag)
+			if err != nil {
+				repoLogger(config).Error(fmt.Sprintf("failed to mark rollout started: %s", err))
+			} else if first {
+				repoLogger(config).Info("full rollout starting", "tag", tag)
+			}
+		}
+		lastInstalledTag, err := state.GetLastInstalledTag()
+		if err != nil {
+			return err
+		}
+
+		var filename string
+		skipped := false
+		action, err := withRetryDecision(ctx, config, "deploy", tag, func() error {
+			var err error
+			_, filename, err = deploy(ctx, config, config.DeployCommand, tag, state, github)
+			if errors.Is(err, ErrDeploySkipped) {
+				skipped = true
+				return nil
+			}
+			return err
+		})
+		recordDeployResult(config, state, tag, err)
+		if err != nil {
+			if (action == actionRollback || errors.Is(err, ErrPostDeploy)) && lastInstalledTag != "" {
+				repoLogger(config).Error("deploy command failed", slog.String("err", err.Error()))
+				countRolloutRollback(state, tag)
+				return handleRollback(ctx, lastInstalledTag, fmt.Sprintf("deploy command of %s failed", tag), config, state, github)
+			}
 			return errors.Wrap(err, "deploy command failed")
 		}
 
+		if config.TrustPeerHealth > 0 && !skipped {
+			if out, err := verifyRollout(ctx, config, state, tag, lastInstalledTag, filename); err != nil {
+				repoLogger(config).Error("rollout health check failed", slog.String("err", err.Error()), slog.String("out", out))
+				if lastInstalledTag != "" {
+					countRolloutRollback(state, tag)
+					return handleRollback(ctx, lastInstalledTag, fmt.Sprintf("rollout health check of %s failed", tag), config, state, github)
+				}
+				return errors.Wrap(err, "rollout health check failed")
+			}
+		}
+
+		completed = true
 		if err := state.SaveMemberState(); err != nil {
-			slog.Error(fmt.Sprintf("failed to save state: %s", err))
+			repoLogger(config).Error(fmt.Sprintf("failed to save state: %s", err))
 		}
 
 		installed, all, err := state.GetRolloutProgress(tag)
 		if err != nil {
 			return err
 		}
-		slog.Info("rollout success", "tag", tag, "progress", fmt.Sprintf("%d/%d", installed, all))
+		setRolloutProgressMetric(config.Repo, installed, all)
+		repoLogger(config).Info("rollout success", "tag", tag, "progress", fmt.Sprintf("%d/%d", installed, all))
+		notify(config, notification{Event: eventRolloutSuccess, Tag: tag, Installed: installed, All: all})
+
+		if rolloutCompleted(config, installed, all) {
+			first, err := state.MarkRolloutComplete(tag)
+			if err != nil {
+				return err
+			}
+			if first {
+				reportRolloutComplete(config, state, tag, installed, all)
+				if config.PostRolloutVerifyCommand != "" {
+					if out, err := verifyFleet(ctx, config, state, tag); err != nil {
+						repoLogger(config).Error("post rollout verification failed", slog.String("tag", tag), slog.String("err", err.Error()), slog.String("out", out))
+					} else {
+						repoLogger(config).Info("post rollout verification success", "tag", tag)
+					}
+				}
+			}
+		}
+	} else {
+		logDecision(config, "rollout", "skip rollout", tag, "lock not acquired")
 	}
 	return nil
 }
 
-func handleCanaryRelease(config *lib.Config, github lib.GitHuber, state *lib.State) error {
+var (
+	stallMu sync.Mutex
+	// stallProgress is keyed by the repository because the repos roll out independently
+	stallProgress = map[string]rolloutStallProgress{}
+)
+
+// rolloutStallProgress is the rollout progress seen at the last rollout window.
+type rolloutStallProgress struct {
+	tag       string
+	installed int
+	all       int
+	windows   uint
+}
+
+// checkRolloutStall notifies the lagging members when the installed fraction of tag
+// hasn't increased for rollout_stall_windows rollout windows. Every node checks
+// the progress, but only the first node notifies a stall at the same progress.
+func checkRolloutStall(config *lib.Config, state lib.Stater, tag string) {
+	if config.RolloutStallWindows == 0 {
+		return
+	}
+
+	installed, all, err := state.GetRolloutProgress(tag)
+	if err != nil {
+		repoLogger(config).Warn(fmt.Sprintf("failed to get rollout progress: %s", err))
+		return
+	}
+
+	stallMu.Lock()
+	last := stallProgress[config.Repo]
+	advanced := last.tag != tag || installed*last.all > last.installed*all
+	progress := rolloutStallProgress{tag: tag, installed: installed, all: all}
+	if !advanced && installed < all {
+		progress = last
+		progress.windows++
+	}
+	stallProgress[config.Repo] = progress
+	windows := progress.windows
+	stallMu.Unlock()
+
+	if windows != config.RolloutStallWindows {
+		return
+	}
+
+	first, err := state.MarkRolloutStalled(tag, installed)
+	if err != nil {
+		repoLogger(config).Error(fmt.Sprintf("failed to mark rollout stalled: %s", err))
+		return
+	}
+	if !first {
+		return
+	}
+
+	states, err := state.MemberStates()
+	if err != nil {
+		repoLogger(config).Error(fmt.Sprintf("failed to get member states: %s", err))
+		return
+	}
+	var lagging []string
+	for host, s := range states {
+		if s.CurrentVersion != tag {
+			lagging = append(lagging, fmt.Sprintf("%s=%s", host, s.CurrentVersion))
+		}
+	}
+	sort.Strings(lagging)
+
+	rolloutStallCounter.WithLabelValues(config.Repo).Inc()
+	repoLogger(config).Warn("rollout stalled", "tag", tag, "progress", fmt.Sprintf("%d/%d", installed, all), "lagging", lagging)
+	notify(config, notification{
+		Event:     eventRolloutStalled,
+		Tag:       tag,
+		Message:   fmt.Sprintf("lagging hosts: %s", strings.Join(lagging, ", ")),
+		Installed: installed,
+		All:       all,
+	})
+}
+
+// verifyRollout skips the full health check and only runs liveness_check_command
+// when another node verified tag healthy within trust_peer_health.
+func verifyRollout(ctx context.Context, config *lib.Config, state lib.Stater, tag, previousTag, file string) (string, error) {
+	attestation, err := state.HealthAttestation(tag)
+	if err != nil {
+		repoLogger(config).Warn(fmt.Sprintf("failed to get health attestation: %s", err))
+	}
+	if attestation == nil {
+		repoLogger(config).Info("no peer health attestation and start health check", "tag", tag)
+		return runHealthCheck(ctx, config, state, tag, previousTag, file)
+	}
+
+	repoLogger(config).Info("trust peer health attestation", "tag", tag, "host", attestation.Host, "verified_at", attestation.VerifiedAt)
+	if config.LivenessCheckCommand == "" {
+		return "", nil
+	}
+	out, err := executeCommand(ctx, config, config.LivenessCheckCommand, tag, file, config.HealthCheckTimeout, previousTagEnv(previousTag))
+	if err != nil {
+		return string(out), fmt.Errorf("liveness check command failed: %w", err)
+	}
+	return string(out), nil
+}
+
+// reportRolloutComplete emits the summary of the rollout. It is called only by the
+// node which marked the rollout complete.
+func reportRolloutComplete(config *lib.Config, state lib.Stater, tag string, installed, all int) {
+	attrs := []any{"tag", tag, "progress", fmt.Sprintf("%d/%d", installed, all), "nodes", all}
+	report, err := state.RolloutReport(tag)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to get rollout report: %s", err))
+	}
+	if report != nil {
+		attrs = append(attrs,
+			"duration", lib.ClockOf(config).Now().Sub(report.StartedAt).Round(time.Second).String(),
+			"rollbacks", report.Rollbacks,
+		)
+	}
+	slog.Info("rollout complete", attrs...)
+}
+
+// verifyFleet runs post_rollout_verify_command with the version distribution of the fleet
+// given as JSON to stdin, e.g. {"tag":"v1.1.0","versions":{"v1.1.0":9,"v1.0.0":1},"avoid_tags":[]}.
+func verifyFleet(ctx context.Context, config *lib.Config, state lib.Stater, tag string) (string, error) {
+	versions, err := state.VersionDistribution()
+	if err != nil {
+		return "", fmt.Errorf("can't get version distribution:%s", err)
+	}
+	avoidTags, err := state.AvoidReleaseTags()
+	if err != nil {
+		return "", fmt.Errorf("can't get avoid tags:%s", err)
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"tag":        tag,
+		"versions":   versions,
+		"avoid_tags": avoidTags,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	out, err := executeCommandWithStdin(ctx, config, bytes.NewReader(b), config.PostRolloutVerifyCommand, tag, "", 5*time.Minute)
+	return string(out), err
+}
+
+func countRolloutRollback(state lib.Stater, tag string) {
+	if err := state.CountRolloutRollback(tag); err != nil {
+		slog.Error(fmt.Sprintf("failed to count rollout rollback: %s", err))
+	}
+}
+
+// rolloutCompleted reports whether installed/all reached rollout_complete_threshold percent.
+// Members that stopped reporting are already pruned by GetRolloutProgress.
+func rolloutCompleted(config *lib.Config, installed, all int) bool {
+	if all == 0 {
+		return false
+	}
+	threshold := config.RolloutCompleteThreshold
+	if threshold == 0 {
+		threshold = 100
+	}
+	return installed*100 >= all*int(threshold)
+}
+
+func handleCanaryRelease(ctx context.Context, config *lib.Config, github lib.GitHuber, state lib.Stater) error {
 	if err := state.SaveMemberState(); err != nil {
 		return err
 	}
 
+	if err := checkHeld(state); err != nil {
+		return err
+	}
+
+	// only the designated canaries try the new release when is_canary or canary_hosts is set
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	if !lib.CanaryEligible(config, hostname) {
+		return nil
+	}
+
 	// ロールバックのためにインストール前にインストール前のバージョンを取得しておく
 	lastInstalledTag, err := state.GetLastInstalledTag()
 	if err != nil {
@@ -135,211 +571,1079 @@ func handleCanaryRelease(config *lib.Config, github lib.GitHuber, state *lib.Sta
 		return err
 	}
 
-	tag, _, err := github.DownloadReleaseAsset(lib.LatestTag)
+	tag, err := latestReleaseTag(ctx, config, github)
 	if err != nil {
-		return fmt.Errorf("can't get release asset:%s %s", tag, err)
+		return fmt.Errorf("can't get release asset:%s %w", tag, err)
 	}
 
 	if tag == stableTab {
+		logDecision(config, "canary_release", "skip release", tag, "stable")
 		return nil
 	}
+	logDecision(config, "canary_release_detected", "new release detected", tag, "")
+
+	if config.ConfirmPolls > 1 && !viper.GetBool("once") {
+		if n := state.ObserveLatestTag(tag); n < config.ConfirmPolls {
+			return errors.Wrap(lib.ErrUnconfirmedRelease, fmt.Sprintf("tag:%s observed:%d/%d", tag, n, config.ConfirmPolls))
+		}
+	}
 
-	err = state.CanInstallTag(tag)
+	resumed, err := interruptedDeploy(state, tag)
 	if err != nil {
+		if errors.Is(err, lib.ErrDeployInterrupted) {
+			logDecision(config, "canary_release", "skip release", tag, "deploy interrupted")
+		}
 		return err
 	}
 
+	if resumed != nil {
+		// another node may have avoided the tag while this node was down
+		if err := state.IsAvoidReleaseTag(tag); err != nil {
+			if errors.Is(err, lib.ErrAvoidReleaseTag) {
+				logDecision(config, "canary_release", "skip release", tag, "avoid")
+				clearDeployProgress(state)
+			}
+			return err
+		}
+		// the tag has been installed before the restart, so the rollback goes back to the tag before it
+		lastInstalledTag = resumed.PreviousTag
+		logDecision(config, "canary_release", "resume release", tag, "deploy interrupted")
+	} else {
+		err = state.CanInstallTag(tag)
+		if err != nil {
+			switch {
+			case errors.Is(err, lib.ErrAvoidReleaseTag):
+				logDecision(config, "canary_release", "skip release", tag, "avoid")
+			case errors.Is(err, lib.ErrAlreadyInstalled):
+				logDecision(config, "canary_release", "skip release", tag, "already installed")
+			}
+			return err
+		}
+
+		if config.HoldNewRelease {
+			if err := holdNewRelease(tag, state); err != nil {
+				return err
+			}
+		}
+
+		if err := checkDeployBackoff(config, state, tag); err != nil {
+			logDecision(config, "canary_release", "skip release", tag, "deploy backoff")
+			return err
+		}
+	}
+
 	got, err := state.TryCanaryReleaseLock(tag)
 	if err != nil {
 		return err
 	}
 
 	if got {
-		slog.Info("lock success and start canary release", "tag", tag)
-		if tag, filename, err := deploy(config.DeployCommand, tag, state, github); err != nil {
-			return errors.Wrap(err, "deploy command failed")
+		repoLogger(config).Info("lock success and start canary release", "tag", tag)
+		defer startDeploy(config.Repo)()
+		// the lock taken with the short lease of canary_lock_heartbeat expires soon after this node crashes
+		lease := lib.CanaryLockLease(config)
+		stopKeepLock := keepLock(ctx, config, "canary release", func() (bool, error) {
+			return state.ExtendCanaryReleaseLock(lease)
+		}, lease)
+		completed, unlocked, deployed := false, false, resumed != nil
+		defer func() {
+			stopKeepLock()
+			// release the lock when shutdown aborted the canary release so that other nodes can take over
+			if ctx.Err() != nil && !completed {
+				repoLogger(config).Info("release canary release lock on shutdown", "tag", tag)
+				if err := state.UnlockCanaryRelease(); err != nil {
+					repoLogger(config).Error(fmt.Sprintf("failed to unlock canary release: %s", err))
+				}
+				// the deploy command killed by the shutdown is run again after the restart,
+				// and the finished one resumes from the health check
+				if !deployed {
+					clearDeployProgress(state)
+				}
+				return
+			}
+			clearDeployProgress(state)
+			// the lock left after a failure or for the rest of the cohort guards the whole canary_lock_ttl
+			if !unlocked && lease < lib.CanaryLockTTL(config) {
+				if _, err := state.ExtendCanaryReleaseLock(lib.CanaryLockTTL(config)); err != nil {
+					repoLogger(config).Error(fmt.Sprintf("failed to extend canary release lock: %s", err))
+				}
+			}
+		}()
+		var filename string
+		skipped := false
+		deployTag := func() error {
+			if err := state.SaveDeployProgress(tag, lastInstalledTag, ""); err != nil {
+				return fmt.Errorf("can't save deploy progress:%s", err)
+			}
+			var err error
+			_, filename, err = deploy(ctx, config, config.DeployCommand, tag, state, github)
+			if errors.Is(err, ErrDeploySkipped) {
+				skipped = true
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+			deployed = true
+			if err := state.SaveDeployProgress(tag, lastInstalledTag, filename); err != nil {
+				repoLogger(config).Error(fmt.Sprintf("failed to save deploy progress: %s", err))
+			}
+			return nil
+		}
+		if resumed != nil {
+			repoLogger(config).Info("resume the interrupted canary release from health check", "tag", tag, "previous_tag", resumed.PreviousTag)
+			deployTag = func() error {
+				var err error
+				filename, err = resumedAssetFile(ctx, config, github, resumed)
+				return err
+			}
+		}
+		if action, err := withRetryDecision(ctx, config, "deploy", tag, deployTag); err != nil {
+			recordDeployResult(config, state, tag, err)
+			if action != actionRollback && !errors.Is(err, ErrPostDeploy) {
+				return errors.Wrap(err, "deploy command failed")
+			}
+			repoLogger(config).Error("deploy command failed", slog.String("err", err.Error()))
+			countCanaryReleaseMetric(config.Repo, false)
+			if err := state.SaveAvoidReleaseTag(tag, "deploy command failed", err.Error()); err != nil {
+				return fmt.Errorf("can't save avoid tag:%s", err)
+			}
+			rollbackTag, err := state.RollbackTag(lastInstalledTag)
+			if err != nil {
+				return err
+			}
+			return handleRollback(ctx, rollbackTag, fmt.Sprintf("deploy command of %s failed", tag), config, state, github)
 		} else {
-			slog.Info("deploy command success and start health check", "tag", tag, "cmd", config.HealthCheckCommand)
-			if out, err := runHealthCheck(config, tag, filename); err != nil {
-				slog.Error("health check command failed", slog.String("err", err.Error()), slog.String("out", out))
-				if err := state.SaveAvoidReleaseTag(tag); err != nil {
+			recordDeployResult(config, state, tag, nil)
+			var out string
+			healthCheck := func() error {
+				var err error
+				out, err = runHealthCheck(ctx, config, state, tag, lastInstalledTag, filename)
+				return err
+			}
+			if skipped {
+				repoLogger(config).Info("release is already deployed and skip health check", "tag", tag)
+				healthCheck = func() error { return nil }
+			} else {
+				repoLogger(config).Info("deploy command success and start health check", "tag", tag, "cmd", config.HealthCheckCommand, "url", config.HealthCheckHTTP.URL)
+			}
+			if action, err := withRetryDecision(ctx, config, "healthcheck", tag, healthCheck); err != nil {
+				if ctx.Err() != nil {
+					return fmt.Errorf("health check aborted: %w", ctx.Err())
+				}
+				repoLogger(config).Error("health check command failed", slog.String("err", err.Error()), slog.String("out", out))
+				countCanaryReleaseMetric(config.Repo, false)
+				if action == actionAbort {
+					return errors.Wrap(err, "health check failed and aborted by retry decision command")
+				}
+				if err := state.SaveAvoidReleaseTag(tag, fmt.Sprintf("health check failed: %s", err), out); err != nil {
 					return fmt.Errorf("can't save avoid tag:%s", err)
 				}
 
+				// the aborted release is always rolled back
+				onFailure := config.OnFailure
+				if errors.Is(err, lib.ErrCanaryAborted) {
+					onFailure = lib.OnFailureRollback
+				}
+				switch onFailure {
+				case lib.OnFailureHold:
+					if err := state.HoldMember(tag); err != nil {
+						return fmt.Errorf("can't hold member:%s", err)
+					}
+					repoLogger(config).Error("health check failed, hold this node on the failed release for investigation. run clear-hold to resume", "tag", tag)
+					notify(config, notification{Event: eventError, Tag: tag, Message: "health check failed, this node is held"})
+					return ErrHold
+				case lib.OnFailureAvoidOnly:
+					repoLogger(config).Error("health check failed, the release is avoided without rollback", "tag", tag)
+					notify(config, notification{Event: eventError, Tag: tag, Message: "health check failed, the release is avoided without rollback"})
+					return ErrAvoidOnly
+				}
+
 				// try rollback
 				rollbackTag, err := state.RollbackTag(lastInstalledTag)
 				if err != nil {
 					return err
 				}
-				return handleRollback(rollbackTag, config, state, github)
+				return handleRollback(ctx, rollbackTag, fmt.Sprintf("health check of %s failed", tag), config, state, github)
 			} else {
-				slog.Info("health check success", "tag", tag)
+				repoLogger(config).Info("health check success", "tag", tag)
+				if config.TrustPeerHealth > 0 && !skipped {
+					if err := state.SaveHealthAttestation(tag); err != nil {
+						repoLogger(config).Error(fmt.Sprintf("failed to save health attestation: %s", err))
+					}
+				}
+				if config.WarmupCommand != "" {
+					if out, err := executeCommand(ctx, config, config.WarmupCommand, tag, filename, 5*time.Minute); err != nil {
+						repoLogger(config).Warn("warmup command failed", slog.String("err", err.Error()), slog.String("out", string(out)))
+					} else {
+						repoLogger(config).Info("warmup command success", "tag", tag)
+					}
+				}
+
+				completed = true
+				promote, err := state.CanaryPassed(tag)
+				if err != nil {
+					return fmt.Errorf("can't save canary result:%s", err)
+				}
+				if !promote {
+					// the cohort membership is kept so that no more canaries join for the tag
+					if err := state.SaveMemberState(); err != nil {
+						repoLogger(config).Error(fmt.Sprintf("failed to save state: %s", err))
+					}
+					repoLogger(config).Info("canary passed and wait for the rest of the cohort", "tag", tag)
+					return nil
+				}
+
 				if err := state.SaveStableReleaseTag(tag); err != nil {
 					return fmt.Errorf("can't save stable tag:%s", err)
 				}
 
+				if err := state.StartRolloutReport(tag); err != nil {
+					repoLogger(config).Error(fmt.Sprintf("failed to start rollout report: %s", err))
+				}
+
 				if err := state.SaveMemberState(); err != nil {
-					slog.Error(fmt.Sprintf("failed to save state: %s", err))
+					repoLogger(config).Error(fmt.Sprintf("failed to save state: %s", err))
 				}
 
+				stopKeepLock()
 				if err := state.UnlockCanaryRelease(); err != nil {
 					return fmt.Errorf("can't unlock canary release tag")
 				}
-				slog.Info("canary release success", "tag", tag)
+				unlocked = true
+				countCanaryReleaseMetric(config.Repo, true)
+				repoLogger(config).Info("canary release success", "tag", tag)
+				notify(config, notification{Event: eventCanarySuccess, Tag: tag})
 				return nil
 			}
 		}
+	} else {
+		logDecision(config, "canary_release", "skip release", tag, "lock not acquired")
 	}
 	return nil
 }
 
+// keepLock extends the lock every third of ttl while the deploy is running so that a deploy
+// longer than ttl doesn't let another node take the lock. The returned stop can be called
+// more than once.
+func keepLock(ctx context.Context, config *lib.Config, name string, extend func() (bool, error), ttl time.Duration) (stop func()) {
+	interval := ttl / 3
+	if interval <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := lib.ClockOf(config).NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				ok, err := extend()
+				if err != nil {
+					slog.Error(fmt.Sprintf("failed to extend %s lock: %s", name, err))
+				} else if !ok {
+					slog.Warn(fmt.Sprintf("%s lock is lost while deploying", name))
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+}
+
+var (
+	decisionMu    sync.Mutex
+	lastDecisions = map[string]string{}
+)
+
+// repoLogger returns the logger with the repository so that the logs of repos can be told apart.
+func repoLogger(config *lib.Config) *slog.Logger {
+	if config.Repo == "" {
+		return slog.Default()
+	}
+	return slog.With("repo", config.Repo)
+}
+
+// logDecision logs a decision of the polling at info level with the tag and the reason.
+// The same decision as the previous poll of the repository is logged at debug level so
+// that every poll doesn't repeat it.
+func logDecision(config *lib.Config, kind, msg, tag, reason string) {
+	attrs := []any{"tag", tag}
+	if reason != "" {
+		attrs = append(attrs, "reason", reason)
+	}
+
+	decisionMu.Lock()
+	defer decisionMu.Unlock()
+	key := config.Repo + "\x00" + kind
+	decision := strings.Join([]string{msg, tag, reason}, "\x00")
+	if lastDecisions[key] == decision {
+		repoLogger(config).Debug(msg, attrs...)
+		return
+	}
+	lastDecisions[key] = decision
+	repoLogger(config).Info(msg, attrs...)
+}
+
+// latestReleaseTag resolves the latest tag.
+// The asset is downloaded in advance unless it is streamed to the deploy command.
+func latestReleaseTag(ctx context.Context, config *lib.Config, github lib.GitHuber) (tag string, err error) {
+	_, span := tracer.Start(ctx, "download", trace.WithAttributes(attribute.String("tag", lib.LatestTag)))
+	defer func() {
+		span.SetAttributes(attribute.String("resolved_tag", tag))
+		endSpan(span, err)
+	}()
+
+	if config.DeployFromStdin {
+		return github.ReleaseTag(ctx, lib.LatestTag)
+	}
+	tag, _, err = github.DownloadReleaseAssets(ctx, lib.LatestTag)
+	return tag, err
+}
+
+// holdNewRelease returns lib.ErrPendingRelease until the tag is promoted by promote-pending.
+func holdNewRelease(tag string, state lib.Stater) error {
+	promoted, err := state.PromotedReleaseTag()
+	if err != nil {
+		return err
+	}
+	if promoted == tag {
+		return nil
+	}
+
+	pending, err := state.PendingReleaseTag()
+	if err != nil {
+		return err
+	}
+	if pending != tag {
+		if err := state.SavePendingReleaseTag(tag); err != nil {
+			return fmt.Errorf("can't save pending tag:%s", err)
+		}
+		slog.Info("new release is pending, run promote-pending to deploy", "tag", tag)
+	}
+	return lib.ErrPendingRelease
+}
+
 var ErrRollback = errors.New("rollback")
 var ErrNoRollback = errors.New("no rollback")
+var ErrHold = errors.New("hold failed release")
+var ErrAvoidOnly = errors.New("avoid failed release without rollback")
+
+// ErrPostDeploy is returned by deploy when post_deploy_command failed after the deploy command
+// succeeded, and the release is rolled back as a failed deploy.
+var ErrPostDeploy = errors.New("post deploy command failed")
+
+// ErrDeploySkipped is returned by deploy when the command exited with deploy_skip_exit_code.
+var ErrDeploySkipped = errors.New("release is already deployed")
+
+// checkHeld returns lib.ErrHeld while this node is held by on_failure=hold.
+func checkHeld(state lib.Stater) error {
+	held, err := state.HeldTag()
+	if err != nil {
+		return err
+	}
+	if held != "" {
+		return errors.Wrap(lib.ErrHeld, fmt.Sprintf("tag:%s", held))
+	}
+	return nil
+}
+
+// checkDeployBackoff returns lib.ErrDeployBackoff while this node waits to deploy tag again
+// after its consecutive deploy failures. The failures of another tag don't delay tag.
+func checkDeployBackoff(config *lib.Config, state lib.Stater, tag string) error {
+	if config.DeployBackoffMax <= 0 {
+		return nil
+	}
+	f, err := state.DeployFailure()
+	if err != nil {
+		return err
+	}
+	if f == nil || f.Tag != tag {
+		return nil
+	}
+	until := f.FailedAt.Add(lib.DeployBackoff(config, f.Count))
+	if lib.ClockOf(config).Now().Before(until) {
+		return errors.Wrap(lib.ErrDeployBackoff, fmt.Sprintf("tag:%s failures:%d until:%s", tag, f.Count, until.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// interruptedDeploy returns the canary release of tag which this node left in progress, e.g. by
+// a restart, to resume it from the health check when the version command reports tag. Otherwise
+// the deploy command may be half done or still running, so lib.ErrDeployInterrupted is returned
+// until the record expires instead of running the command again.
+func interruptedDeploy(state lib.Stater, tag string) (*lib.DeployProgress, error) {
+	p, err := state.DeployProgress()
+	if err != nil {
+		return nil, err
+	}
+	if p == nil || p.Tag != tag {
+		return nil, nil
+	}
+	installed, err := state.GetLastInstalledTag()
+	if err != nil {
+		return nil, err
+	}
+	if installed != tag {
+		return nil, errors.Wrap(lib.ErrDeployInterrupted, fmt.Sprintf("tag:%s until:%s", tag, p.ExpiresAt.Format(time.RFC3339)))
+	}
+	return p, nil
+}
+
+// resumedAssetFile returns the asset file of the interrupted deploy. The file is not recorded
+// when the node crashed before saving it after the deploy, so the asset is resolved again.
+func resumedAssetFile(ctx context.Context, config *lib.Config, github lib.GitHuber, p *lib.DeployProgress) (string, error) {
+	if p.File != "" {
+		return p.File, nil
+	}
+	if config.DeployFromStdin {
+		return stdinAssetFile, nil
+	}
+	tag, files, err := github.DownloadReleaseAssets(ctx, p.Tag)
+	if err != nil {
+		return "", fmt.Errorf("can't get release asset:%s %w", tag, err)
+	}
+	return files[0], nil
+}
+
+// clearDeployProgress only logs on failure because the record expires anyway.
+func clearDeployProgress(state lib.Stater) {
+	if err := state.ClearDeployProgress(); err != nil {
+		slog.Error(fmt.Sprintf("failed to clear deploy progress: %s", err))
+	}
+}
+
+// recordDeployResult counts up the deploy failures of tag for the backoff, and resets them on success.
+func recordDeployResult(config *lib.Config, state lib.Stater, tag string, deployErr error) {
+	if config.DeployBackoffMax <= 0 {
+		return
+	}
+	if deployErr == nil {
+		if err := state.ClearDeployFailure(); err != nil {
+			repoLogger(config).Error(fmt.Sprintf("failed to clear deploy failure: %s", err))
+		}
+		return
+	}
+	f, err := state.SaveDeployFailure(tag)
+	if err != nil {
+		repoLogger(config).Error(fmt.Sprintf("failed to save deploy failure: %s", err))
+		return
+	}
+	repoLogger(config).Warn("deploy failed, back off before deploying the tag again", "tag", tag, "failures", f.Count, "backoff", lib.DeployBackoff(config, f.Count))
+}
+
+// checkCanaryAborted returns lib.ErrCanaryAborted when the abort subcommand is run for tag.
+// A failure to get the abort key doesn't fail the health check.
+func checkCanaryAborted(state lib.Stater, tag string) error {
+	aborted, err := state.CanaryAbortedTag()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("failed to get aborted tag: %s", err))
+		return nil
+	}
+	if aborted != "" && aborted == tag {
+		return errors.Wrap(lib.ErrCanaryAborted, fmt.Sprintf("tag:%s", tag))
+	}
+	return nil
+}
+
+func handleRollback(ctx context.Context, rollbackTag, reason string, config *lib.Config, state lib.Stater, github lib.GitHuber) error {
+	defer startDeploy(config.Repo)()
+
+	// fast path: switch the current link back to the kept snapshot
+	if config.Snapshot && lib.HasSnapshot(config.SaveAssetsPath, rollbackTag) {
+		if config.DryRun {
+			repoLogger(config).Info("dry run: skip rollback by snapshot", "tag", rollbackTag)
+			return ErrRollback
+		}
+		err := lib.SwitchSnapshot(config.SaveAssetsPath, rollbackTag)
+		if err == nil {
+			repoLogger(config).Info("rollback success by snapshot", "tag", rollbackTag)
+			rollbackCounter.WithLabelValues(config.Repo).Inc()
+			setDeployedTagMetric(config.Repo, rollbackTag)
+			saveRollbackHistory(state, rollbackTag, reason)
+			notify(config, notification{Event: eventRollback, Tag: rollbackTag, Message: reason})
+			return ErrRollback
+		}
+		repoLogger(config).Warn("failed to rollback by snapshot", "tag", rollbackTag, "err", err)
+	}
 
-func handleRollback(rollbackTag string, config *lib.Config, state *lib.State, github lib.GitHuber) error {
 	if config.RollbackCommand == "" {
 		return ErrNoRollback
 	}
-	slog.Info("start rollback", "tag", rollbackTag)
-	if _, _, err := deploy(config.RollbackCommand, rollbackTag, state, github); err != nil {
+	repoLogger(config).Info("start rollback", "tag", rollbackTag)
+	if _, _, err := deploy(ctx, config, config.RollbackCommand, rollbackTag, state, github); err != nil && !errors.Is(err, ErrDeploySkipped) {
 		return errors.Wrap(err, "rollback command failed")
 	}
-	slog.Info("rollback success", "tag", rollbackTag)
-	return ErrRollback
-
-}
-func runServer(config *lib.Config) error {
-	github, err := lib.NewGitHub(config)
-	if err != nil {
-		return err
+	repoLogger(config).Info("rollback success", "tag", rollbackTag)
+	rollbackCounter.WithLabelValues(config.Repo).Inc()
+	setDeployedTagMetric(config.Repo, rollbackTag)
+	saveRollbackHistory(state, rollbackTag, reason)
+	notify(config, notification{Event: eventRollback, Tag: rollbackTag, Message: reason})
+	return ErrRollback
+}
+
+func saveRollbackHistory(state lib.Stater, tag, reason string) {
+	if err := state.SaveReleaseHistory(tag, lib.ReleaseActionRollback, reason); err != nil {
+		slog.Error(fmt.Sprintf("failed to save release history: %s", err))
+	}
+}
+
+// runServer runs the canary release and rollout of each repository independently.
+// A failure of a repository among repos doesn't stop the others.
+func runServer(config *lib.Config) error {
+	configs, err := config.RepoConfigs()
+	if err != nil {
+		return err
+	}
+
+	githubs := make([]lib.GitHuber, 0, len(configs))
+	for _, c := range configs {
+		github, err := lib.NewGitHuber(c)
+		if err != nil {
+			return err
+		}
+		githubs = append(githubs, github)
+	}
+
+	states, err := lib.NewStaters(configs)
+	if err != nil {
+		return err
+	}
+	return serve(config, configs, githubs, states)
+}
+
+// serve runs the repositories of configs with their release sources and states,
+// which are given by the caller so that tests can supply fakes.
+func serve(config *lib.Config, configs []*lib.Config, githubs []lib.GitHuber, states []lib.Stater) error {
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	shutdownTracing, err := setupTracing(context.Background(), config)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	// ctx is passed to in-flight deploy and health check.
+	// it is canceled when shutdown_grace expires after a shutdown signal.
+	ctx, cancel := context.WithCancel(traceContextFromEnv(context.Background()))
+	defer cancel()
+	go func() {
+		<-sigCtx.Done()
+		if config.ShutdownGrace > 0 {
+			repoLogger(config).Info("shutdown signal received, waiting for in-flight operation", "grace", config.ShutdownGrace)
+			select {
+			case <-lib.ClockOf(config).After(config.ShutdownGrace):
+				repoLogger(config).Warn("shutdown grace expired, abort in-flight operation")
+			case <-ctx.Done():
+			}
+		}
+		cancel()
+	}()
+
+	// one shot mode runs the repositories in order
+	if viper.GetBool("once") {
+		if len(configs) == 1 {
+			return runRepo(sigCtx, ctx, configs[0], githubs[0], states[0], nil)
+		}
+		failed := 0
+		for i, c := range configs {
+			if err := runRepo(sigCtx, ctx, c, githubs[i], states[i], nil); err != nil {
+				repoLogger(config).Error(fmt.Sprintf("failed to run %s: %s", c.Repo, err))
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d repos failed", failed, len(configs))
+		}
+		return nil
+	}
+
+	if config.MetricsAddr != "" {
+		if err := startMetricsServer(sigCtx, config); err != nil {
+			return err
+		}
+	}
+
+	if config.ReadinessAddr != "" {
+		if err := startReadinessServer(sigCtx, config, configs, states); err != nil {
+			return err
+		}
+	}
+
+	var triggerC <-chan struct{}
+	if config.TriggerListen != "" {
+		triggerC, err = startTriggerServer(sigCtx, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(configs) == 1 {
+		return runRepo(sigCtx, ctx, configs[0], githubs[0], states[0], triggerC)
+	}
+
+	triggers := fanOut(sigCtx, triggerC, len(configs))
+	var wg sync.WaitGroup
+	for i, c := range configs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := runRepo(sigCtx, ctx, c, githubs[i], states[i], triggers[i])
+				if err == nil || sigCtx.Err() != nil {
+					return
+				}
+				repoLogger(config).Error(fmt.Sprintf("failed to run %s, restart after %s: %s", c.Repo, c.RepositryPollingInterval, err))
+				notify(c, notification{Event: eventError, Message: fmt.Sprintf("failed to run %s: %s", c.Repo, err)})
+				select {
+				case <-sigCtx.Done():
+					return
+				case <-lib.ClockOf(c).After(c.RepositryPollingInterval):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// fanOut forwards each signal of ch to n channels. A signal is dropped for a channel
+// which already has one pending, as the trigger is debounced anyway.
+func fanOut(ctx context.Context, ch <-chan struct{}, n int) []<-chan struct{} {
+	outs := make([]chan struct{}, n)
+	ret := make([]<-chan struct{}, n)
+	for i := range outs {
+		outs[i] = make(chan struct{}, 1)
+		ret[i] = outs[i]
+	}
+	if ch == nil {
+		return ret
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				for _, out := range outs {
+					select {
+					case out <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return ret
+}
+
+// runRepo runs the canary release and rollout of a repository until the shutdown signal.
+// sigCtx is canceled by the signal, and ctx is passed to in-flight deploy and health check.
+func runRepo(sigCtx, ctx context.Context, config *lib.Config, github lib.GitHuber, state lib.Stater, triggerC <-chan struct{}) error {
+	canary := func() error {
+		if err := canaryReleaseCycle(ctx, config, github, state); err != nil {
+			if sigCtx.Err() != nil {
+				repoLogger(config).Warn("canary release aborted by shutdown", "err", err)
+				return nil
+			}
+			return err
+		}
+		return nil
+	}
+	rollout := func() error {
+		if err := rolloutCycle(ctx, config, github, state); err != nil {
+			if sigCtx.Err() != nil {
+				repoLogger(config).Warn("rollout aborted by shutdown", "err", err)
+				return nil
+			}
+			return err
+		}
+		return nil
 	}
 
-	gitTicker := time.NewTicker(config.RepositryPollingInterval)
+	// one shot mode evaluates canary release before rollout so that the result is predictable
 	if viper.GetBool("once") {
-		gitTicker = time.NewTicker(time.Nanosecond)
+		if err := canary(); err != nil {
+			return err
+		}
+		if sigCtx.Err() != nil {
+			return nil
+		}
+		return rollout()
 	}
+
+	gitTicker := lib.ClockOf(config).NewTicker(config.RepositryPollingInterval)
 	defer gitTicker.Stop()
 
-	rolloutTicker := time.NewTicker(config.RolloutWindow)
-	if viper.GetBool("once") {
-		rolloutTicker = time.NewTicker(time.Nanosecond)
-	}
+	rolloutTicker := lib.ClockOf(config).NewTicker(config.RolloutWindow)
 	defer rolloutTicker.Stop()
 
-	state, err := lib.NewState(config)
-	if err != nil {
-		return err
-	}
-
 	for {
+		if sigCtx.Err() != nil {
+			repoLogger(config).Info("shutdown")
+			return nil
+		}
+
+		// canary release is evaluated before rollout when both tickers have fired
 		select {
-		case <-rolloutTicker.C:
-			if err := handleRollout(config, github, state); err != nil {
-				if errors.Is(err, lib.ErrAlreadyInstalled) {
-					slog.Debug("can't rollout", "err", err)
-				} else if errors.Is(err, lib.ErrAssetsCannotDownload) {
-					slog.Warn("can't get assets files")
-				} else {
-					return err
-				}
+		case <-gitTicker.C():
+			if err := canary(); err != nil {
+				return err
 			}
-			if viper.GetBool("once") {
-				rolloutTicker.Stop()
-			}
-		case <-gitTicker.C:
-			if err := handleCanaryRelease(config, github, state); err != nil {
-				if errors.Is(err, lib.ErrAssetsNotFound) ||
-					errors.Is(err, lib.ErrAlreadyInstalled) ||
-					errors.Is(err, lib.ErrAvoidReleaseTag) {
-					slog.Debug("can't rollout", "err", err)
-				} else if errors.Is(err, lib.ErrAssetsCannotDownload) {
-					slog.Warn("can't get assets files")
-				} else {
-					if errors.Is(err, ErrRollback) {
-						slog.Warn("rollback success")
-					} else if errors.Is(err, ErrNoRollback) {
-						slog.Info("no rollback because no rollback command")
-					} else {
-						return err
-					}
-				}
+			continue
+		default:
+		}
 
+		select {
+		case <-sigCtx.Done():
+			repoLogger(config).Info("shutdown")
+			return nil
+		case <-triggerC:
+			repoLogger(config).Info("canary release triggered by webhook")
+			if err := canary(); err != nil {
+				return err
 			}
-			if viper.GetBool("once") {
-				return nil
+		case <-gitTicker.C():
+			if err := canary(); err != nil {
+				return err
+			}
+		case <-rolloutTicker.C():
+			if err := rollout(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rolloutCycle runs handleRollout and returns only errors that should stop the server.
+func rolloutCycle(ctx context.Context, config *lib.Config, github lib.GitHuber, state lib.Stater) error {
+	ctx, span := tracer.Start(ctx, "rollout_cycle")
+	defer span.End()
+	if err := handleRollout(ctx, config, github, state); err != nil {
+		span.RecordError(err)
+		if errors.Is(err, lib.ErrAlreadyInstalled) ||
+			errors.Is(err, lib.ErrHeld) ||
+			errors.Is(err, lib.ErrDeployBackoff) {
+			repoLogger(config).Debug("can't rollout", "err", err)
+		} else if errors.Is(err, lib.ErrDowngrade) {
+			repoLogger(config).Warn("skip rollout because it is a downgrade", "err", err)
+		} else if errors.Is(err, lib.ErrAssetsCannotDownload) {
+			repoLogger(config).Warn("can't get assets files")
+		} else if errors.Is(err, lib.ErrChecksumMismatch) {
+			repoLogger(config).Error("asset checksum mismatch", "err", err)
+			notify(config, notification{Event: eventError, Message: fmt.Sprintf("asset checksum mismatch: %s", err)})
+		} else if errors.Is(err, lib.ErrSignatureInvalid) {
+			repoLogger(config).Error("asset signature verification failed", "err", err)
+			notify(config, notification{Event: eventError, Message: fmt.Sprintf("asset signature verification failed: %s", err)})
+		} else if errors.Is(err, lib.ErrLFSPointer) {
+			repoLogger(config).Error("asset is a git lfs pointer, enable resolve_lfs to download the content", "err", err)
+			notify(config, notification{Event: eventError, Message: fmt.Sprintf("asset is a git lfs pointer: %s", err)})
+		} else if errors.Is(err, ErrRollback) {
+			repoLogger(config).Warn("rollback success")
+		} else if errors.Is(err, ErrNoRollback) {
+			repoLogger(config).Info("no rollback because no rollback command")
+		} else {
+			return err
+		}
+	}
+	return nil
+}
+
+// canaryReleaseCycle runs handleCanaryRelease and returns only errors that should stop the server.
+func canaryReleaseCycle(ctx context.Context, config *lib.Config, github lib.GitHuber, state lib.Stater) error {
+	ctx, span := tracer.Start(ctx, "canary_release_cycle")
+	defer span.End()
+	if err := handleCanaryRelease(ctx, config, github, state); err != nil {
+		span.RecordError(err)
+		if errors.Is(err, lib.ErrAssetsNotFound) ||
+			errors.Is(err, lib.ErrAlreadyInstalled) ||
+			errors.Is(err, lib.ErrAvoidReleaseTag) ||
+			errors.Is(err, lib.ErrPendingRelease) ||
+			errors.Is(err, lib.ErrUnconfirmedRelease) ||
+			errors.Is(err, lib.ErrHeld) ||
+			errors.Is(err, lib.ErrDeployBackoff) {
+			repoLogger(config).Debug("can't rollout", "err", err)
+		} else if errors.Is(err, lib.ErrDowngrade) {
+			repoLogger(config).Warn("skip release because it is a downgrade", "err", err)
+		} else if errors.Is(err, lib.ErrDeployInterrupted) {
+			repoLogger(config).Warn("skip release because the interrupted deploy may still be running", "err", err)
+		} else if errors.Is(err, lib.ErrAssetsCannotDownload) {
+			repoLogger(config).Warn("can't get assets files")
+		} else if errors.Is(err, lib.ErrChecksumMismatch) {
+			repoLogger(config).Error("asset checksum mismatch", "err", err)
+			notify(config, notification{Event: eventError, Message: fmt.Sprintf("asset checksum mismatch: %s", err)})
+		} else if errors.Is(err, lib.ErrSignatureInvalid) {
+			repoLogger(config).Error("asset signature verification failed", "err", err)
+			notify(config, notification{Event: eventError, Message: fmt.Sprintf("asset signature verification failed: %s", err)})
+		} else if errors.Is(err, lib.ErrLFSPointer) {
+			repoLogger(config).Error("asset is a git lfs pointer, enable resolve_lfs to download the content", "err", err)
+			notify(config, notification{Event: eventError, Message: fmt.Sprintf("asset is a git lfs pointer: %s", err)})
+		} else {
+			if errors.Is(err, ErrRollback) {
+				repoLogger(config).Warn("rollback success")
+			} else if errors.Is(err, ErrHold) || errors.Is(err, ErrAvoidOnly) {
+				repoLogger(config).Warn("failed release is kept", "err", err)
+			} else if errors.Is(err, ErrNoRollback) {
+				repoLogger(config).Info("no rollback because no rollback command")
+			} else {
+				return err
 			}
 		}
 	}
+	return nil
 }
 
-func runHealthCheck(config *lib.Config, tag, file string) (string, error) {
-	healthCheckTick := time.NewTicker(config.HealthCheckInterval)
-	canaryReleaseTick := time.NewTicker(config.CanaryRolloutWindow)
+// runHealthCheck checks tag deployed over previousTag.
+func runHealthCheck(ctx context.Context, config *lib.Config, state lib.Stater, tag, previousTag, file string) (out string, err error) {
+	ctx, span := tracer.Start(ctx, "health_check", trace.WithAttributes(attribute.String("tag", tag)))
+	defer func() { endSpan(span, err) }()
+
+	if config.DryRun {
+		repoLogger(config).Info("dry run: skip health check", "command", config.HealthCheckCommand, "url", config.HealthCheckHTTP.URL, "tag", tag, "asset_file", file)
+		return "", nil
+	}
+
+	healthCheckTick := lib.ClockOf(config).NewTicker(config.HealthCheckInterval)
+	canaryReleaseTick := lib.ClockOf(config).NewTicker(config.CanaryRolloutWindow)
 
 	if viper.GetBool("once") {
-		healthCheckTick = time.NewTicker(time.Nanosecond)
-		canaryReleaseTick = time.NewTicker(time.Nanosecond)
+		healthCheckTick.Stop()
+		canaryReleaseTick.Stop()
+		healthCheckTick = lib.ClockOf(config).NewTicker(time.Nanosecond)
+		canaryReleaseTick = lib.ClockOf(config).NewTicker(time.Nanosecond)
 	}
 	defer healthCheckTick.Stop()
 	defer canaryReleaseTick.Stop()
 	f := func() (string, error) {
+		if err := checkCanaryAborted(state, tag); err != nil {
+			return "", err
+		}
+
 		ret := ""
+		var abortErr error
 		cxt, cancel := context.WithTimeout(
-			context.Background(),
+			ctx,
 			config.HealthCheckTimeout*time.Duration(config.HealthCheckRetries)+
 				config.HealthCheckInterval*time.Duration(config.HealthCheckRetries))
 		defer cancel()
 		err := retry.Do(
 			func() error {
-				out, err := executeCommand(config.HealthCheckCommand, tag, file, config.HealthCheckTimeout)
+				out, err := healthCheck(ctx, config, tag, previousTag, file)
 				ret = string(out)
-				if err != nil {
-					return fmt.Errorf("health check command failed: %s, %s", err.Error(), string(out))
+				if err != nil && ctx.Err() == nil {
+					healthCheckFailureCounter.WithLabelValues(config.Repo).Inc()
+					if abortErr = checkCanaryAborted(state, tag); abortErr != nil {
+						return retry.Unrecoverable(abortErr)
+					}
 				}
-				return nil
+				return err
 			},
 			retry.Context(cxt),
 			retry.Attempts(config.HealthCheckRetries),
 			retry.Delay(config.HealthCheckInterval),
 		)
+		if abortErr != nil {
+			return ret, abortErr
+		}
 		return ret, err
 	}
+	if config.HealthCheckSuccessThreshold > 0 {
+		return runHealthCheckUntilThreshold(ctx, config, f, healthCheckTick.C(), canaryReleaseTick.C())
+	}
+
 	if out, err := f(); err != nil {
 		return out, err
 	}
 
 	for {
 		select {
-		case <-healthCheckTick.C:
+		case <-healthCheckTick.C():
 			if out, err := f(); err != nil {
 				return out, err
 			}
 
-		case <-canaryReleaseTick.C:
+		case <-canaryReleaseTick.C():
 			return "", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// runHealthCheckUntilThreshold tolerates failed health checks within the window, and passes
+// once healthcheck_success_threshold checks in the window succeeded in a row. A failure after
+// that doesn't undo the pass.
+func runHealthCheckUntilThreshold(ctx context.Context, config *lib.Config, f func() (string, error), healthCheckC, windowC <-chan time.Time) (string, error) {
+	var successes uint
+	var passed bool
+	var lastOut string
+	var lastErr error
+	check := func() {
+		lastOut, lastErr = f()
+		if errors.Is(lastErr, lib.ErrCanaryAborted) {
+			return
+		}
+		if lastErr != nil {
+			if successes > 0 {
+				repoLogger(config).Warn("health check failed, wait for consecutive successes", "err", lastErr, "threshold", config.HealthCheckSuccessThreshold)
+			}
+			successes = 0
+			return
+		}
+		successes++
+		if successes >= config.HealthCheckSuccessThreshold {
+			passed = true
+		}
+	}
+
+	check()
+	for {
+		if errors.Is(lastErr, lib.ErrCanaryAborted) {
+			return lastOut, lastErr
+		}
+		select {
+		case <-healthCheckC:
+			check()
+		case <-windowC:
+			if passed {
+				return "", nil
+			}
+			if lastErr == nil {
+				lastErr = errors.New("not enough health checks in the window")
+			}
+			return lastOut, fmt.Errorf("health check succeeded %d times in a row, %d required: %w", successes, config.HealthCheckSuccessThreshold, lastErr)
+		case <-ctx.Done():
+			return "", ctx.Err()
 		}
 	}
 }
 
-func executeCommand(command string, tag, file string, timeout time.Duration) ([]byte, error) {
-	ctx := context.Background()
+// stdinAssetFile is ASSET_FILE when the asset is given from stdin
+const stdinAssetFile = "-"
+
+// previousTagEnv gives the commands PREVIOUS_TAG, the version installed before the deploy.
+func previousTagEnv(tag string) string {
+	return fmt.Sprintf("PREVIOUS_TAG=%s", tag)
+}
+
+func executeCommand(ctx context.Context, config *lib.Config, command string, tag, file string, timeout time.Duration, env ...string) ([]byte, error) {
+	return executeCommandWithStdin(ctx, config, nil, command, tag, file, timeout, env...)
+}
+
+// executeCommandWithStdin runs command by sh in command_working_dir.
+// The built-in variables such as RELEASE_TAG and ASSET_FILE take precedence over command_env.
+func executeCommandWithStdin(ctx context.Context, config *lib.Config, stdin io.Reader, command string, tag, file string, timeout time.Duration, env ...string) (out []byte, err error) {
 	if timeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
 
+	ctx, span := tracer.Start(ctx, "execute_command", trace.WithAttributes(attribute.String("tag", tag), attribute.String("command", command)))
+	defer func() { endSpan(span, err) }()
+
+	if config.DryRun {
+		repoLogger(config).Info("dry run: skip command", "command", command, "tag", tag, "asset_file", file, "env", env)
+		return nil, nil
+	}
+
 	cmd := exec.CommandContext(ctx, "sh", "-c", command)
-	cmd.Env = append(os.Environ(), fmt.Sprintf("RELEASE_TAG=%s", tag))
+	cmd.Dir = config.CommandWorkingDir
+	cmd.Env = os.Environ()
+	for k, v := range config.CommandEnv {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	// later values win over the same key
+	cmd.Env = append(cmd.Env, fmt.Sprintf("RELEASE_TAG=%s", tag))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("ASSET_FILE=%s", file))
+	cmd.Env = append(cmd.Env, traceEnv(ctx)...)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdin = stdin
+
+	if config.StreamCommandOutput {
+		out, err = streamOutput(cmd, command, tag)
+	} else {
+		out, err = cmd.CombinedOutput()
+	}
+	repoLogger(config).Debug("command result", "command", command, "out", string(out))
+	out = truncateOutput(out, config.MaxCommandOutputBytes)
+	return out, err
+}
 
-	out, err := cmd.CombinedOutput()
+// commandOutputMessage is the message of the streamed lines.
+const commandOutputMessage = "command output"
+
+// streamOutput runs cmd logging stdout and stderr line by line as they are written,
+// and returns the combined output.
+func streamOutput(cmd *exec.Cmd, command, tag string) ([]byte, error) {
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return out, err
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var (
+		mu  sync.Mutex
+		buf bytes.Buffer
+		wg  sync.WaitGroup
+	)
+	for stream, r := range map[string]io.Reader{"stdout": stdout, "stderr": stderr} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// a line of any length is read unlike bufio.Scanner
+			br := bufio.NewReader(r)
+			for {
+				line, err := br.ReadBytes('\n')
+				if len(line) > 0 {
+					mu.Lock()
+					buf.Write(line)
+					mu.Unlock()
+					slog.Info(commandOutputMessage, "tag", tag, "command", command, "stream", stream, "line", strings.TrimRight(string(line), "\r\n"))
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
 	}
+	// the pipes must be read to the end before Wait closes them
+	wg.Wait()
+	err = cmd.Wait()
+	return buf.Bytes(), err
+}
 
-	slog.Debug("command result", "command", command, "out", string(out))
-	return out, nil
+// truncateOutput keeps the head and the tail of the output up to limit bytes in total so that
+// the errors and the notifications stay small. The full output is logged at debug level.
+func truncateOutput(out []byte, limit int) []byte {
+	if limit <= 0 || len(out) <= limit {
+		return out
+	}
+	head := limit / 2
+	tail := limit - head
+	ret := make([]byte, 0, limit+64)
+	ret = append(ret, out[:head]...)
+	ret = append(ret, fmt.Sprintf("\n...(%d bytes truncated)...\n", len(out)-limit)...)
+	return append(ret, out[len(out)-tail:]...)
 }
 
 func Execute() {
@@ -368,57 +1672,118 @@ func getLogger(config *lib.Config, level string) (*slog.Logger, error) {
 		Level: logLevel,
 	}
 	logOutput = os.Stdout
+	switch {
+	case config.LogFile != "":
+		f, err := openLogFile(config.LogFile)
+		if err != nil {
+			return nil, err
+		}
+		f.reopenOnSIGHUP()
+		logOutput = f
+	case config.LogStderr:
+		logOutput = os.Stderr
+	}
+	handler, err := newLogHandler(logOutput, config.LogFormat, &ops)
+	if err != nil {
+		return nil, err
+	}
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get hostname: %s", err)
 	}
 
-	logger := slog.New(slog.NewJSONHandler(logOutput, &ops)).With("host", hostname)
-	if config.SlackWebhookURL != "" {
-		logger = slog.New(
-			slogmulti.Fanout(
-				slog.NewJSONHandler(logOutput, &ops),
-				slogslack.Option{
-					Level:      logLevel,
-					WebhookURL: config.SlackWebhookURL,
-					Channel:    config.SlackChannel,
-				}.NewSlackHandler(),
-			),
-		).With("host", hostname)
+	version, commit, date := buildInfo()
+	return slog.New(handler).With("host", hostname, "version", version, "commit", commit, "build_date", date), nil
+}
+
+// newLogHandler returns the handler of log_format, json by default or text for logfmt.
+func newLogHandler(w io.Writer, format string, ops *slog.HandlerOptions) (slog.Handler, error) {
+	switch format {
+	case "", "json":
+		return slog.NewJSONHandler(w, ops), nil
+	case "text":
+		return slog.NewTextHandler(w, ops), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
 	}
+}
+
+// configPaths expands the given config paths in order. A directory is
+// expanded to its *.conf and *.toml files sorted by name.
+func configPaths(files []string) ([]string, error) {
+	ret := []string{}
+	for _, f := range files {
+		p, err := homedir.Expand(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get config path: %s", err)
+		}
+		p, err = filepath.Abs(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get config path: %s", err)
+		}
+
+		fi, err := os.Stat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				slog.Warn("config file not found", slog.String("path", p))
+				continue
+			}
+			return nil, fmt.Errorf("failed to get config path: %s", err)
+		}
 
-	return logger, nil
+		if !fi.IsDir() {
+			ret = append(ret, p)
+			continue
+		}
+
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config dir: %s", err)
+		}
+		for _, e := range entries {
+			ext := filepath.Ext(e.Name())
+			if e.IsDir() || (ext != ".conf" && ext != ".toml") {
+				continue
+			}
+			ret = append(ret, filepath.Join(p, e.Name()))
+		}
+	}
+	return ret, nil
 }
 
-func loadConfig() (*lib.Config, error) {
-	p, err := homedir.Expand(cfgFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get config path: %s", err)
+// validateServerConfig checks the options which are required only to deploy,
+// so that the other subcommands can run without them.
+func validateServerConfig(config *lib.Config) error {
+	if config.DeployCommand == "" {
+		return errors.New("deploy_command is required")
 	}
-	p, err = filepath.Abs(p)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get config path: %s", err)
+	if config.HealthCheckCommand == "" && config.HealthCheckHTTP.URL == "" {
+		return errors.New("healthcheck_command or healthcheck_http.url is required")
 	}
+	return nil
+}
+
+func loadConfig() (*lib.Config, error) {
 	viper.SetConfigType("toml")
 	viper.SetEnvPrefix("GACR")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
-	if _, err := os.Stat(p); err == nil {
-		c, err := os.ReadFile(p)
-		if err != nil {
-			return nil, err
-		}
+	paths, err := configPaths(cfgFiles)
+	if err != nil {
+		return nil, err
+	}
 
+	// later files override earlier ones
+	for _, p := range paths {
+		c, err := os.ReadFile(p)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read config: %s", err)
 		}
 
-		if err := viper.ReadConfig(bytes.NewReader(c)); err != nil {
-			return nil, fmt.Errorf("failed to read config: %s", err)
+		if err := viper.MergeConfig(bytes.NewReader(c)); err != nil {
+			return nil, fmt.Errorf("failed to read config %s: %s", p, err)
 		}
-	} else {
-		slog.Warn("config file not found", slog.String("path", p))
 	}
 
 	config := lib.Config{}
@@ -426,44 +1791,241 @@ func loadConfig() (*lib.Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal config: %s", err)
 	}
 
+	// is_canary is not bound to viper so that it stays unset unless specified
+	if isCanaryFlag != nil && isCanaryFlag.Changed {
+		isCanary := isCanaryFlag.Value.String() == "true"
+		config.IsCanary = &isCanary
+	}
+
 	validate := validator.New(validator.WithRequiredStructEnabled())
 	err = validate.Struct(&config)
 	if err != nil {
 		return nil, fmt.Errorf("faileh to validate config: %s", err)
 	}
+
+	// repo selects one of repos, for the subcommands in particular
+	if len(config.Repos) > 0 && config.Repo != "" {
+		rc, err := config.RepoConfig(config.Repo)
+		if err != nil {
+			return nil, err
+		}
+		config = *rc
+	}
+
+	configs, err := config.RepoConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range configs {
+		if err := validate.Struct(c); err != nil {
+			return nil, fmt.Errorf("failed to validate config of %s: %s", c.Repo, err)
+		}
+		if err := lib.ValidateConfig(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := lib.ParseGitHubAPIEndpoint(config.GitHubAPIEndpoint); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
 
 func init() {
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "~/gacr.conf", "config file (default is $HOME/gacr.conf)")
+	rootCmd.PersistentFlags().StringSliceVar(&cfgFiles, "config", []string{"~/gacr.conf"}, "config files or directories, merged in order (default is $HOME/gacr.conf)")
 
 	rootCmd.PersistentFlags().String("repo", "", "GitHub repository name")
 	viper.BindPFlag("repo", rootCmd.PersistentFlags().Lookup("repo"))
 
+	rootCmd.PersistentFlags().String("provider", "github", "release provider(github or gitlab)")
+	viper.BindPFlag("provider", rootCmd.PersistentFlags().Lookup("provider"))
+
+	rootCmd.PersistentFlags().String("gitlab-token", "", "GitLab token")
+	viper.BindPFlag("gitlab_token", rootCmd.PersistentFlags().Lookup("gitlab-token"))
+
+	rootCmd.PersistentFlags().String("gitlab-api", "https://gitlab.com/api/v4", "GitLab API endpoint")
+	viper.BindPFlag("gitlab_api", rootCmd.PersistentFlags().Lookup("gitlab-api"))
+
 	rootCmd.PersistentFlags().String("github-token", "", "GitHub token")
 	viper.BindPFlag("github_token", rootCmd.PersistentFlags().Lookup("github-token"))
 
 	rootCmd.PersistentFlags().String("github-api", "https://api.github.com", "GitHub API endpoint")
 	viper.BindPFlag("github_api", rootCmd.PersistentFlags().Lookup("github-api"))
 
+	rootCmd.PersistentFlags().String("http-proxy", "", "Proxy for the http requests to the release provider (default is HTTP_PROXY)")
+	viper.BindPFlag("http_proxy", rootCmd.PersistentFlags().Lookup("http-proxy"))
+
+	rootCmd.PersistentFlags().String("https-proxy", "", "Proxy for the https requests to the release provider (default is HTTPS_PROXY)")
+	viper.BindPFlag("https_proxy", rootCmd.PersistentFlags().Lookup("https-proxy"))
+
+	rootCmd.PersistentFlags().String("no-proxy", "", "Hosts requested without the proxy (default is NO_PROXY)")
+	viper.BindPFlag("no_proxy", rootCmd.PersistentFlags().Lookup("no-proxy"))
+
 	rootCmd.PersistentFlags().String("deploy-command", "", "Deploy command")
 	viper.BindPFlag("deploy_command", rootCmd.PersistentFlags().Lookup("deploy-command"))
 
 	rootCmd.PersistentFlags().String("rollback-command", "", "Rollback command")
 	viper.BindPFlag("rollback_command", rootCmd.PersistentFlags().Lookup("rollback-command"))
 
+	rootCmd.PersistentFlags().String("pre-deploy-command", "", "command run before the deploy and rollback commands; a failure aborts the deploy")
+	viper.BindPFlag("pre_deploy_command", rootCmd.PersistentFlags().Lookup("pre-deploy-command"))
+
+	rootCmd.PersistentFlags().String("post-deploy-command", "", "command run after the deploy and rollback commands succeed; a failure rolls back the release")
+	viper.BindPFlag("post_deploy_command", rootCmd.PersistentFlags().Lookup("post-deploy-command"))
+
+	rootCmd.PersistentFlags().Int("deploy-skip-exit-code", 0, "exit code of the deploy command meaning the release is already deployed(0 disables)")
+	viper.BindPFlag("deploy_skip_exit_code", rootCmd.PersistentFlags().Lookup("deploy-skip-exit-code"))
+
 	rootCmd.PersistentFlags().String("healthcheck-command", "", "HealthCheck command")
 	viper.BindPFlag("healthcheck_command", rootCmd.PersistentFlags().Lookup("healthcheck-command"))
 
+	rootCmd.PersistentFlags().StringToString("command-env", map[string]string{}, "environment variables given to every command (e.g. DEPLOY_USER=deploy,REGION=ap-northeast-1)")
+	viper.BindPFlag("command_env", rootCmd.PersistentFlags().Lookup("command-env"))
+
+	rootCmd.PersistentFlags().String("command-working-dir", "", "working directory of every command (default is the current directory)")
+	viper.BindPFlag("command_working_dir", rootCmd.PersistentFlags().Lookup("command-working-dir"))
+
+	rootCmd.PersistentFlags().Int("max-command-output-bytes", 4096, "output of a command kept in the errors and the notifications, keeping the head and the tail(0 keeps all)")
+	viper.BindPFlag("max_command_output_bytes", rootCmd.PersistentFlags().Lookup("max-command-output-bytes"))
+
+	rootCmd.PersistentFlags().Bool("stream-command-output", false, "log the output of the commands line by line while they run")
+	viper.BindPFlag("stream_command_output", rootCmd.PersistentFlags().Lookup("stream-command-output"))
+
+	rootCmd.PersistentFlags().String("healthcheck-http-url", "", "HealthCheck URL, ${RELEASE_TAG} is replaced with the release tag")
+	viper.BindPFlag("healthcheck_http.url", rootCmd.PersistentFlags().Lookup("healthcheck-http-url"))
+
+	rootCmd.PersistentFlags().Int("healthcheck-http-expected-status", 200, "HealthCheck expected status code")
+	viper.BindPFlag("healthcheck_http.expected_status", rootCmd.PersistentFlags().Lookup("healthcheck-http-expected-status"))
+
+	rootCmd.PersistentFlags().String("healthcheck-http-body-contains", "", "HealthCheck expected substring of the response body")
+	viper.BindPFlag("healthcheck_http.body_contains", rootCmd.PersistentFlags().Lookup("healthcheck-http-body-contains"))
+
 	rootCmd.PersistentFlags().String("version-command", "", "Version command")
 	viper.BindPFlag("version_command", rootCmd.PersistentFlags().Lookup("version-command"))
 
+	rootCmd.PersistentFlags().Bool("hold-new-release", false, "record a new release as pending and wait for promote-pending before deploying")
+	viper.BindPFlag("hold_new_release", rootCmd.PersistentFlags().Lookup("hold-new-release"))
+
+	rootCmd.PersistentFlags().Duration("avoid-tag-ttl", 0, "expire the avoid tags after this duration(0 keeps them until clear-avoid)")
+	viper.BindPFlag("avoid_tag_ttl", rootCmd.PersistentFlags().Lookup("avoid-tag-ttl"))
+
+	rootCmd.PersistentFlags().Duration("deploy-backoff-max", 0, "max backoff before deploying a tag again after its deploy failed(0 disables the backoff)")
+	viper.BindPFlag("deploy_backoff_max", rootCmd.PersistentFlags().Lookup("deploy-backoff-max"))
+
+	rootCmd.PersistentFlags().Uint("github-max-retries", 3, "number of retries of a GitHub API call on transient errors")
+	viper.BindPFlag("github_max_retries", rootCmd.PersistentFlags().Lookup("github-max-retries"))
+
+	rootCmd.PersistentFlags().Duration("github-retry-delay", time.Second, "initial delay of the exponential backoff between GitHub API retries")
+	viper.BindPFlag("github_retry_delay", rootCmd.PersistentFlags().Lookup("github-retry-delay"))
+
+	rootCmd.PersistentFlags().Bool("respect-rate-limit", true, "sleep until the GitHub rate limit is reset instead of failing")
+	viper.BindPFlag("respect_rate_limit", rootCmd.PersistentFlags().Lookup("respect-rate-limit"))
+
+	rootCmd.PersistentFlags().String("post-rollout-verify-command", "", "command run once on rollout completion with the version distribution in stdin")
+	viper.BindPFlag("post_rollout_verify_command", rootCmd.PersistentFlags().Lookup("post-rollout-verify-command"))
+
+	rootCmd.PersistentFlags().Uint("max-concurrent-rollout", 1, "maximum number of nodes which roll out at the same time")
+	viper.BindPFlag("max_concurrent_rollout", rootCmd.PersistentFlags().Lookup("max-concurrent-rollout"))
+
+	rootCmd.PersistentFlags().Uint("rollout-batch-percent", 0, "percentage of the members which roll out per rollout window (0 is one node per window)")
+	viper.BindPFlag("rollout_batch_percent", rootCmd.PersistentFlags().Lookup("rollout-batch-percent"))
+
+	rootCmd.PersistentFlags().Bool("notify-rollout-start", true, "notify once when the fleet starts rolling out a new stable tag")
+	viper.BindPFlag("notify_rollout_start", rootCmd.PersistentFlags().Lookup("notify-rollout-start"))
+
+	rootCmd.PersistentFlags().Bool("snapshot", false, "keep the asset of each deployed tag and roll back by switching the current link")
+	viper.BindPFlag("snapshot", rootCmd.PersistentFlags().Lookup("snapshot"))
+
+	rootCmd.PersistentFlags().Bool("extract-assets", false, "extract tar.gz and zip assets and pass the directory to the deploy command as ASSET_DIR")
+	viper.BindPFlag("extract_assets", rootCmd.PersistentFlags().Lookup("extract-assets"))
+
+	rootCmd.PersistentFlags().String("channel-source-tag", "", "release tag which has channels.json mapping channels to tags")
+	viper.BindPFlag("channel_source_tag", rootCmd.PersistentFlags().Lookup("channel-source-tag"))
+
+	rootCmd.PersistentFlags().String("channel", "", "channel in channels.json to resolve the latest tag")
+	viper.BindPFlag("channel", rootCmd.PersistentFlags().Lookup("channel"))
+
+	rootCmd.PersistentFlags().Uint("canary-cohort-size", 1, "number of canary nodes which must pass the health check before promotion")
+	viper.BindPFlag("canary_cohort_size", rootCmd.PersistentFlags().Lookup("canary-cohort-size"))
+
+	rootCmd.PersistentFlags().Bool("canary-lock-queue", false, "give the canary release lock to the nodes in the order they first tried it")
+	viper.BindPFlag("canary_lock_queue", rootCmd.PersistentFlags().Lookup("canary-lock-queue"))
+
+	rootCmd.PersistentFlags().Bool("is-canary", false, "designate this node as a canary (true) or not (false); canaries are elected by lock when unset")
+	isCanaryFlag = rootCmd.PersistentFlags().Lookup("is-canary")
+
+	rootCmd.PersistentFlags().StringSlice("canary-hosts", []string{}, "hostname patterns of the nodes which may become a canary when is-canary is unset")
+	viper.BindPFlag("canary_hosts", rootCmd.PersistentFlags().Lookup("canary-hosts"))
+
+	rootCmd.PersistentFlags().String("asset-cache-dir", "", "directory to cache assets by checksum across tags (requires checksum-pattern)")
+	viper.BindPFlag("asset_cache_dir", rootCmd.PersistentFlags().Lookup("asset-cache-dir"))
+
+	rootCmd.PersistentFlags().Int("keep-assets", 0, "number of the most recent assets kept in save-assets-path after a deploy(0 keeps all)")
+	viper.BindPFlag("keep_assets", rootCmd.PersistentFlags().Lookup("keep-assets"))
+
+	rootCmd.PersistentFlags().Bool("resolve-lfs", false, "resolve the content of git lfs pointer assets by the LFS batch API")
+	viper.BindPFlag("resolve_lfs", rootCmd.PersistentFlags().Lookup("resolve-lfs"))
+
+	rootCmd.PersistentFlags().Uint("confirm-polls", 0, "number of consecutive polls which must observe the same latest tag before canary release")
+	viper.BindPFlag("confirm_polls", rootCmd.PersistentFlags().Lookup("confirm-polls"))
+
+	rootCmd.PersistentFlags().Uint("version-command-failure-threshold", 3, "consecutive version command failures tolerated when reporting the member state")
+	viper.BindPFlag("version_command_failure_threshold", rootCmd.PersistentFlags().Lookup("version-command-failure-threshold"))
+
+	rootCmd.PersistentFlags().Duration("version-cache-ttl", 10*time.Second, "duration to reuse the result of the version command(0 disables the cache)")
+	viper.BindPFlag("version_cache_ttl", rootCmd.PersistentFlags().Lookup("version-cache-ttl"))
+
+	rootCmd.PersistentFlags().Duration("trust-peer-health", 0, "skip the rollout health check when a node verified the tag healthy within this duration")
+	viper.BindPFlag("trust_peer_health", rootCmd.PersistentFlags().Lookup("trust-peer-health"))
+
+	rootCmd.PersistentFlags().String("liveness-check-command", "", "quick check command run instead of the health check when a peer attestation exists")
+	viper.BindPFlag("liveness_check_command", rootCmd.PersistentFlags().Lookup("liveness-check-command"))
+
+	rootCmd.PersistentFlags().String("deploy-record-key", "", "HMAC key to sign deploy records")
+	viper.BindPFlag("deploy_record_key", rootCmd.PersistentFlags().Lookup("deploy-record-key"))
+
+	rootCmd.PersistentFlags().String("on-failure", lib.OnFailureRollback, "action on health check failure: rollback, hold or avoid_only")
+	viper.BindPFlag("on_failure", rootCmd.PersistentFlags().Lookup("on-failure"))
+
+	rootCmd.PersistentFlags().String("retry-decision-command", "", "command to decide retry(exit 0), abort(exit 1) or rollback(exit 2) on deploy/health check failure")
+	viper.BindPFlag("retry_decision_command", rootCmd.PersistentFlags().Lookup("retry-decision-command"))
+
+	rootCmd.PersistentFlags().Uint("retry-decision-max-attempts", 3, "max attempts when retry decision command asks to retry")
+	viper.BindPFlag("retry_decision_max_attempts", rootCmd.PersistentFlags().Lookup("retry-decision-max-attempts"))
+
+	rootCmd.PersistentFlags().String("warmup-command", "", "Warmup command")
+	viper.BindPFlag("warmup_command", rootCmd.PersistentFlags().Lookup("warmup-command"))
+
 	rootCmd.PersistentFlags().String("slack-webhook-url", "", "Slack webhook URL")
 	viper.BindPFlag("slack_webhook_url", rootCmd.PersistentFlags().Lookup("slack-webhook-url"))
 
 	rootCmd.PersistentFlags().String("slack-channel", "", "Slack channel")
 	viper.BindPFlag("slack_channel", rootCmd.PersistentFlags().Lookup("slack-channel"))
 
+	rootCmd.PersistentFlags().String("slack-mention-on-error", "", "Slack mention prepended to error messages (e.g. <!subteam^ID>)")
+	viper.BindPFlag("slack_mention_on_error", rootCmd.PersistentFlags().Lookup("slack-mention-on-error"))
+
+	rootCmd.PersistentFlags().String("slack-mention-on-warn", "", "Slack mention prepended to warn messages such as rollback")
+	viper.BindPFlag("slack_mention_on_warn", rootCmd.PersistentFlags().Lookup("slack-mention-on-warn"))
+
+	rootCmd.PersistentFlags().String("notify-webhook-url", "", "URL to post the release events as JSON")
+	viper.BindPFlag("notify_webhook_url", rootCmd.PersistentFlags().Lookup("notify-webhook-url"))
+
+	rootCmd.PersistentFlags().String("discord-webhook-url", "", "Discord webhook URL to notify the release events")
+	viper.BindPFlag("discord_webhook_url", rootCmd.PersistentFlags().Lookup("discord-webhook-url"))
+
+	rootCmd.PersistentFlags().String("teams-webhook-url", "", "Microsoft Teams incoming webhook URL to notify the release events")
+	viper.BindPFlag("teams_webhook_url", rootCmd.PersistentFlags().Lookup("teams-webhook-url"))
+
+	rootCmd.PersistentFlags().String("state-backend", lib.StateBackendRedis, "State backend(redis or file)")
+	viper.BindPFlag("state_backend", rootCmd.PersistentFlags().Lookup("state-backend"))
+
+	rootCmd.PersistentFlags().String("state-file", "", "State file path for the file state backend")
+	viper.BindPFlag("state_file", rootCmd.PersistentFlags().Lookup("state-file"))
+
+	rootCmd.PersistentFlags().String("redis-mode", lib.RedisModeStandalone, "Redis mode(standalone, sentinel or cluster)")
+	viper.BindPFlag("redis.mode", rootCmd.PersistentFlags().Lookup("redis-mode"))
+
 	rootCmd.PersistentFlags().String("redis-host", "127.0.0.1", "Redis host")
 	viper.BindPFlag("redis.host", rootCmd.PersistentFlags().Lookup("redis-host"))
 
@@ -476,15 +2038,87 @@ func init() {
 	rootCmd.PersistentFlags().Int("redis-db", 1, "Redis DB")
 	viper.BindPFlag("redis.db", rootCmd.PersistentFlags().Lookup("redis-db"))
 
+	rootCmd.PersistentFlags().StringSlice("redis-addrs", []string{}, "Redis sentinel addresses in sentinel mode, or cluster node addresses in cluster mode")
+	viper.BindPFlag("redis.addrs", rootCmd.PersistentFlags().Lookup("redis-addrs"))
+
+	rootCmd.PersistentFlags().String("redis-master-name", "", "Redis master name in sentinel mode")
+	viper.BindPFlag("redis.master_name", rootCmd.PersistentFlags().Lookup("redis-master-name"))
+
+	rootCmd.PersistentFlags().String("redis-sentinel-password", "", "Redis sentinel password in sentinel mode")
+	viper.BindPFlag("redis.sentinel_password", rootCmd.PersistentFlags().Lookup("redis-sentinel-password"))
+
+	rootCmd.PersistentFlags().Bool("redis-tls", false, "Connect to Redis with TLS")
+	viper.BindPFlag("redis.tls.enabled", rootCmd.PersistentFlags().Lookup("redis-tls"))
+
+	rootCmd.PersistentFlags().String("redis-tls-ca-cert", "", "CA certificate path to verify the Redis server")
+	viper.BindPFlag("redis.tls.ca_cert", rootCmd.PersistentFlags().Lookup("redis-tls-ca-cert"))
+
+	rootCmd.PersistentFlags().String("redis-tls-cert", "", "Client certificate path for mutual TLS with Redis")
+	viper.BindPFlag("redis.tls.cert", rootCmd.PersistentFlags().Lookup("redis-tls-cert"))
+
+	rootCmd.PersistentFlags().String("redis-tls-key", "", "Client key path for mutual TLS with Redis")
+	viper.BindPFlag("redis.tls.key", rootCmd.PersistentFlags().Lookup("redis-tls-key"))
+
+	rootCmd.PersistentFlags().Bool("redis-tls-insecure-skip-verify", false, "Skip verifying the Redis server certificate(for testing only)")
+	viper.BindPFlag("redis.tls.insecure_skip_verify", rootCmd.PersistentFlags().Lookup("redis-tls-insecure-skip-verify"))
+
 	rootCmd.PersistentFlags().String("redis-key-prefix", "", "Redis key prefix(default repo name)")
 	viper.BindPFlag("redis.key_prefix", rootCmd.PersistentFlags().Lookup("redis-key-prefix"))
 
+	rootCmd.PersistentFlags().Duration("redis-timeout", 5*time.Second, "Timeout of each Redis operation(0 disables the timeout)")
+	viper.BindPFlag("redis.timeout", rootCmd.PersistentFlags().Lookup("redis-timeout"))
+
+	rootCmd.PersistentFlags().String("instance-id", "", "instance id to distinguish multiple agents on the same host")
+	viper.BindPFlag("instance_id", rootCmd.PersistentFlags().Lookup("instance-id"))
+
 	rootCmd.PersistentFlags().String("package-name-pattern", "", "Package name pattern")
 	viper.BindPFlag("package_name_pattern", rootCmd.PersistentFlags().Lookup("package-name-pattern"))
 
+	rootCmd.PersistentFlags().StringSlice("package-name-patterns", []string{}, "Package name patterns, all of which must match an asset to be downloaded")
+	viper.BindPFlag("package_name_patterns", rootCmd.PersistentFlags().Lookup("package-name-patterns"))
+
+	rootCmd.PersistentFlags().String("tag-pattern", "", "release tag pattern eligible for deploy")
+	viper.BindPFlag("tag_pattern", rootCmd.PersistentFlags().Lookup("tag-pattern"))
+
+	rootCmd.PersistentFlags().String("release-branch", "", "only track releases whose target commitish is this branch")
+	viper.BindPFlag("release_branch", rootCmd.PersistentFlags().Lookup("release-branch"))
+
+	rootCmd.PersistentFlags().String("version-selection", lib.VersionSelectionDate, "how to select the latest release, date or semver")
+	viper.BindPFlag("version_selection", rootCmd.PersistentFlags().Lookup("version-selection"))
+
+	rootCmd.PersistentFlags().String("version-prefix", "v", "prefix stripped from the tag before parsing it as semver")
+	viper.BindPFlag("version_prefix", rootCmd.PersistentFlags().Lookup("version-prefix"))
+
+	rootCmd.PersistentFlags().String("version-constraint", "", "semver range the latest release must satisfy with version_selection semver (e.g. \">=1.2.0 <2.0.0\")")
+	viper.BindPFlag("version_constraint", rootCmd.PersistentFlags().Lookup("version-constraint"))
+
+	rootCmd.PersistentFlags().Bool("deploy-from-stdin", false, "stream the asset to stdin of the deploy command instead of saving it")
+	viper.BindPFlag("deploy_from_stdin", rootCmd.PersistentFlags().Lookup("deploy-from-stdin"))
+
+	rootCmd.PersistentFlags().String("checksum-pattern", "", "checksum asset name pattern (e.g. checksums.txt)")
+	viper.BindPFlag("checksum_pattern", rootCmd.PersistentFlags().Lookup("checksum-pattern"))
+
+	rootCmd.PersistentFlags().Uint("checksum-retries", 2, "retry count of download on checksum mismatch")
+	viper.BindPFlag("checksum_retries", rootCmd.PersistentFlags().Lookup("checksum-retries"))
+
+	rootCmd.PersistentFlags().String("signature-pattern", "", "pattern of the minisign signature assets named after the asset (e.g. \\.minisig$)")
+	viper.BindPFlag("signature_pattern", rootCmd.PersistentFlags().Lookup("signature-pattern"))
+
+	rootCmd.PersistentFlags().String("signature-public-key", "", "minisign public key file to verify the assets")
+	viper.BindPFlag("signature_public_key", rootCmd.PersistentFlags().Lookup("signature-public-key"))
+
 	rootCmd.PersistentFlags().String("log-level", "info", "Log level")
 	viper.BindPFlag("log_level", rootCmd.PersistentFlags().Lookup("log-level"))
 
+	rootCmd.PersistentFlags().String("log-format", "json", "Log format (json|text)")
+	viper.BindPFlag("log_format", rootCmd.PersistentFlags().Lookup("log-format"))
+
+	rootCmd.PersistentFlags().String("log-file", "", "append logs to this file, which is reopened on SIGHUP (default stdout)")
+	viper.BindPFlag("log_file", rootCmd.PersistentFlags().Lookup("log-file"))
+
+	rootCmd.PersistentFlags().Bool("log-stderr", false, "write logs to stderr instead of stdout")
+	viper.BindPFlag("log_stderr", rootCmd.PersistentFlags().Lookup("log-stderr"))
+
 	rootCmd.PersistentFlags().String("save-assets-path", "/usr/local/src", "assets download path")
 	viper.BindPFlag("save_assets_path", rootCmd.PersistentFlags().Lookup("save-assets-path"))
 
@@ -494,21 +2128,75 @@ func init() {
 	rootCmd.PersistentFlags().Duration("rollout-window", 1*time.Minute, "release rollout window")
 	viper.BindPFlag("rollout_window", rootCmd.PersistentFlags().Lookup("rollout-window"))
 
+	rootCmd.PersistentFlags().Duration("canary-lock-ttl", 0, "canary release lock ttl, extended while deploying (default canary-rollout-window * 2)")
+	viper.BindPFlag("canary_lock_ttl", rootCmd.PersistentFlags().Lookup("canary-lock-ttl"))
+
+	rootCmd.PersistentFlags().Duration("canary-lock-heartbeat", 0, "take the canary release lock with this short ttl and refresh it while the holder is alive (e.g. 30s)")
+	viper.BindPFlag("canary_lock_heartbeat", rootCmd.PersistentFlags().Lookup("canary-lock-heartbeat"))
+
+	rootCmd.PersistentFlags().Duration("rollout-lock-ttl", 0, "rollout lock ttl, extended while deploying (default rollout-window)")
+	viper.BindPFlag("rollout_lock_ttl", rootCmd.PersistentFlags().Lookup("rollout-lock-ttl"))
+
+	rootCmd.PersistentFlags().Uint("rollout-complete-threshold", 100, "percentage of members on the tag to consider the rollout complete")
+	viper.BindPFlag("rollout_complete_threshold", rootCmd.PersistentFlags().Lookup("rollout-complete-threshold"))
+
+	rootCmd.PersistentFlags().Uint("rollout-stall-windows", 0, "notify the lagging members when the rollout doesn't progress for this number of rollout windows (0 is disabled)")
+	viper.BindPFlag("rollout_stall_windows", rootCmd.PersistentFlags().Lookup("rollout-stall-windows"))
+
 	rootCmd.PersistentFlags().Duration("health-check-interval", 1*time.Minute, "health check interval")
 	viper.BindPFlag("healthcheck_interval", rootCmd.PersistentFlags().Lookup("health-check-interval"))
 
 	rootCmd.PersistentFlags().Duration("repository-polling-interval", 5*time.Minute, "repository polling interval")
 	viper.BindPFlag("repository_polling_interval", rootCmd.PersistentFlags().Lookup("repository-polling-interval"))
 
+	rootCmd.PersistentFlags().Bool("prevent-downgrade", false, "refuse to install a lower semver tag than the installed one")
+	viper.BindPFlag("prevent_downgrade", rootCmd.PersistentFlags().Lookup("prevent-downgrade"))
+
+	rootCmd.PersistentFlags().Bool("allow-downgrade", false, "override prevent-downgrade for an intentional rollback")
+	viper.BindPFlag("allow_downgrade", rootCmd.PersistentFlags().Lookup("allow-downgrade"))
+
+	rootCmd.PersistentFlags().String("metrics-addr", "", "listen address of the Prometheus metrics endpoint /metrics (e.g. :9100)")
+	viper.BindPFlag("metrics_addr", rootCmd.PersistentFlags().Lookup("metrics-addr"))
+
+	rootCmd.PersistentFlags().String("readiness-addr", "", "listen address of the readiness endpoint /readyz (e.g. :8081)")
+	viper.BindPFlag("readiness_addr", rootCmd.PersistentFlags().Lookup("readiness-addr"))
+
+	rootCmd.PersistentFlags().String("trigger-listen", "", "listen address of the webhook that triggers a canary release cycle (e.g. :8080)")
+	viper.BindPFlag("trigger_listen", rootCmd.PersistentFlags().Lookup("trigger-listen"))
+
+	rootCmd.PersistentFlags().String("trigger-token", "", "bearer token required by the trigger webhook")
+	viper.BindPFlag("trigger_token", rootCmd.PersistentFlags().Lookup("trigger-token"))
+
+	rootCmd.PersistentFlags().Duration("trigger-debounce", 10*time.Second, "ignore triggers within this duration of the previous one")
+	viper.BindPFlag("trigger_debounce", rootCmd.PersistentFlags().Lookup("trigger-debounce"))
+
+	rootCmd.PersistentFlags().Duration("shutdown-grace", 0, "time to wait for in-flight deploy and health check on shutdown (0 aborts immediately)")
+	viper.BindPFlag("shutdown_grace", rootCmd.PersistentFlags().Lookup("shutdown-grace"))
+
+	rootCmd.PersistentFlags().String("otel-endpoint", "", "OTLP/HTTP endpoint to export traces (e.g. http://localhost:4318)")
+	viper.BindPFlag("otel_endpoint", rootCmd.PersistentFlags().Lookup("otel-endpoint"))
+
 	rootCmd.PersistentFlags().Bool("once", false, "one shot mode")
 	viper.BindPFlag("once", rootCmd.PersistentFlags().Lookup("once"))
 
+	rootCmd.PersistentFlags().Bool("dry-run", false, "log the commands and the tags without running them nor saving stable and avoid tags")
+	viper.BindPFlag("dry_run", rootCmd.PersistentFlags().Lookup("dry-run"))
+
 	rootCmd.PersistentFlags().Int("healthcheck-retries", 3, "retry count of health check")
 	viper.BindPFlag("healthcheck_retries", rootCmd.PersistentFlags().Lookup("healthcheck-retries"))
 
+	rootCmd.PersistentFlags().Uint("healthcheck-success-threshold", 0, "consecutive successful health checks required in the canary release window, failures before and after are tolerated")
+	viper.BindPFlag("healthcheck_success_threshold", rootCmd.PersistentFlags().Lookup("healthcheck-success-threshold"))
+
 	rootCmd.PersistentFlags().Duration("healthcheck-timeout", 30*time.Second, "timeout of health check")
 	viper.BindPFlag("healthcheck_timeout", rootCmd.PersistentFlags().Lookup("healthcheck-timeout"))
 
 	rootCmd.PersistentFlags().Bool("include-prerelease", false, "include prerelease")
 	viper.BindPFlag("include_prerelease", rootCmd.PersistentFlags().Lookup("include-prerelease"))
+
+	rootCmd.PersistentFlags().Bool("include-draft", false, "include draft releases, which requires a token with push access")
+	viper.BindPFlag("include_draft", rootCmd.PersistentFlags().Lookup("include-draft"))
+
+	rootCmd.PersistentFlags().Duration("release-min-age", 0, "minimum age since a release is published to select it as the latest (0 is disabled)")
+	viper.BindPFlag("release_min_age", rootCmd.PersistentFlags().Lookup("release-min-age"))
 }
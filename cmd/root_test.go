@@ -1,15 +1,26 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/pyama86/git-assets-canary-releaser/lib"
 	"github.com/pyama86/git-assets-canary-releaser/testutils"
 	redis "github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/mock"
 	"github.com/tj/assert"
 	"go.uber.org/mock/gomock"
@@ -20,10 +31,24 @@ type MockGitHuber struct {
 	mock.Mock
 }
 
-// DownloadReleaseAsset mocks the DownloadReleaseAsset method
-func (m *MockGitHuber) DownloadReleaseAsset(tag string) (string, string, error) {
+// DownloadReleaseAssets mocks the DownloadReleaseAssets method
+func (m *MockGitHuber) DownloadReleaseAssets(ctx context.Context, tag string) (string, []string, error) {
 	args := m.Called(tag)
-	return args.String(0), args.String(1), args.Error(2)
+	files, _ := args.Get(1).([]string)
+	return args.String(0), files, args.Error(2)
+}
+
+// ReleaseTag mocks the ReleaseTag method
+func (m *MockGitHuber) ReleaseTag(ctx context.Context, tag string) (string, error) {
+	args := m.Called(tag)
+	return args.String(0), args.Error(1)
+}
+
+// OpenReleaseAsset mocks the OpenReleaseAsset method
+func (m *MockGitHuber) OpenReleaseAsset(ctx context.Context, tag string) (string, io.ReadCloser, error) {
+	args := m.Called(tag)
+	r, _ := args.Get(1).(io.ReadCloser)
+	return args.String(0), r, args.Error(2)
 }
 
 func TestDeploy(t *testing.T) {
@@ -41,18 +66,28 @@ func TestDeploy(t *testing.T) {
 			cmd:  "../testdata/dummy.sh",
 			tag:  "latest",
 			mockSetup: func(m *MockGitHuber) {
-				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
 			},
 			wantTag:  "latest",
 			wantFile: "assetfile",
 			wantErr:  false,
 		},
+		{
+			name: "Multiple assets",
+			cmd:  `test "$ASSET_FILE" = app && test "$ASSET_FILES" = "$(printf 'app\napp.service')"`,
+			tag:  "latest",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"app", "app.service"}, nil)
+			},
+			wantTag:  "latest",
+			wantFile: "app",
+		},
 		{
 			name: "Failed to download asset",
 			cmd:  "echo",
 			tag:  "v1.0.0",
 			mockSetup: func(m *MockGitHuber) {
-				m.On("DownloadReleaseAsset", "v1.0.0").Return("", "", errors.New("download error"))
+				m.On("DownloadReleaseAssets", "v1.0.0").Return("", nil, errors.New("download error"))
 			},
 			wantErr: true,
 		},
@@ -80,7 +115,7 @@ func TestDeploy(t *testing.T) {
 			state, err := lib.NewState(config)
 			assert.NoError(t, err)
 
-			tag, file, err := deploy(tt.cmd, tt.tag, state, mockGitHub)
+			tag, file, err := deploy(context.Background(), config, tt.cmd, tt.tag, state, mockGitHub)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -110,7 +145,7 @@ func TestHandleRollout(t *testing.T) {
 		{
 			name: "Successful Rollout",
 			mockSetup: func(m *MockGitHuber) {
-				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
 			},
 			expectedError: false,
 			before: func(redisClient *redis.Client) {
@@ -122,7 +157,7 @@ func TestHandleRollout(t *testing.T) {
 		{
 			name: "Already installed",
 			mockSetup: func(m *MockGitHuber) {
-				m.On("DownloadReleaseAsset", "already_installed").Return("latest", "assetfile", nil)
+				m.On("DownloadReleaseAssets", "already_installed").Return("latest", []string{"assetfile"}, nil)
 			},
 			expectedError: true,
 			before: func(redisClient *redis.Client) {
@@ -160,7 +195,7 @@ func TestHandleRollout(t *testing.T) {
 
 			tc.before(redisClient)
 
-			err = handleRollout(config, mockGitHub, state)
+			err = handleRollout(context.Background(), config, mockGitHub, state)
 			if tc.expectedError {
 				assert.Error(t, err)
 				if tc.wantError != nil {
@@ -173,6 +208,52 @@ func TestHandleRollout(t *testing.T) {
 	}
 }
 
+func TestRolloutCycleRollback(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		DeployCommand:       "../testdata/dummy.sh",
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/always_fail.sh",
+		RollbackCommand:     "../testdata/always_succes.sh",
+		TrustPeerHealth:     time.Minute,
+		HealthCheckInterval: time.Nanosecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Nanosecond,
+		RolloutWindow:       time.Second,
+	}
+
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	if err := redisClient.FlushAll(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "latest", 0)
+	os.Setenv("TEST_VERSION", "rollback")
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+	mockGitHub.On("DownloadReleaseAssets", "rollback").Return("rollback", []string{"assetfile"}, nil)
+
+	// the rollout health check fails and rolls back, which must not stop the server
+	assert.NoError(t, rolloutCycle(context.Background(), config, mockGitHub, state))
+
+	history, err := state.GetReleaseHistory(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(history))
+	assert.Equal(t, lib.ReleaseActionRollback, history[0].Action)
+	assert.Equal(t, "rollback", history[0].Tag)
+}
+
 func TestHandleCanaryRollout(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -185,12 +266,17 @@ func TestHandleCanaryRollout(t *testing.T) {
 		wantError          error
 		healthCheckCommand string
 		rollbackCommand    string
+		warmupCommand      string
+		holdNewRelease     bool
+		onFailure          string
+		interruptedFrom    string
+		interruptedFile    string
 		before             func(redisClient *redis.Client)
 	}{
 		{
 			name: "Successful Rollout",
 			mockSetup: func(m *MockGitHuber) {
-				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
 			},
 			expectedError: false,
 			before: func(redisClient *redis.Client) {
@@ -202,7 +288,7 @@ func TestHandleCanaryRollout(t *testing.T) {
 		{
 			name: "Already installed",
 			mockSetup: func(m *MockGitHuber) {
-				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
 			},
 			expectedError: true,
 			before: func(redisClient *redis.Client) {
@@ -212,11 +298,118 @@ func TestHandleCanaryRollout(t *testing.T) {
 			},
 			wantError: lib.ErrAlreadyInstalled,
 		},
+		{
+			name: "Resume interrupted deploy",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: false,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				os.Setenv("TEST_VERSION", "latest")
+			},
+			interruptedFrom: "stable",
+			interruptedFile: "assetfile",
+		},
+		{
+			name: "Resume interrupted deploy without asset file",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: false,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				os.Setenv("TEST_VERSION", "latest")
+			},
+			healthCheckCommand: `test "$ASSET_FILE" = assetfile`,
+			interruptedFrom:    "stable",
+		},
+		{
+			name: "Avoid interrupted deploy",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: true,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				redisClient.SAdd(context.Background(), "foo/bar_avoid_release_tag", "latest")
+				os.Setenv("TEST_VERSION", "latest")
+			},
+			interruptedFrom: "stable",
+			interruptedFile: "assetfile",
+			wantError:       lib.ErrAvoidReleaseTag,
+		},
+		{
+			name: "Skip interrupted deploy",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: true,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				os.Setenv("TEST_VERSION", "notinstalled")
+			},
+			interruptedFrom: "stable",
+			interruptedFile: "assetfile",
+			wantError:       lib.ErrDeployInterrupted,
+		},
+		{
+			name: "Warmup failure does not rollback",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: false,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				redisClient.Del(context.Background(), "foo/bar_avoid_release_tag")
+				os.Setenv("TEST_VERSION", "notinstalled")
+			},
+			warmupCommand: "../testdata/always_fail.sh",
+		},
+		{
+			name: "Avoid release tag",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: true,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				redisClient.SAdd(context.Background(), "foo/bar_avoid_release_tag", "latest")
+				os.Setenv("TEST_VERSION", "notinstalled")
+			},
+			wantError: lib.ErrAvoidReleaseTag,
+		},
+		{
+			name: "Hold new release",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: true,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				os.Setenv("TEST_VERSION", "notinstalled")
+			},
+			holdNewRelease: true,
+			wantError:      lib.ErrPendingRelease,
+		},
+		{
+			name: "Promoted release",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: false,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				redisClient.Set(context.Background(), "foo/bar_promoted_release_tag", "latest", 0)
+				os.Setenv("TEST_VERSION", "notinstalled")
+			},
+			holdNewRelease: true,
+		},
 		{
 			name: "Rollback",
 			mockSetup: func(m *MockGitHuber) {
-				m.On("DownloadReleaseAsset", "latest").Return("latest", "assetfile", nil)
-				m.On("DownloadReleaseAsset", "rollback").Return("stable", "assetfile", nil)
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+				m.On("DownloadReleaseAssets", "rollback").Return("stable", []string{"assetfile"}, nil)
 			},
 			expectedError: true,
 			before: func(redisClient *redis.Client) {
@@ -227,6 +420,36 @@ func TestHandleCanaryRollout(t *testing.T) {
 			rollbackCommand:    "../testdata/always_succes.sh",
 			wantError:          ErrRollback,
 		},
+		{
+			name: "Hold on failure",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: true,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				os.Setenv("TEST_VERSION", "rollback")
+			},
+			healthCheckCommand: "../testdata/always_fail.sh",
+			rollbackCommand:    "../testdata/always_succes.sh",
+			onFailure:          lib.OnFailureHold,
+			wantError:          ErrHold,
+		},
+		{
+			name: "Avoid only on failure",
+			mockSetup: func(m *MockGitHuber) {
+				m.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+			},
+			expectedError: true,
+			before: func(redisClient *redis.Client) {
+				redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+				os.Setenv("TEST_VERSION", "rollback")
+			},
+			healthCheckCommand: "../testdata/always_fail.sh",
+			rollbackCommand:    "../testdata/always_succes.sh",
+			onFailure:          lib.OnFailureAvoidOnly,
+			wantError:          ErrAvoidOnly,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -254,6 +477,9 @@ func TestHandleCanaryRollout(t *testing.T) {
 				VersionCommand:      "../testdata/echo_version.sh",
 				HealthCheckCommand:  healthCheckCommand,
 				RollbackCommand:     rollbackCommand,
+				WarmupCommand:       tc.warmupCommand,
+				HoldNewRelease:      tc.holdNewRelease,
+				OnFailure:           tc.onFailure,
 				HealthCheckInterval: time.Nanosecond,
 				HealthCheckTimeout:  time.Second,
 				HealthCheckRetries:  1,
@@ -269,8 +495,11 @@ func TestHandleCanaryRollout(t *testing.T) {
 				t.Fatal(err)
 			}
 			tc.before(redisClient)
+			if tc.interruptedFrom != "" {
+				assert.NoError(t, state.SaveDeployProgress("latest", tc.interruptedFrom, tc.interruptedFile))
+			}
 
-			err = handleCanaryRelease(config, mockGitHub, state)
+			err = handleCanaryRelease(context.Background(), config, mockGitHub, state)
 			if tc.expectedError {
 				assert.Error(t, err)
 				if tc.wantError != nil {
@@ -285,8 +514,743 @@ func TestHandleCanaryRollout(t *testing.T) {
 
 				_, err = redisClient.Get(context.Background(), "foo/bar_canary_release_tag").Result()
 				assert.Error(t, err)
+
+				p, err := state.DeployProgress()
+				assert.NoError(t, err)
+				assert.Nil(t, p)
+			}
+
+		})
+	}
+}
+
+func TestConfigPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"b.conf", "a.toml", "c.txt"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, f), []byte(""), 0644))
+	}
+	override := filepath.Join(t.TempDir(), "override.conf")
+	assert.NoError(t, os.WriteFile(override, []byte(""), 0644))
+
+	paths, err := configPaths([]string{dir, override, filepath.Join(dir, "notfound.conf")})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "a.toml"),
+		filepath.Join(dir, "b.conf"),
+		override,
+	}, paths)
+}
+
+func TestHandleCanaryReleaseCanceled(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		DeployCommand:       "../testdata/dummy.sh",
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/dummy.sh",
+		CanaryRolloutWindow: time.Minute,
+		RolloutWindow:       time.Second,
+	}
+
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	if err := redisClient.FlushAll(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TEST_VERSION", "notinstalled")
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = handleCanaryRelease(ctx, config, mockGitHub, state)
+	assert.Error(t, err)
+
+	_, err = redisClient.Get(context.Background(), "foo/bar_canary_release_tag").Result()
+	assert.Equal(t, redis.Nil, err)
+}
+
+func TestHandleRolloutCanceled(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		DeployCommand:       "../testdata/dummy.sh",
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/dummy.sh",
+		CanaryRolloutWindow: time.Minute,
+		RolloutWindow:       time.Minute,
+		TrustPeerHealth:     time.Minute,
+	}
+
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	if err := redisClient.FlushAll(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TEST_VERSION", "notinstalled")
+	assert.NoError(t, state.SaveStableReleaseTag("latest"))
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = handleRollout(ctx, config, mockGitHub, state)
+	assert.Error(t, err)
+
+	_, err = redisClient.Get(context.Background(), "foo/bar_rollout").Result()
+	assert.Equal(t, redis.Nil, err)
+}
+
+func TestHandleCanaryReleaseNotCanary(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	isCanary := false
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		DeployCommand:       "../testdata/dummy.sh",
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/dummy.sh",
+		CanaryRolloutWindow: time.Minute,
+		RolloutWindow:       time.Second,
+		IsCanary:            &isCanary,
+	}
+
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	if err := redisClient.FlushAll(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TEST_VERSION", "notinstalled")
+
+	mockGitHub := new(MockGitHuber)
+	err = handleCanaryRelease(context.Background(), config, mockGitHub, state)
+	assert.NoError(t, err)
+	mockGitHub.AssertNotCalled(t, "DownloadReleaseAssets", "latest")
+
+	_, err = redisClient.Get(context.Background(), "foo/bar_canary_release_tag").Result()
+	assert.Equal(t, redis.Nil, err)
+}
+
+func TestRolloutCompleted(t *testing.T) {
+	tests := []struct {
+		threshold uint
+		installed int
+		all       int
+		want      bool
+	}{
+		{0, 9, 10, false},
+		{0, 10, 10, true},
+		{90, 9, 10, true},
+		{90, 8, 10, false},
+		{90, 0, 0, false},
+	}
+	for _, tt := range tests {
+		config := &lib.Config{RolloutCompleteThreshold: tt.threshold}
+		assert.Equal(t, tt.want, rolloutCompleted(config, tt.installed, tt.all))
+	}
+}
+
+func TestNewLogHandler(t *testing.T) {
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{format: "", want: `"msg":"hello"`},
+		{format: "json", want: `"msg":"hello"`},
+		{format: "text", want: "msg=hello host=web01"},
+		{format: "logfmt", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			h, err := newLogHandler(&buf, tt.format, &slog.HandlerOptions{})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
 			}
+			assert.NoError(t, err)
+			slog.New(h).With("host", "web01").Info("hello")
+			assert.Contains(t, buf.String(), tt.want)
+		})
+	}
+}
+
+func TestDeployFromStdin(t *testing.T) {
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		VersionCommand:  "../testdata/echo_version.sh",
+		DeployFromStdin: true,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("OpenReleaseAsset", "v1.0.0").Return("v1.0.0", io.NopCloser(strings.NewReader("payload")), nil)
+
+	tag, file, err := deploy(context.Background(), config, `test "$(cat)" = payload && test "$ASSET_FILE" = -`, "v1.0.0", state, mockGitHub)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+	assert.Equal(t, "-", file)
+	mockGitHub.AssertExpectations(t)
+}
+
+func TestPreviousTagEnv(t *testing.T) {
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	os.Setenv("TEST_VERSION", "v0.9.0")
+	t.Cleanup(func() {
+		os.Unsetenv("TEST_VERSION")
+	})
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		VersionCommand:     "../testdata/echo_version.sh",
+		HealthCheckCommand: `test "$PREVIOUS_TAG" = v0.9.0`,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("DownloadReleaseAssets", "v1.0.0").Return("v1.0.0", []string{"assetfile"}, nil)
+
+	_, file, err := deploy(context.Background(), config, `test "$PREVIOUS_TAG" = v0.9.0`, "v1.0.0", state, mockGitHub)
+	assert.NoError(t, err)
+	mockGitHub.AssertExpectations(t)
+
+	_, err = healthCheck(context.Background(), config, "v1.0.0", "v0.9.0", file)
+	assert.NoError(t, err)
+}
+
+func TestDeploySkipped(t *testing.T) {
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		VersionCommand:     "../testdata/echo_version.sh",
+		DeploySkipExitCode: 99,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("DownloadReleaseAssets", "v1.0.0").Return("v1.0.0", []string{"assetfile"}, nil)
+
+	tag, file, err := deploy(context.Background(), config, "exit 99", "v1.0.0", state, mockGitHub)
+	assert.True(t, errors.Is(err, ErrDeploySkipped))
+	assert.Equal(t, "v1.0.0", tag)
+	assert.Equal(t, "assetfile", file)
+
+	_, _, err = deploy(context.Background(), config, "exit 98", "v1.0.0", state, mockGitHub)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrDeploySkipped))
+}
+
+func TestDeployHooks(t *testing.T) {
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	log := filepath.Join(t.TempDir(), "log")
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		VersionCommand:    "../testdata/echo_version.sh",
+		PreDeployCommand:  fmt.Sprintf(`echo "pre $RELEASE_TAG $ASSET_FILE" >> %s`, log),
+		PostDeployCommand: fmt.Sprintf(`echo "post $RELEASE_TAG" >> %s`, log),
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("DownloadReleaseAssets", "v1.0.0").Return("v1.0.0", []string{"assetfile"}, nil)
+
+	_, _, err = deploy(context.Background(), config, fmt.Sprintf(`echo deploy >> %s`, log), "v1.0.0", state, mockGitHub)
+	assert.NoError(t, err)
+	b, err := os.ReadFile(log)
+	assert.NoError(t, err)
+	assert.Equal(t, "pre v1.0.0 assetfile\ndeploy\npost v1.0.0\n", string(b))
+
+	// the deploy command doesn't run when the pre deploy command fails
+	assert.NoError(t, os.Remove(log))
+	config.PreDeployCommand = "exit 1"
+	_, _, err = deploy(context.Background(), config, fmt.Sprintf(`echo deploy >> %s`, log), "v1.0.0", state, mockGitHub)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrPostDeploy))
+	_, err = os.Stat(log)
+	assert.True(t, os.IsNotExist(err))
+
+	config.PreDeployCommand = ""
+	config.PostDeployCommand = "exit 1"
+	_, _, err = deploy(context.Background(), config, "exit 0", "v1.0.0", state, mockGitHub)
+	assert.True(t, errors.Is(err, ErrPostDeploy))
+}
+
+func TestDeployDryRun(t *testing.T) {
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		VersionCommand:     "../testdata/echo_version.sh",
+		HealthCheckCommand: "exit 1",
+		DryRun:             true,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("DownloadReleaseAssets", "v1.0.0").Return("v1.0.0", []string{"assetfile"}, nil)
+
+	tag, file, err := deploy(context.Background(), config, "exit 1", "v1.0.0", state, mockGitHub)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+	assert.Equal(t, "assetfile", file)
+	mockGitHub.AssertExpectations(t)
+
+	_, err = runHealthCheck(context.Background(), config, state, tag, "", file)
+	assert.NoError(t, err)
+}
+
+func TestExecuteCommandDryRun(t *testing.T) {
+	out, err := executeCommand(context.Background(), &lib.Config{DryRun: true}, "echo ng; exit 1", "v1.0.0", "", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+
+	// the config of the repo decides over the global flag
+	viper.Set("dry_run", true)
+	t.Cleanup(func() { viper.Set("dry_run", false) })
+	out, err = executeCommand(context.Background(), &lib.Config{}, "echo ok", "v1.0.0", "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok\n", string(out))
+}
+
+func TestRunHealthCheckAborted(t *testing.T) {
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		HealthCheckCommand:  "exit 0",
+		HealthCheckInterval: time.Millisecond,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Hour,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		testutils.RedisClient().Del(context.Background(), "foo/bar_abort_canary")
+	})
+
+	// another tag is not aborted
+	assert.NoError(t, state.AbortCanaryRelease("v1.0.0"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = runHealthCheck(ctx, config, state, "v1.1.0", "v1.0.0", "assetfile")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, lib.ErrCanaryAborted))
+
+	assert.NoError(t, state.AbortCanaryRelease("v1.1.0"))
+	_, err = runHealthCheck(context.Background(), config, state, "v1.1.0", "v1.0.0", "assetfile")
+	assert.True(t, errors.Is(err, lib.ErrCanaryAborted))
+
+	config.HealthCheckSuccessThreshold = 3
+	_, err = runHealthCheck(context.Background(), config, state, "v1.1.0", "v1.0.0", "assetfile")
+	assert.True(t, errors.Is(err, lib.ErrCanaryAborted))
+}
+
+func TestCheckDeployBackoff(t *testing.T) {
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		RepositryPollingInterval: time.Hour,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		state.ClearDeployFailure()
+	})
+
+	// disabled
+	recordDeployResult(config, state, "v1.0.0", errors.New("failed"))
+	assert.NoError(t, checkDeployBackoff(config, state, "v1.0.0"))
 
+	config.DeployBackoffMax = 2 * time.Hour
+	recordDeployResult(config, state, "v1.0.0", errors.New("failed"))
+	assert.True(t, errors.Is(checkDeployBackoff(config, state, "v1.0.0"), lib.ErrDeployBackoff))
+	assert.NoError(t, checkDeployBackoff(config, state, "v1.1.0"))
+
+	recordDeployResult(config, state, "v1.0.0", nil)
+	assert.NoError(t, checkDeployBackoff(config, state, "v1.0.0"))
+}
+
+func TestFanOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan struct{})
+	outs := fanOut(ctx, ch, 2)
+	assert.Len(t, outs, 2)
+
+	// the second signal doesn't block while the first one is pending
+	ch <- struct{}{}
+	ch <- struct{}{}
+	for _, out := range outs {
+		select {
+		case <-out:
+		case <-time.After(time.Second):
+			t.Fatal("signal is not forwarded")
+		}
+	}
+
+	// without the trigger, the channels never fire
+	for _, out := range fanOut(ctx, nil, 2) {
+		select {
+		case <-out:
+			t.Fatal("unexpected signal")
+		default:
+		}
+	}
+}
+
+func TestExecuteCommandEnv(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	config := &lib.Config{
+		CommandEnv: map[string]string{
+			"DEPLOY_USER": "deploy",
+			"RELEASE_TAG": "override",
+		},
+		CommandWorkingDir: dir,
+	}
+
+	out, err := executeCommand(context.Background(), config, `test "$DEPLOY_USER" = deploy && test "$RELEASE_TAG" = v1.0.0 && pwd -P`, "v1.0.0", "assetfile", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, dir, strings.TrimSpace(string(out)))
+}
+
+func TestExecuteCommandOutputLimit(t *testing.T) {
+	config := &lib.Config{MaxCommandOutputBytes: 10}
+
+	out, err := executeCommand(context.Background(), config, `printf 'head-%s-tail' "$(printf '%0100d' 0)"; exit 1`, "v1.0.0", "", time.Minute)
+	assert.Error(t, err)
+	assert.Equal(t, "head-\n...(100 bytes truncated)...\n-tail", string(out))
+
+	out, err = executeCommand(context.Background(), config, "printf short", "v1.0.0", "", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "short", string(out))
+}
+
+func TestExecuteCommandStreamOutput(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	config := &lib.Config{StreamCommandOutput: true}
+	out, err := executeCommand(context.Background(), config, "echo out1; echo err1 >&2; printf out2; exit 1", "v1.0.0", "", time.Minute)
+	assert.Error(t, err)
+	assert.Contains(t, string(out), "out1\n")
+	assert.Contains(t, string(out), "err1\n")
+	assert.Contains(t, string(out), "out2")
+
+	assert.Contains(t, buf.String(), "tag=v1.0.0")
+	assert.Contains(t, buf.String(), "stream=stdout line=out1")
+	assert.Contains(t, buf.String(), "stream=stderr line=err1")
+	assert.Contains(t, buf.String(), "stream=stdout line=out2")
+}
+
+func TestLogDecision(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	decisionMu.Lock()
+	lastDecisions = map[string]string{}
+	decisionMu.Unlock()
+
+	config := &lib.Config{Repo: "foo/bar"}
+	logDecision(config, "test", "skip release", "v1.0.0", "stable")
+	logDecision(config, "test", "skip release", "v1.0.0", "stable")
+	assert.Equal(t, 1, strings.Count(buf.String(), "skip release"))
+	assert.Contains(t, buf.String(), "reason=stable")
+	assert.Contains(t, buf.String(), "repo=foo/bar")
+
+	logDecision(config, "test", "skip release", "v1.1.0", "avoid")
+	assert.Equal(t, 2, strings.Count(buf.String(), "skip release"))
+
+	// the decisions of the repos don't mix up
+	other := &lib.Config{Repo: "foo/baz"}
+	logDecision(other, "test", "skip release", "v1.1.0", "avoid")
+	logDecision(config, "test", "skip release", "v1.1.0", "avoid")
+	assert.Equal(t, 3, strings.Count(buf.String(), "skip release"))
+	assert.Contains(t, buf.String(), "repo=foo/baz")
+}
+
+func TestKeepLock(t *testing.T) {
+	var count atomic.Int32
+	stop := keepLock(context.Background(), &lib.Config{}, "test", func() (bool, error) {
+		count.Add(1)
+		return true, nil
+	}, 30*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	stop()
+	n := count.Load()
+	assert.True(t, n >= 2)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, n, count.Load())
+
+	// stop extending when the lock is lost
+	count.Store(0)
+	stop = keepLock(context.Background(), &lib.Config{}, "test", func() (bool, error) {
+		count.Add(1)
+		return false, nil
+	}, 30*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	assert.Equal(t, int32(1), count.Load())
+}
+
+func TestRunHealthCheckUntilThreshold(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []bool
+		wantErr bool
+	}{
+		{name: "consecutive successes", results: []bool{true, true, true}},
+		{name: "transient failure", results: []bool{true, false, true, true, true}},
+		{name: "failure after the threshold", results: []bool{true, true, true, false}},
+		{name: "failure at the end", results: []bool{false, true, true, false}, wantErr: true},
+		{name: "not enough checks", results: []bool{true, true}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &lib.Config{HealthCheckSuccessThreshold: 3}
+			i := 0
+			f := func() (string, error) {
+				ok := tt.results[i]
+				i++
+				if !ok {
+					return "ng", errors.New("unhealthy")
+				}
+				return "ok", nil
+			}
+
+			healthCheckC := make(chan time.Time)
+			windowC := make(chan time.Time, 1)
+			go func() {
+				for range tt.results[1:] {
+					healthCheckC <- time.Now()
+				}
+				windowC <- time.Now()
+			}()
+
+			_, err := runHealthCheckUntilThreshold(context.Background(), config, f, healthCheckC, windowC)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, len(tt.results), i)
 		})
 	}
 }
+
+// stallState is a lib.Stater which reports the fixed rollout progress.
+type stallState struct {
+	lib.Stater
+	installed, all int
+	marks          map[string]bool
+}
+
+func (s *stallState) GetRolloutProgress(tag string) (int, int, error) {
+	return s.installed, s.all, nil
+}
+
+func (s *stallState) MarkRolloutStalled(tag string, installed int) (bool, error) {
+	mark := fmt.Sprintf("%s:%d", tag, installed)
+	first := !s.marks[mark]
+	s.marks[mark] = true
+	return first, nil
+}
+
+func (s *stallState) MemberStates() (map[string]*lib.MemberState, error) {
+	return map[string]*lib.MemberState{
+		"web01": {CurrentVersion: "v1.1.0"},
+		"web02": {CurrentVersion: "v1.0.0"},
+		"web03": {CurrentVersion: lib.UnknownVersion},
+	}, nil
+}
+
+func TestCheckRolloutStall(t *testing.T) {
+	var got []notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		got = append(got, n)
+	}))
+	defer srv.Close()
+
+	config := &lib.Config{RolloutStallWindows: 2, NotifyWebhookURL: srv.URL}
+	state := &stallState{installed: 1, all: 3, marks: map[string]bool{}}
+	t.Cleanup(func() { stallProgress = map[string]rolloutStallProgress{} })
+
+	for i := 0; i < 4; i++ {
+		checkRolloutStall(config, state, "v1.1.0")
+	}
+	assert.Len(t, got, 1)
+	assert.Equal(t, eventRolloutStalled, got[0].Event)
+	assert.Equal(t, "lagging hosts: web02=v1.0.0, web03=unknown", got[0].Message)
+	assert.Equal(t, 1, got[0].Installed)
+	assert.Equal(t, 3, got[0].All)
+
+	// progress resets the stall
+	state.installed = 2
+	checkRolloutStall(config, state, "v1.1.0")
+	checkRolloutStall(config, state, "v1.1.0")
+	assert.Len(t, got, 1)
+	checkRolloutStall(config, state, "v1.1.0")
+	assert.Len(t, got, 2)
+
+	// completed rollout never stalls
+	state.installed = 3
+	for i := 0; i < 4; i++ {
+		checkRolloutStall(config, state, "v1.1.0")
+	}
+	assert.Len(t, got, 2)
+}
+
+func TestCheckRolloutStallRepos(t *testing.T) {
+	var got []notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		got = append(got, n)
+	}))
+	defer srv.Close()
+	t.Cleanup(func() { stallProgress = map[string]rolloutStallProgress{} })
+
+	foo := &lib.Config{Repo: "owner/foo", RolloutStallWindows: 2, NotifyWebhookURL: srv.URL}
+	bar := &lib.Config{Repo: "owner/bar", RolloutStallWindows: 2, NotifyWebhookURL: srv.URL}
+	fooState := &stallState{installed: 1, all: 3, marks: map[string]bool{}}
+	barState := &stallState{installed: 1, all: 3, marks: map[string]bool{}}
+
+	// the repos checked alternately don't reset the progress of each other
+	for i := 0; i < 3; i++ {
+		checkRolloutStall(foo, fooState, "v1.1.0")
+		checkRolloutStall(bar, barState, "v2.0.0")
+	}
+	assert.Len(t, got, 2)
+	assert.Equal(t, "owner/foo", got[0].Repo)
+	assert.Equal(t, "v1.1.0", got[0].Tag)
+	assert.Equal(t, "owner/bar", got[1].Repo)
+	assert.Equal(t, "v2.0.0", got[1].Tag)
+}
+
+func TestServeOnce(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisHost := os.Getenv("GACR_REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost"
+	}
+	config := &lib.Config{
+		Repo: "foo/bar",
+		Redis: &lib.RedisConfig{
+			Host: redisHost,
+			Port: 6379,
+		},
+		DeployCommand:       "../testdata/dummy.sh",
+		VersionCommand:      "../testdata/echo_version.sh",
+		HealthCheckCommand:  "../testdata/dummy.sh",
+		HealthCheckInterval: time.Minute,
+		HealthCheckTimeout:  time.Second,
+		HealthCheckRetries:  1,
+		CanaryRolloutWindow: time.Minute,
+		RolloutWindow:       time.Minute,
+	}
+	state, err := lib.NewState(config)
+	assert.NoError(t, err)
+	if err := redisClient.FlushAll(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	redisClient.Set(context.Background(), "foo/bar_stable_release_tag", "stable", 0)
+	os.Setenv("TEST_VERSION", "notinstalled")
+	viper.Set("once", true)
+	t.Cleanup(func() { viper.Set("once", false) })
+
+	mockGitHub := new(MockGitHuber)
+	mockGitHub.On("DownloadReleaseAssets", "latest").Return("latest", []string{"assetfile"}, nil)
+	err = serve(config, []*lib.Config{config}, []lib.GitHuber{mockGitHub}, []lib.Stater{state})
+	assert.NoError(t, err)
+
+	stableTag, err := redisClient.Get(context.Background(), "foo/bar_stable_release_tag").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "latest", stableTag)
+	mockGitHub.AssertCalled(t, "DownloadReleaseAssets", "latest")
+}
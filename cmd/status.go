@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var statusJSON bool
+
+type memberStatus struct {
+	Member  string `json:"member"`
+	Version string `json:"version"`
+}
+
+type clusterStatus struct {
+	StableTag    string             `json:"stable_tag"`
+	CanaryLocks  []lib.CanaryLock   `json:"canary_locks"`
+	AvoidTags    []string           `json:"avoid_tags"`
+	AvoidReasons []*lib.AvoidReason `json:"avoid_reasons"`
+	Installed    int                `json:"installed"`
+	Total        int                `json:"total"`
+	Members      []memberStatus     `json:"members"`
+}
+
+func getClusterStatus(state lib.Stater) (*clusterStatus, error) {
+	stable, err := state.CurrentStableTag()
+	if err != nil {
+		return nil, fmt.Errorf("can't get stable tag:%s", err)
+	}
+
+	locks, err := state.CanaryReleaseLocks()
+	if err != nil {
+		return nil, fmt.Errorf("can't get canary release lock:%s", err)
+	}
+
+	avoidTags, err := state.AvoidReleaseTags()
+	if err != nil {
+		return nil, fmt.Errorf("can't get avoid tags:%s", err)
+	}
+	sort.Strings(avoidTags)
+
+	reasons, err := state.AvoidReasons()
+	if err != nil {
+		return nil, fmt.Errorf("can't get avoid reasons:%s", err)
+	}
+	avoidReasons := make([]*lib.AvoidReason, 0, len(reasons))
+	for _, t := range avoidTags {
+		if r, ok := reasons[t]; ok {
+			avoidReasons = append(avoidReasons, r)
+		}
+	}
+
+	states, err := state.MemberStates()
+	if err != nil {
+		return nil, fmt.Errorf("can't get member states:%s", err)
+	}
+
+	status := &clusterStatus{
+		StableTag:    stable,
+		CanaryLocks:  locks,
+		AvoidTags:    avoidTags,
+		AvoidReasons: avoidReasons,
+		Total:        len(states),
+		Members:      make([]memberStatus, 0, len(states)),
+	}
+	for m, ms := range states {
+		if stable != "" && ms.CurrentVersion == stable {
+			status.Installed++
+		}
+		status.Members = append(status.Members, memberStatus{Member: m, Version: ms.CurrentVersion})
+	}
+	sort.Slice(status.Members, func(i, j int) bool {
+		return status.Members[i].Member < status.Members[j].Member
+	})
+	return status, nil
+}
+
+func printClusterStatus(status *clusterStatus) {
+	fmt.Printf("stable: %s\n", status.StableTag)
+	if len(status.CanaryLocks) == 0 {
+		fmt.Println("canary: -")
+	}
+	for _, l := range status.CanaryLocks {
+		fmt.Printf("canary: %s (%s)\n", l.Tag, strings.Join(l.Holders, ", "))
+	}
+	fmt.Printf("avoid: %s\n", strings.Join(status.AvoidTags, ", "))
+	for _, r := range status.AvoidReasons {
+		fmt.Printf("  %s %s by %s: %s\n", r.Tag, r.AvoidedAt.Format(time.RFC3339), r.Host, r.Reason)
+		for _, l := range strings.Split(strings.TrimSpace(r.Output), "\n") {
+			if l != "" {
+				fmt.Printf("    %s\n", l)
+			}
+		}
+	}
+	fmt.Printf("rollout: %d/%d\n", status.Installed, status.Total)
+	for _, m := range status.Members {
+		fmt.Printf("  %s %s\n", m.Member, m.Version)
+	}
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the stable tag, canary release, avoid tags and rollout progress.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		state, err := lib.NewStater(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		status, err := getClusterStatus(state)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to get status: %s", err))
+			os.Exit(1)
+		}
+
+		if statusJSON {
+			b, err := json.MarshalIndent(status, "", "  ")
+			if err != nil {
+				slog.Error(fmt.Sprintf("failed to marshal status: %s", err))
+				os.Exit(1)
+			}
+			fmt.Println(string(b))
+			return
+		}
+		printClusterStatus(status)
+	},
+}
+
+func init() {
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "print the status as JSON")
+	rootCmd.AddCommand(statusCmd)
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/pyama86/git-assets-canary-releaser")
+
+var propagator = propagation.TraceContext{}
+
+// setupTracing exports spans to otel_endpoint.
+// Without the endpoint the global no-op provider is kept so that spans cost nothing.
+func setupTracing(ctx context.Context, config *lib.Config) (func(context.Context) error, error) {
+	if config.OtelEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(config.OtelEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otlp exporter: %s", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithHost(),
+		resource.WithAttributes(
+			semconv.ServiceName("git-assets-canary-releaser"),
+			attribute.String("repo", config.Repo),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otel resource: %s", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+	return tp.Shutdown, nil
+}
+
+// envCarrier reads and writes the trace context as environment variables (e.g. TRACEPARENT).
+type envCarrier map[string]string
+
+func (c envCarrier) Get(key string) string {
+	return c[strings.ToUpper(key)]
+}
+
+func (c envCarrier) Set(key, value string) {
+	c[strings.ToUpper(key)] = value
+}
+
+func (c envCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// traceContextFromEnv continues the trace given by TRACEPARENT of the process environment.
+func traceContextFromEnv(ctx context.Context) context.Context {
+	carrier := envCarrier{}
+	for _, key := range propagator.Fields() {
+		if v := os.Getenv(strings.ToUpper(key)); v != "" {
+			carrier.Set(key, v)
+		}
+	}
+	return propagator.Extract(ctx, carrier)
+}
+
+// traceEnv returns the trace context of ctx to pass it to child commands.
+func traceEnv(ctx context.Context) []string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := envCarrier{}
+	propagator.Inject(ctx, carrier)
+	env := make([]string, 0, len(carrier))
+	for k, v := range carrier {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	return env
+}
+
+// endSpan records err on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
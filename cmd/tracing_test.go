@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/tj/assert"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTraceContextFromEnv(t *testing.T) {
+	t.Setenv("TRACEPARENT", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx := traceContextFromEnv(context.Background())
+	sc := trace.SpanContextFromContext(ctx)
+	assert.True(t, sc.IsValid())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+
+	env := traceEnv(ctx)
+	assert.Len(t, env, 1)
+	assert.True(t, strings.HasPrefix(env[0], "TRACEPARENT=00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+}
+
+func TestTraceEnvWithoutTrace(t *testing.T) {
+	assert.Len(t, traceEnv(context.Background()), 0)
+}
+
+// countSpan counts the calls which must happen once per span.
+type countSpan struct {
+	noop.Span
+	ends   int
+	errors int
+}
+
+func (s *countSpan) End(...trace.SpanEndOption) {
+	s.ends++
+}
+
+func (s *countSpan) RecordError(error, ...trace.EventOption) {
+	s.errors++
+}
+
+type countTracer struct {
+	noop.Tracer
+	span *countSpan
+}
+
+func (t *countTracer) Start(ctx context.Context, _ string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.ContextWithSpan(ctx, t.span), t.span
+}
+
+func TestExecuteCommandEndsSpanOnce(t *testing.T) {
+	orig := tracer
+	t.Cleanup(func() { tracer = orig })
+
+	for _, tt := range []struct {
+		command    string
+		wantErrors int
+	}{
+		{"exit 0", 0},
+		{"exit 1", 1},
+	} {
+		span := &countSpan{}
+		tracer = &countTracer{span: span}
+		executeCommand(context.Background(), &lib.Config{}, tt.command, "v1.0.0", "", 0)
+		assert.Equal(t, 1, span.ends, tt.command)
+		assert.Equal(t, tt.wantErrors, span.errors, tt.command)
+	}
+}
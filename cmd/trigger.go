@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+)
+
+// newTriggerHandler returns a handler that notifies ch on an authorized POST.
+// Triggers within debounce of the previous accepted one are ignored.
+func newTriggerHandler(clock lib.Clock, token string, debounce time.Duration, ch chan<- struct{}) http.Handler {
+	var mu sync.Mutex
+	var last time.Time
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if clock.Now().Sub(last) < debounce {
+			slog.Debug("trigger debounced")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		last = clock.Now()
+
+		select {
+		case ch <- struct{}{}:
+		default:
+			// a cycle is already queued
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+func startTriggerServer(ctx context.Context, config *lib.Config) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/trigger", newTriggerHandler(lib.ClockOf(config), config.TriggerToken, config.TriggerDebounce, ch))
+
+	l, err := net.Listen("tcp", config.TriggerListen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen trigger: %s", err)
+	}
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error(fmt.Sprintf("trigger server stopped: %s", err))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	slog.Info("trigger server started", "addr", l.Addr().String())
+	return ch, nil
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/tj/assert"
+)
+
+func TestTriggerHandler(t *testing.T) {
+	ch := make(chan struct{}, 1)
+	h := newTriggerHandler(lib.RealClock{}, "secret", time.Hour, ch)
+
+	do := func(method, auth string) int {
+		req := httptest.NewRequest(method, "/trigger", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet, "Bearer secret"))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "Bearer wrong"))
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, "Bearer secret"))
+	assert.Len(t, ch, 1)
+
+	// debounced
+	assert.Equal(t, http.StatusTooManyRequests, do(http.MethodPost, "Bearer secret"))
+	assert.Len(t, ch, 1)
+}
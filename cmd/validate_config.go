@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate-config",
+	Short: "Validate the config without starting the server and print the effective config with the secrets redacted.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := validateConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("invalid config: %s", err))
+			os.Exit(1)
+		}
+
+		b, err := json.MarshalIndent(config.Redacted().Settings(), "", "  ")
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to marshal config: %s", err))
+			os.Exit(1)
+		}
+		fmt.Println(string(b))
+	},
+}
+
+// validateConfig loads the config and checks it as the server does.
+func validateConfig() (*lib.Config, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	configs, err := config.RepoConfigs()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range configs {
+		if err := validateServerConfig(c); err != nil {
+			return nil, fmt.Errorf("%s: %s", c.Repo, err)
+		}
+	}
+	return config, nil
+}
+
+func init() {
+	rootCmd.AddCommand(validateConfigCmd)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/pyama86/git-assets-canary-releaser/lib"
+	"github.com/spf13/cobra"
+)
+
+var verifyHistoryCmd = &cobra.Command{
+	Use:   "verify-history",
+	Short: "Verify the signatures of the deploy records with deploy_record_key.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := loadConfig()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to load config: %s", err))
+			os.Exit(1)
+		}
+
+		if config.DeployRecordKey == "" {
+			slog.Error("deploy_record_key is required to verify history")
+			os.Exit(1)
+		}
+
+		state, err := lib.NewStater(config)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to init state: %s", err))
+			os.Exit(1)
+		}
+
+		records, err := state.DeployHistory()
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to get deploy history: %s", err))
+			os.Exit(1)
+		}
+
+		failed := false
+		for _, r := range records {
+			if err := r.Verify(config.DeployRecordKey); err != nil {
+				failed = true
+				fmt.Printf("NG %s %s %s: %s\n", r.DeployedAt.Format(time.RFC3339), r.Host, r.Tag, err)
+				continue
+			}
+			fmt.Printf("OK %s %s %s\n", r.DeployedAt.Format(time.RFC3339), r.Host, r.Tag)
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyHistoryCmd)
+}
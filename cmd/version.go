@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	"github.com/spf13/cobra"
+)
+
+// The build info is set by main, which is given by -ldflags "-X main.version=..." like goreleaser does.
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildDate    = ""
+)
+
+// SetBuildInfo sets the build info reported by the version subcommand and the logs.
+func SetBuildInfo(version, commit, date string) {
+	if version != "" {
+		buildVersion = version
+	}
+	buildCommit = commit
+	buildDate = date
+}
+
+// buildInfo returns the version, the git commit and the build date. The commit and the
+// date fall back to the VCS info embedded by go build when they are not given.
+func buildInfo() (version, commit, date string) {
+	version, commit, date = buildVersion, buildCommit, buildDate
+	if commit != "" && date != "" {
+		return version, commit, date
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version, commit, date
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && commit == "":
+			commit = s.Value
+		case s.Key == "vcs.time" && date == "":
+			date = s.Value
+		}
+	}
+	return version, commit, date
+}
+
+func printVersion(w io.Writer) {
+	version, commit, date := buildInfo()
+	fmt.Fprintf(w, "version: %s\ncommit: %s\ndate: %s\n", version, commit, date)
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Show the version, the git commit and the build date of gacr.",
+	Run: func(cmd *cobra.Command, args []string) {
+		printVersion(cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(versionCmd)
+}
@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+func TestPrintVersion(t *testing.T) {
+	t.Cleanup(func() { SetBuildInfo("dev", "", "") })
+	SetBuildInfo("v1.2.0", "abc123", "2024-01-02T03:04:05Z")
+
+	var buf bytes.Buffer
+	printVersion(&buf)
+	assert.Equal(t, "version: v1.2.0\ncommit: abc123\ndate: 2024-01-02T03:04:05Z\n", buf.String())
+
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// The package name patterns can reference the tag of the release as {{.Tag}}, e.g.
+// "app-{{.Tag}}-linux-amd64.tar.gz", so that only the asset of the tag matches.
+// The tag is quoted as a literal in the regexp.
+
+type assetPattern struct {
+	name     string
+	regexp   *regexp.Regexp
+	template *template.Template
+}
+
+type assetPatterns []assetPattern
+
+type assetPatternData struct {
+	Tag string
+}
+
+func newAssetPattern(name, pattern string) (assetPattern, error) {
+	if !strings.Contains(pattern, "{{") {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return assetPattern{}, fmt.Errorf("invalid %s %q:%s", name, pattern, err)
+		}
+		return assetPattern{name: name, regexp: r}, nil
+	}
+
+	t, err := template.New(name).Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return assetPattern{}, fmt.Errorf("invalid %s %q:%s", name, pattern, err)
+	}
+	p := assetPattern{name: name, template: t}
+	// the template is checked with a tag so that an invalid one fails on loading
+	if _, err := p.forTag("v0.0.0"); err != nil {
+		return assetPattern{}, err
+	}
+	return p, nil
+}
+
+func (p assetPattern) forTag(tag string) (*regexp.Regexp, error) {
+	if p.template == nil {
+		return p.regexp, nil
+	}
+	var b bytes.Buffer
+	if err := p.template.Execute(&b, assetPatternData{Tag: regexp.QuoteMeta(tag)}); err != nil {
+		return nil, fmt.Errorf("invalid %s %q:%s", p.name, p.template.Root.String(), err)
+	}
+	r, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q for tag %s:%s", p.name, b.String(), tag, err)
+	}
+	return r, nil
+}
+
+// forTag returns the patterns for the release of tag.
+func (ps assetPatterns) forTag(tag string) ([]*regexp.Regexp, error) {
+	ret := make([]*regexp.Regexp, 0, len(ps))
+	for _, p := range ps {
+		r, err := p.forTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+func (ps assetPatterns) templated() bool {
+	for _, p := range ps {
+		if p.template != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// assetPath returns the path to save the asset of tag. The assets are saved in the
+// directory of the tag with the templated patterns, so that the versions don't clobber each other.
+func (ps assetPatterns) assetPath(root, tag, name string) string {
+	if ps.templated() {
+		return filepath.Join(root, assetDirName(tag), name)
+	}
+	return filepath.Join(root, name)
+}
+
+func assetDirName(tag string) string {
+	return strings.ReplaceAll(tag, "/", "_")
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// The asset cache stores downloaded assets by sha256 checksum in asset_cache_dir.
+// The checksum asset of each release maps the tag to the checksum, so a release
+// which re-uses an identical asset under a new tag is served without downloading.
+
+func (g *GitHub) cachedAssetPath(checksum string) string {
+	if g.config.AssetCacheDir == "" || checksum == "" {
+		return ""
+	}
+	return filepath.Join(g.config.AssetCacheDir, checksum)
+}
+
+// restoreCachedAsset places the cached asset with checksum at filePath and
+// reports whether it succeeded.
+func (g *GitHub) restoreCachedAsset(checksum, filePath string) bool {
+	cached := g.cachedAssetPath(checksum)
+	if cached == "" {
+		return false
+	}
+	if _, err := os.Stat(cached); err != nil {
+		return false
+	}
+	if err := verifyChecksum(cached, checksum); err != nil {
+		slog.Warn("cached asset checksum mismatch, remove it", "path", cached)
+		os.Remove(cached)
+		return false
+	}
+	if err := linkOrCopy(cached, filePath); err != nil {
+		slog.Warn("failed to restore cached asset", "path", cached, "err", err)
+		return false
+	}
+	slog.Info("asset is restored from cache", "path", filePath, "checksum", checksum)
+	return true
+}
+
+// cacheAsset stores the downloaded asset in the cache. A failure only loses the cache.
+func (g *GitHub) cacheAsset(checksum, filePath string) {
+	cached := g.cachedAssetPath(checksum)
+	if cached == "" {
+		return
+	}
+	if _, err := os.Stat(cached); err == nil {
+		return
+	}
+	if err := os.MkdirAll(g.config.AssetCacheDir, 0755); err != nil {
+		slog.Warn("failed to create asset cache dir", "err", err)
+		return
+	}
+	if err := linkOrCopy(filePath, cached); err != nil {
+		slog.Warn("failed to cache asset", "path", filePath, "err", err)
+	}
+}
+
+// linkOrCopy hard links src to dst, and copies it when they are on different filesystems.
+func linkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,57 @@
+package lib
+
+import "time"
+
+// Clock drives the control loop, the health check and the times recorded in the state so
+// that their timing can be tested without real waits.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// Ticker is the ticker of Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// ClockOf returns the clock of config, which is the real clock unless a test sets another one.
+func ClockOf(config *Config) Clock {
+	if config == nil || config.Clock == nil {
+		return RealClock{}
+	}
+	return config.Clock
+}
+
+// RealClock is the Clock of the time package.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return &realTicker{ticker: time.NewTicker(d)}
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *realTicker) Stop() {
+	t.ticker.Stop()
+}
@@ -1,34 +1,488 @@
 package lib
 
-import "time"
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	OnFailureRollback  = "rollback"
+	OnFailureHold      = "hold"
+	OnFailureAvoidOnly = "avoid_only"
+)
+
+const (
+	VersionSelectionDate   = "date"
+	VersionSelectionSemver = "semver"
+)
+
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+)
+
+const (
+	StateBackendRedis = "redis"
+	StateBackendFile  = "file"
+)
+
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
+// RedisTLSConfig enables TLS for the connections to Redis. Cert and Key are used for mutual TLS.
+type RedisTLSConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CACert             string `mapstructure:"ca_cert"`
+	Cert               string `mapstructure:"cert" validate:"required_with=Key"`
+	Key                string `mapstructure:"key" validate:"required_with=Cert"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
 
 type RedisConfig struct {
-	Host      string `mapstructure:"host" validate:"required"`
-	Port      int    `mapstructure:"port" validate:"required"`
-	Password  string `mapstructure:"password"`
-	DB        int    `mapstructure:"db" validate:"required"`
-	KeyPrefix string `mapstructure:"key_prefix"`
+	Mode             string         `mapstructure:"mode" validate:"omitempty,oneof=standalone sentinel cluster"`
+	Host             string         `mapstructure:"host" validate:"required"`
+	Port             int            `mapstructure:"port" validate:"required"`
+	Addrs            []string       `mapstructure:"addrs" validate:"required_if=Mode sentinel"`
+	MasterName       string         `mapstructure:"master_name" validate:"required_if=Mode sentinel"`
+	Password         string         `mapstructure:"password"`
+	SentinelPassword string         `mapstructure:"sentinel_password"`
+	DB               int            `mapstructure:"db" validate:"required"`
+	KeyPrefix        string         `mapstructure:"key_prefix"`
+	TLS              RedisTLSConfig `mapstructure:"tls"`
+	Timeout          time.Duration  `mapstructure:"timeout"`
+}
+
+// HealthCheckHTTPConfig replaces healthcheck_command with a GET request when URL is set.
+type HealthCheckHTTPConfig struct {
+	URL            string `mapstructure:"url" validate:"omitempty,url"`
+	ExpectedStatus int    `mapstructure:"expected_status"`
+	BodyContains   string `mapstructure:"body_contains"`
+}
+
+// RepoConfig is a section of repos, which overrides the global settings for the repository.
+type RepoConfig struct {
+	Repo                string                `mapstructure:"repo" validate:"required"`
+	KeyPrefix           string                `mapstructure:"key_prefix"`
+	StateFile           string                `mapstructure:"state_file"`
+	SaveAssetsPath      string                `mapstructure:"save_assets_path"`
+	PackageNamePattern  string                `mapstructure:"package_name_pattern"`
+	PackageNamePatterns []string              `mapstructure:"package_name_patterns"`
+	TagPattern          string                `mapstructure:"tag_pattern"`
+	ReleaseBranch       string                `mapstructure:"release_branch"`
+	DeployCommand       string                `mapstructure:"deploy_command"`
+	RollbackCommand     string                `mapstructure:"rollback_command"`
+	HealthCheckCommand  string                `mapstructure:"healthcheck_command"`
+	HealthCheckHTTP     HealthCheckHTTPConfig `mapstructure:"healthcheck_http"`
+	VersionCommand      string                `mapstructure:"version_command"`
 }
 
 type Config struct {
-	GitHubToken              string        `mapstructure:"github_token"`
-	Repo                     string        `mapstructure:"repo" validate:"required"`
-	SaveAssetsPath           string        `mapstructure:"save_assets_path" validate:"required"`
-	GitHubAPIEndpoint        string        `mapstructure:"github_api"`
-	DeployCommand            string        `mapstructure:"deploy_command"  validate:"required"`
-	RollbackCommand          string        `mapstructure:"rollback_command"`
-	HealthCheckCommand       string        `mapstructure:"healthcheck_command" validate:"required"`
-	VersionCommand           string        `mapstructure:"version_command" validate:"required"`
-	HealthCheckInterval      time.Duration `mapstructure:"healthcheck_interval" validate:"required"`
-	CanaryRolloutWindow      time.Duration `mapstructure:"canary_rollout_window" validate:"required"`
-	RolloutWindow            time.Duration `mapstructure:"rollout_window" validate:"required"`
-	RepositryPollingInterval time.Duration `mapstructure:"repository_polling_interval" validate:"required"`
-	PackageNamePattern       string        `mapstructure:"package_name_pattern" validate:"required"`
-	SlackWebhookURL          string        `mapstructure:"slack_webhook_url"`
-	SlackChannel             string        `mapstructure:"slack_channel"`
-	Redis                    *RedisConfig  `mapstructure:"redis" validate:"required"`
-	LogLevel                 string        `mapstructure:"log_level"`
-	HealthCheckRetries       uint          `mapstructure:"healthcheck_retries" validate:"required"`
-	HealthCheckTimeout       time.Duration `mapstructure:"healthcheck_timeout" validate:"required"`
-	IncludePreRelease        bool          `mapstructure:"include_prerelease"`
+	Provider                       string                `mapstructure:"provider" validate:"omitempty,oneof=github gitlab"`
+	GitHubToken                    string                `mapstructure:"github_token"`
+	GitLabToken                    string                `mapstructure:"gitlab_token"`
+	GitLabAPIEndpoint              string                `mapstructure:"gitlab_api"`
+	Repo                           string                `mapstructure:"repo" validate:"required_without=Repos"`
+	Repos                          []RepoConfig          `mapstructure:"repos" validate:"dive"`
+	SaveAssetsPath                 string                `mapstructure:"save_assets_path" validate:"required"`
+	Snapshot                       bool                  `mapstructure:"snapshot"`
+	ExtractAssets                  bool                  `mapstructure:"extract_assets"`
+	DeployFromStdin                bool                  `mapstructure:"deploy_from_stdin"`
+	DryRun                         bool                  `mapstructure:"dry_run"`
+	GitHubMaxRetries               uint                  `mapstructure:"github_max_retries"`
+	GitHubRetryDelay               time.Duration         `mapstructure:"github_retry_delay"`
+	RespectRateLimit               bool                  `mapstructure:"respect_rate_limit"`
+	GitHubAPIEndpoint              string                `mapstructure:"github_api"`
+	HTTPProxy                      string                `mapstructure:"http_proxy"`
+	HTTPSProxy                     string                `mapstructure:"https_proxy"`
+	NoProxy                        string                `mapstructure:"no_proxy"`
+	DeployCommand                  string                `mapstructure:"deploy_command"`
+	RollbackCommand                string                `mapstructure:"rollback_command"`
+	PreDeployCommand               string                `mapstructure:"pre_deploy_command"`
+	PostDeployCommand              string                `mapstructure:"post_deploy_command"`
+	DeploySkipExitCode             int                   `mapstructure:"deploy_skip_exit_code" validate:"gte=0,lte=255"`
+	CommandEnv                     map[string]string     `mapstructure:"command_env"`
+	CommandWorkingDir              string                `mapstructure:"command_working_dir"`
+	MaxCommandOutputBytes          int                   `mapstructure:"max_command_output_bytes" validate:"gte=0"`
+	StreamCommandOutput            bool                  `mapstructure:"stream_command_output"`
+	HealthCheckCommand             string                `mapstructure:"healthcheck_command"`
+	HealthCheckHTTP                HealthCheckHTTPConfig `mapstructure:"healthcheck_http"`
+	VersionCommand                 string                `mapstructure:"version_command" validate:"required_without=Repos"`
+	VersionCommandFailureThreshold uint                  `mapstructure:"version_command_failure_threshold"`
+	VersionCacheTTL                time.Duration         `mapstructure:"version_cache_ttl"`
+	HealthCheckInterval            time.Duration         `mapstructure:"healthcheck_interval" validate:"required"`
+	CanaryCohortSize               uint                  `mapstructure:"canary_cohort_size"`
+	CanaryLockQueue                bool                  `mapstructure:"canary_lock_queue"`
+	CanaryRolloutWindow            time.Duration         `mapstructure:"canary_rollout_window" validate:"required"`
+	CanaryLockTTL                  time.Duration         `mapstructure:"canary_lock_ttl"`
+	CanaryLockHeartbeat            time.Duration         `mapstructure:"canary_lock_heartbeat"`
+	MaxConcurrentRollout           uint                  `mapstructure:"max_concurrent_rollout"`
+	RolloutBatchPercent            uint                  `mapstructure:"rollout_batch_percent" validate:"max=100"`
+	RolloutWindow                  time.Duration         `mapstructure:"rollout_window" validate:"required"`
+	RolloutLockTTL                 time.Duration         `mapstructure:"rollout_lock_ttl"`
+	PostRolloutVerifyCommand       string                `mapstructure:"post_rollout_verify_command"`
+	NotifyRolloutStart             bool                  `mapstructure:"notify_rollout_start"`
+	RolloutCompleteThreshold       uint                  `mapstructure:"rollout_complete_threshold" validate:"max=100"`
+	RolloutStallWindows            uint                  `mapstructure:"rollout_stall_windows"`
+	RepositryPollingInterval       time.Duration         `mapstructure:"repository_polling_interval" validate:"required"`
+	PackageNamePattern             string                `mapstructure:"package_name_pattern" validate:"required_without_all=PackageNamePatterns Repos"`
+	PackageNamePatterns            []string              `mapstructure:"package_name_patterns"`
+	ConfirmPolls                   uint                  `mapstructure:"confirm_polls"`
+	ChannelSourceTag               string                `mapstructure:"channel_source_tag" validate:"required_with=Channel"`
+	Channel                        string                `mapstructure:"channel" validate:"required_with=ChannelSourceTag"`
+	TagPattern                     string                `mapstructure:"tag_pattern"`
+	ReleaseBranch                  string                `mapstructure:"release_branch"`
+	VersionSelection               string                `mapstructure:"version_selection" validate:"omitempty,oneof=date semver"`
+	VersionPrefix                  string                `mapstructure:"version_prefix"`
+	VersionConstraint              string                `mapstructure:"version_constraint"`
+	SlackWebhookURL                string                `mapstructure:"slack_webhook_url"`
+	SlackChannel                   string                `mapstructure:"slack_channel"`
+	SlackMentionOnError            string                `mapstructure:"slack_mention_on_error"`
+	SlackMentionOnWarn             string                `mapstructure:"slack_mention_on_warn"`
+	NotifyWebhookURL               string                `mapstructure:"notify_webhook_url" validate:"omitempty,url"`
+	DiscordWebhookURL              string                `mapstructure:"discord_webhook_url" validate:"omitempty,url"`
+	TeamsWebhookURL                string                `mapstructure:"teams_webhook_url" validate:"omitempty,url"`
+	StateBackend                   string                `mapstructure:"state_backend" validate:"omitempty,oneof=redis file"`
+	StateFile                      string                `mapstructure:"state_file" validate:"required_if=StateBackend file"`
+	Redis                          *RedisConfig          `mapstructure:"redis" validate:"required"`
+	IsCanary                       *bool                 `mapstructure:"is_canary"`
+	CanaryHosts                    []string              `mapstructure:"canary_hosts"`
+	InstanceID                     string                `mapstructure:"instance_id"`
+	LogLevel                       string                `mapstructure:"log_level"`
+	LogFormat                      string                `mapstructure:"log_format" validate:"omitempty,oneof=json text"`
+	LogFile                        string                `mapstructure:"log_file"`
+	LogStderr                      bool                  `mapstructure:"log_stderr" validate:"excluded_with=LogFile"`
+	OtelEndpoint                   string                `mapstructure:"otel_endpoint"`
+	HealthCheckRetries             uint                  `mapstructure:"healthcheck_retries" validate:"required"`
+	HealthCheckSuccessThreshold    uint                  `mapstructure:"healthcheck_success_threshold"`
+	HealthCheckTimeout             time.Duration         `mapstructure:"healthcheck_timeout" validate:"required"`
+	TrustPeerHealth                time.Duration         `mapstructure:"trust_peer_health"`
+	LivenessCheckCommand           string                `mapstructure:"liveness_check_command"`
+	IncludePreRelease              bool                  `mapstructure:"include_prerelease"`
+	IncludeDraft                   bool                  `mapstructure:"include_draft"`
+	ReleaseMinAge                  time.Duration         `mapstructure:"release_min_age"`
+	ResolveLFS                     bool                  `mapstructure:"resolve_lfs"`
+	ChecksumPattern                string                `mapstructure:"checksum_pattern"`
+	AssetCacheDir                  string                `mapstructure:"asset_cache_dir"`
+	KeepAssets                     int                   `mapstructure:"keep_assets" validate:"gte=0"`
+	ChecksumRetries                uint                  `mapstructure:"checksum_retries"`
+	SignaturePattern               string                `mapstructure:"signature_pattern" validate:"required_with=SignaturePublicKey"`
+	SignaturePublicKey             string                `mapstructure:"signature_public_key" validate:"required_with=SignaturePattern"`
+	DeployRecordKey                string                `mapstructure:"deploy_record_key"`
+	OnFailure                      string                `mapstructure:"on_failure" validate:"omitempty,oneof=rollback hold avoid_only"`
+	RetryDecisionCommand           string                `mapstructure:"retry_decision_command"`
+	RetryDecisionMaxAttempts       uint                  `mapstructure:"retry_decision_max_attempts"`
+	DeployBackoffMax               time.Duration         `mapstructure:"deploy_backoff_max"`
+	HoldNewRelease                 bool                  `mapstructure:"hold_new_release"`
+	AvoidTagTTL                    time.Duration         `mapstructure:"avoid_tag_ttl"`
+	WarmupCommand                  string                `mapstructure:"warmup_command"`
+	ShutdownGrace                  time.Duration         `mapstructure:"shutdown_grace"`
+	MetricsAddr                    string                `mapstructure:"metrics_addr"`
+	ReadinessAddr                  string                `mapstructure:"readiness_addr"`
+	TriggerListen                  string                `mapstructure:"trigger_listen"`
+	TriggerToken                   string                `mapstructure:"trigger_token" validate:"required_with=TriggerListen"`
+	TriggerDebounce                time.Duration         `mapstructure:"trigger_debounce"`
+	PreventDowngrade               bool                  `mapstructure:"prevent_downgrade"`
+	AllowDowngrade                 bool                  `mapstructure:"allow_downgrade"`
+
+	// Clock is not configurable. Tests set a fake to control the time.
+	Clock Clock `mapstructure:"-"`
+}
+
+// RepoConfigs returns the config of each section of repos on top of the global settings,
+// or the config itself without repos. The assets of a repository are saved under
+// save_assets_path/<repo> unless the section sets save_assets_path.
+func (c *Config) RepoConfigs() ([]*Config, error) {
+	if len(c.Repos) == 0 {
+		return []*Config{c}, nil
+	}
+
+	ret := make([]*Config, 0, len(c.Repos))
+	prefixes := map[string]string{}
+	stateFiles := map[string]string{}
+	for _, r := range c.Repos {
+		rc := c.repoConfig(&r)
+		if other, ok := prefixes[keyPrefix(rc)]; ok {
+			return nil, fmt.Errorf("repos %s and %s share the key prefix %q", other, r.Repo, keyPrefix(rc))
+		}
+		prefixes[keyPrefix(rc)] = r.Repo
+		if rc.StateBackend == StateBackendFile {
+			if other, ok := stateFiles[rc.StateFile]; ok {
+				return nil, fmt.Errorf("repos %s and %s share the state_file %q", other, r.Repo, rc.StateFile)
+			}
+			stateFiles[rc.StateFile] = r.Repo
+		}
+		ret = append(ret, rc)
+	}
+	return ret, nil
+}
+
+// RepoConfig returns the config of the section of repo.
+func (c *Config) RepoConfig(repo string) (*Config, error) {
+	for _, r := range c.Repos {
+		if r.Repo == repo {
+			return c.repoConfig(&r), nil
+		}
+	}
+	return nil, fmt.Errorf("repo %s is not found in repos", repo)
+}
+
+func (c *Config) repoConfig(r *RepoConfig) *Config {
+	rc := *c
+	rc.Repos = nil
+	rc.Repo = r.Repo
+
+	// the keys of the repository are prefixed with key_prefix of the section, or the repo
+	redis := *c.Redis
+	redis.KeyPrefix = r.KeyPrefix
+	rc.Redis = &redis
+
+	rc.SaveAssetsPath = filepath.Join(c.SaveAssetsPath, r.Repo)
+	if r.SaveAssetsPath != "" {
+		rc.SaveAssetsPath = r.SaveAssetsPath
+	}
+	if r.PackageNamePattern != "" || len(r.PackageNamePatterns) > 0 {
+		rc.PackageNamePattern = r.PackageNamePattern
+		rc.PackageNamePatterns = r.PackageNamePatterns
+	}
+	if r.HealthCheckCommand != "" || r.HealthCheckHTTP.URL != "" {
+		rc.HealthCheckCommand = r.HealthCheckCommand
+		rc.HealthCheckHTTP = r.HealthCheckHTTP
+	}
+	for _, o := range []struct {
+		dst *string
+		src string
+	}{
+		{&rc.StateFile, r.StateFile},
+		{&rc.TagPattern, r.TagPattern},
+		{&rc.ReleaseBranch, r.ReleaseBranch},
+		{&rc.DeployCommand, r.DeployCommand},
+		{&rc.RollbackCommand, r.RollbackCommand},
+		{&rc.VersionCommand, r.VersionCommand},
+	} {
+		if o.src != "" {
+			*o.dst = o.src
+		}
+	}
+	return &rc
+}
+
+const redacted = "[REDACTED]"
+
+// Redacted returns a copy of the config with the secrets masked, to print it.
+// The webhook URLs keep the scheme and the host.
+func (c *Config) Redacted() *Config {
+	rc := *c
+	for _, s := range []*string{
+		&rc.GitHubToken,
+		&rc.GitLabToken,
+		&rc.TriggerToken,
+		&rc.DeployRecordKey,
+	} {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	for _, u := range []*string{
+		&rc.SlackWebhookURL,
+		&rc.NotifyWebhookURL,
+		&rc.DiscordWebhookURL,
+		&rc.TeamsWebhookURL,
+	} {
+		*u = RedactURL(*u)
+	}
+	rc.HealthCheckHTTP.URL = redactURLPassword(rc.HealthCheckHTTP.URL)
+	rc.GitHubAPIEndpoint = redactURLPassword(rc.GitHubAPIEndpoint)
+	rc.GitLabAPIEndpoint = redactURLPassword(rc.GitLabAPIEndpoint)
+	rc.HTTPProxy = redactURLPassword(rc.HTTPProxy)
+	rc.HTTPSProxy = redactURLPassword(rc.HTTPSProxy)
+
+	if c.Redis != nil {
+		rc.Redis = c.Redis.Redacted()
+	}
+	return &rc
+}
+
+// LogValue logs the settings with the secrets masked.
+func (c Config) LogValue() slog.Value {
+	return slog.AnyValue(c.Redacted().Settings())
+}
+
+func (c *RedisConfig) Redacted() *RedisConfig {
+	rc := *c
+	if rc.Password != "" {
+		rc.Password = redacted
+	}
+	if rc.SentinelPassword != "" {
+		rc.SentinelPassword = redacted
+	}
+	return &rc
+}
+
+// LogValue logs the settings with the passwords masked.
+func (c RedisConfig) LogValue() slog.Value {
+	return slog.AnyValue(settings(reflect.ValueOf(c.Redacted())))
+}
+
+// Settings returns the values keyed by the names in the config file.
+// The durations are formatted as in the config file.
+func (c *Config) Settings() map[string]interface{} {
+	return settings(reflect.ValueOf(c)).(map[string]interface{})
+}
+
+func settings(v reflect.Value) interface{} {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		return time.Duration(v.Int()).String()
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return settings(v.Elem())
+	case reflect.Struct:
+		m := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("mapstructure"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			m[name] = settings(v.Field(i))
+		}
+		return m
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		s := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			s = append(s, settings(v.Index(i)))
+		}
+		return s
+	}
+	return v.Interface()
+}
+
+// RedactSecrets masks the secrets in s, such as an error message.
+func RedactSecrets(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// RedactURL masks all but the scheme and the host, as the path of a webhook URL is the secret.
+func RedactURL(s string) string {
+	if s == "" {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	return fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, redacted)
+}
+
+// redactURLPassword masks the password of the userinfo only.
+func redactURLPassword(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	return u.Redacted()
+}
+
+var repoPattern = regexp.MustCompile(`^[^/\s]+/[^/\s]+$`)
+
+// the project of GitLab can be in the subgroups
+var gitLabProjectPattern = regexp.MustCompile(`^[^/\s]+(/[^/\s]+)+$`)
+
+// ValidateConfig checks the values which the validate tags can't, so that an invalid
+// config fails on loading with a readable error instead of panicking later.
+func ValidateConfig(config *Config) error {
+	if config.Provider == ProviderGitLab {
+		if !gitLabProjectPattern.MatchString(config.Repo) {
+			return fmt.Errorf("invalid repo %q: must be group/name", config.Repo)
+		}
+	} else if !repoPattern.MatchString(config.Repo) {
+		return fmt.Errorf("invalid repo %q: must be owner/name", config.Repo)
+	}
+
+	if _, err := packageNamePatterns(config); err != nil {
+		return err
+	}
+	for _, p := range []struct{ name, pattern string }{
+		{"tag_pattern", config.TagPattern},
+		{"checksum_pattern", config.ChecksumPattern},
+		{"signature_pattern", config.SignaturePattern},
+	} {
+		if _, err := compilePattern(p.name, p.pattern); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"repository_polling_interval", config.RepositryPollingInterval},
+		{"healthcheck_interval", config.HealthCheckInterval},
+		{"healthcheck_timeout", config.HealthCheckTimeout},
+		{"canary_rollout_window", config.CanaryRolloutWindow},
+		{"rollout_window", config.RolloutWindow},
+	} {
+		if d.value <= 0 {
+			return fmt.Errorf("%s must be positive: %s", d.name, d.value)
+		}
+	}
+	if config.HealthCheckRetries == 0 {
+		return fmt.Errorf("healthcheck_retries must be positive")
+	}
+	for _, h := range config.CanaryHosts {
+		if _, err := path.Match(h, ""); err != nil {
+			return fmt.Errorf("invalid canary_hosts %q:%s", h, err)
+		}
+	}
+	return nil
+}
+
+// CanaryEligible reports whether the node of hostname may become a canary. is_canary decides
+// it when set, and otherwise the hostname must match one of canary_hosts if any.
+func CanaryEligible(config *Config, hostname string) bool {
+	if config.IsCanary != nil {
+		return *config.IsCanary
+	}
+	if len(config.CanaryHosts) == 0 {
+		return true
+	}
+	for _, h := range config.CanaryHosts {
+		if ok, _ := path.Match(h, hostname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePattern returns nil for an empty pattern.
+func compilePattern(name, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	r, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q:%s", name, pattern, err)
+	}
+	return r, nil
 }
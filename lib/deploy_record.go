@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const deployHistoryLimit = 1000
+
+var ErrInvalidSignature = errors.New("invalid deploy record signature")
+
+// DeployRecord is an entry of the deploy history. Signature is the HMAC-SHA256 of
+// host, tag and deployed_at with deploy_record_key, and is empty when no key is configured.
+type DeployRecord struct {
+	Host       string    `json:"host"`
+	Tag        string    `json:"tag"`
+	DeployedAt time.Time `json:"deployed_at"`
+	Signature  string    `json:"signature,omitempty"`
+}
+
+func (r *DeployRecord) sign(key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s", r.Host, r.Tag, r.DeployedAt.UTC().Format(time.RFC3339Nano))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of the record with key.
+func (r *DeployRecord) Verify(key string) error {
+	if r.Signature == "" {
+		return fmt.Errorf("%w: not signed", ErrInvalidSignature)
+	}
+	sig, err := hex.DecodeString(r.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+	want, _ := hex.DecodeString(r.sign(key))
+	if !hmac.Equal(sig, want) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// SaveDeployRecord appends a record of this node deploying tag to the deploy history.
+func (s *State) SaveDeployRecord(tag string) error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	r := &DeployRecord{
+		Host:       s.me,
+		Tag:        tag,
+		DeployedAt: s.now().UTC(),
+	}
+	if s.config.DeployRecordKey != "" {
+		r.Signature = r.sign(s.config.DeployRecordKey)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.LPush(ctx, s.deployHistoryKey, b)
+	pipe.LTrim(ctx, s.deployHistoryKey, 0, deployHistoryLimit-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DeployHistory returns the deploy records, newest first.
+func (s *State) DeployHistory() ([]DeployRecord, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	vs, err := s.client.LRange(ctx, s.deployHistoryKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]DeployRecord, 0, len(vs))
+	for _, v := range vs {
+		r := DeployRecord{}
+		if err := json.Unmarshal([]byte(v), &r); err != nil {
+			return nil, fmt.Errorf("can't parse deploy record:%s", err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
@@ -0,0 +1,295 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extract_assets extracts the archives of a tag into <save_assets_path>/extracted/<tag>,
+// which is given to the deploy command as ASSET_DIR.
+
+const extractedDir = "extracted"
+
+var ErrNoArchive = errors.New("no archive in assets")
+var ErrUnsafeArchivePath = errors.New("unsafe path in archive")
+
+func ExtractDir(root, tag string) string {
+	return filepath.Join(root, extractedDir, strings.ReplaceAll(tag, "/", "_"))
+}
+
+// isArchive reports whether the file is a tar.gz or zip archive by its name.
+func isArchive(file string) bool {
+	name := strings.ToLower(file)
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".zip")
+}
+
+// ExtractAssets extracts the tar.gz and zip archives among files into the directory of tag
+// and returns the directory. The other files are not placed in the directory. The directory
+// is replaced as a whole so that the files of a previous extraction don't remain.
+func ExtractAssets(root, tag string, files ...string) (string, error) {
+	dir := ExtractDir(root, tag)
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", fmt.Errorf("can't create extract dir:%s", err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+".tmp")
+	if err != nil {
+		return "", fmt.Errorf("can't create extract dir:%s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	extracted := false
+	for _, file := range files {
+		if !isArchive(file) {
+			continue
+		}
+		if err := extractArchive(file, tmp); err != nil {
+			return "", fmt.Errorf("can't extract %s: %w", filepath.Base(file), err)
+		}
+		extracted = true
+	}
+	if !extracted {
+		return "", ErrNoArchive
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", fmt.Errorf("can't create extract dir:%s", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("can't remove previous extract dir:%s", err)
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", fmt.Errorf("can't place extract dir:%s", err)
+	}
+	return dir, nil
+}
+
+func extractArchive(file, dir string) error {
+	name := strings.ToLower(file)
+	if strings.HasSuffix(name, ".zip") {
+		return extractZip(file, dir)
+	}
+	return extractTarGz(file, dir)
+}
+
+func inDir(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+// isSymlink reports whether p exists as a symlink.
+func isSymlink(p string) (bool, error) {
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode()&os.ModeSymlink != 0, nil
+}
+
+// safePath returns the path of name in dir, and refuses the name escaping dir (zip-slip).
+// The path is also refused when it or one of its parents is a symlink extracted before,
+// because the entry would be written through the link.
+func safePath(dir, name string) (string, error) {
+	p := filepath.Join(dir, name)
+	if !inDir(dir, p) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafeArchivePath, name)
+	}
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrUnsafeArchivePath, name)
+	}
+	cur := dir
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		if c == "." {
+			continue
+		}
+		cur = filepath.Join(cur, c)
+		link, err := isSymlink(cur)
+		if err != nil {
+			return "", err
+		}
+		if link {
+			return "", fmt.Errorf("%w: %s through symlink", ErrUnsafeArchivePath, name)
+		}
+	}
+	return p, nil
+}
+
+// safeLink refuses the link whose target escapes dir. The target is followed component by
+// component, and the one going through another link is refused because the link may point
+// outside of dir, e.g. "d/f -> e/.." with "d/e -> ..".
+func safeLink(dir, path, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("%w: %s -> %s", ErrUnsafeArchivePath, path, target)
+	}
+	cur := filepath.Dir(path)
+	for _, c := range strings.Split(filepath.ToSlash(target), "/") {
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			if !inDir(dir, cur) {
+				return fmt.Errorf("%w: %s -> %s", ErrUnsafeArchivePath, path, target)
+			}
+		default:
+			cur = filepath.Join(cur, c)
+			link, err := isSymlink(cur)
+			if err != nil {
+				return err
+			}
+			if link {
+				return fmt.Errorf("%w: %s -> %s points at symlink", ErrUnsafeArchivePath, path, target)
+			}
+		}
+	}
+	return nil
+}
+
+func extractTarGz(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p, err := safePath(dir, h.Name)
+		if err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeExtracted(p, tr, h.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := safeLink(dir, p, h.Linkname); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(h.Linkname, p); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := safePath(dir, h.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(target, p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func extractZip(file, dir string) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		p, err := safePath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+		if zf.FileInfo().IsDir() {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if zf.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: symlink %s", ErrUnsafeArchivePath, zf.Name)
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = writeExtracted(p, r, zf.Mode().Perm())
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeExtracted(p string, r io.Reader, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if perm == 0 {
+		perm = 0644
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// PruneExtracted removes the extracted directories other than the ones of keepTags.
+// A rollback extracts the archive of the tag again, so the old ones are not needed.
+func PruneExtracted(root string, keepTags ...string) error {
+	entries, err := os.ReadDir(filepath.Join(root, extractedDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	keep := map[string]bool{}
+	for _, tag := range keepTags {
+		keep[ExtractDir(root, tag)] = true
+	}
+	for _, e := range entries {
+		p := filepath.Join(root, extractedDir, e.Name())
+		if keep[p] {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("can't remove extract dir:%s %s", p, err)
+		}
+	}
+	return nil
+}
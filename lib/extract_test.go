@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+type archiveEntry struct {
+	name     string
+	body     string
+	linkname string
+}
+
+func writeTarGz(t *testing.T, file string, entries ...archiveEntry) {
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0755, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+		if e.linkname != "" {
+			h = &tar.Header{Name: e.name, Linkname: e.linkname, Typeflag: tar.TypeSymlink}
+		}
+		assert.NoError(t, tw.WriteHeader(h))
+		_, err := tw.Write([]byte(e.body))
+		assert.NoError(t, err)
+	}
+}
+
+func writeZip(t *testing.T, file string, entries ...archiveEntry) {
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	defer zw.Close()
+
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(e.body))
+		assert.NoError(t, err)
+	}
+}
+
+func TestExtractAssets(t *testing.T) {
+	root := t.TempDir()
+	tarGz := filepath.Join(root, "app-v1.0.0.tar.gz")
+	writeTarGz(t, tarGz,
+		archiveEntry{name: "bin/app", body: "app"},
+		archiveEntry{name: "bin/current", linkname: "app"},
+	)
+	zipFile := filepath.Join(root, "conf-v1.0.0.zip")
+	writeZip(t, zipFile, archiveEntry{name: "conf/app.conf", body: "conf"})
+	raw := filepath.Join(root, "app-v1.0.0.sha256")
+	assert.NoError(t, os.WriteFile(raw, []byte("sum"), 0644))
+
+	dir, err := ExtractAssets(root, "v1.0.0", tarGz, zipFile, raw)
+	assert.NoError(t, err)
+	assert.Equal(t, ExtractDir(root, "v1.0.0"), dir)
+
+	b, err := os.ReadFile(filepath.Join(dir, "bin", "current"))
+	assert.NoError(t, err)
+	assert.Equal(t, "app", string(b))
+	fi, err := os.Stat(filepath.Join(dir, "bin", "app"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+	b, err = os.ReadFile(filepath.Join(dir, "conf", "app.conf"))
+	assert.NoError(t, err)
+	assert.Equal(t, "conf", string(b))
+	_, err = os.Stat(filepath.Join(dir, "app-v1.0.0.sha256"))
+	assert.True(t, os.IsNotExist(err))
+
+	// extracting again replaces the directory
+	writeTarGz(t, tarGz, archiveEntry{name: "bin/app2", body: "app2"})
+	dir, err = ExtractAssets(root, "v1.0.0", tarGz)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "bin", "app"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = ExtractAssets(root, "v1.0.0", raw)
+	assert.True(t, errors.Is(err, ErrNoArchive))
+
+	_, err = ExtractAssets(root, "v1.1.0", tarGz)
+	assert.NoError(t, err)
+	assert.NoError(t, PruneExtracted(root, "v1.1.0"))
+	_, err = os.Stat(ExtractDir(root, "v1.0.0"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(ExtractDir(root, "v1.1.0"))
+	assert.NoError(t, err)
+}
+
+func TestExtractAssetsUnsafePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(t *testing.T, file string)
+		file  string
+	}{
+		{
+			name: "tar parent path",
+			file: "app.tar.gz",
+			write: func(t *testing.T, file string) {
+				writeTarGz(t, file, archiveEntry{name: "../evil", body: "evil"})
+			},
+		},
+		{
+			name: "tar absolute symlink",
+			file: "app.tgz",
+			write: func(t *testing.T, file string) {
+				writeTarGz(t, file, archiveEntry{name: "passwd", linkname: "/etc/passwd"})
+			},
+		},
+		{
+			name: "tar escaping symlink",
+			file: "app.tgz",
+			write: func(t *testing.T, file string) {
+				writeTarGz(t, file, archiveEntry{name: "sub/link", linkname: "../../evil"})
+			},
+		},
+		{
+			name: "tar symlink chain",
+			file: "app.tgz",
+			write: func(t *testing.T, file string) {
+				writeTarGz(t, file,
+					archiveEntry{name: "d/e", linkname: ".."},
+					archiveEntry{name: "d/f", linkname: "e/.."},
+					archiveEntry{name: "d/f/evil", body: "evil"},
+				)
+			},
+		},
+		{
+			name: "tar write through symlink",
+			file: "app.tgz",
+			write: func(t *testing.T, file string) {
+				writeTarGz(t, file,
+					archiveEntry{name: "d/e", linkname: ".."},
+					archiveEntry{name: "d/e/evil", body: "evil"},
+				)
+			},
+		},
+		{
+			name: "zip parent path",
+			file: "app.zip",
+			write: func(t *testing.T, file string) {
+				writeZip(t, file, archiveEntry{name: "a/../../evil", body: "evil"})
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			file := filepath.Join(root, tt.file)
+			tt.write(t, file)
+
+			_, err := ExtractAssets(root, "v1.0.0", file)
+			assert.True(t, errors.Is(err, ErrUnsafeArchivePath))
+			_, err = os.Stat(filepath.Join(root, "extracted", "evil"))
+			assert.True(t, os.IsNotExist(err))
+			_, err = os.Stat(ExtractDir(root, "v1.0.0"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
@@ -0,0 +1,669 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// FileState keeps the state in a local file for a single node deployment without Redis.
+// The file is guarded by flock so that several processes on the host can share it.
+type FileState struct {
+	nodeState
+	me   string
+	path string
+}
+
+type fileLock struct {
+	Tag       string    `json:"tag"`
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (l *fileLock) held(now time.Time) bool {
+	return l != nil && now.Before(l.ExpiresAt)
+}
+
+type fileStateData struct {
+	StableReleaseTag   string                  `json:"stable_release_tag,omitempty"`
+	AvoidReleaseTags   []string                `json:"avoid_release_tags,omitempty"`
+	AvoidTagExpiry     map[string]time.Time    `json:"avoid_tag_expiry,omitempty"`
+	AvoidReasons       map[string]*AvoidReason `json:"avoid_reasons,omitempty"`
+	PendingReleaseTag  string                  `json:"pending_release_tag,omitempty"`
+	PromotedReleaseTag string                  `json:"promoted_release_tag,omitempty"`
+	RolloutStartTag    string                  `json:"rollout_start_tag,omitempty"`
+	RolloutStall       string                  `json:"rollout_stall,omitempty"`
+	RolloutCompleteTag string                  `json:"rollout_complete_tag,omitempty"`
+	HeldTag            string                  `json:"held_tag,omitempty"`
+	AbortCanary        *fileLock               `json:"abort_canary,omitempty"`
+	DeployFailure      *DeployFailure          `json:"deploy_failure,omitempty"`
+	DeployProgress     *DeployProgress         `json:"deploy_progress,omitempty"`
+	Member             *MemberState            `json:"member,omitempty"`
+	CanaryLock         *fileLock               `json:"canary_lock,omitempty"`
+	RolloutLock        *fileLock               `json:"rollout_lock,omitempty"`
+	HealthAttestation  *HealthAttestation      `json:"health_attestation,omitempty"`
+	RolloutReport      *RolloutReport          `json:"rollout_report,omitempty"`
+	DeployHistory      []DeployRecord          `json:"deploy_history,omitempty"`
+	ReleaseHistory     []ReleaseHistory        `json:"release_history,omitempty"`
+}
+
+func NewFileState(config *Config) (*FileState, error) {
+	if err := os.MkdirAll(filepath.Dir(config.StateFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %s", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %s", err)
+	}
+
+	me := hostname
+	if config.InstanceID != "" {
+		me = fmt.Sprintf("%s:%s", me, config.InstanceID)
+	}
+
+	s := &FileState{
+		nodeState: nodeState{config: config},
+		me:        me,
+		path:      config.StateFile,
+	}
+	if err := s.view(func(*fileStateData) error { return nil }); err != nil {
+		return nil, fmt.Errorf("failed to read state file: %s", err)
+	}
+	return s, nil
+}
+
+func (s *FileState) flock(how int) (func(), error) {
+	f, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (s *FileState) read() (*fileStateData, error) {
+	d := &fileStateData{}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return d, nil
+		}
+		return nil, err
+	}
+	if len(b) == 0 {
+		return d, nil
+	}
+	if err := json.Unmarshal(b, d); err != nil {
+		return nil, fmt.Errorf("can't parse state file:%s", err)
+	}
+	return d, nil
+}
+
+func (s *FileState) view(f func(d *fileStateData) error) error {
+	unlock, err := s.flock(syscall.LOCK_SH)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := s.read()
+	if err != nil {
+		return err
+	}
+	return f(d)
+}
+
+// update applies f to the state and writes it back atomically.
+func (s *FileState) update(f func(d *fileStateData) error) error {
+	unlock, err := s.flock(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := s.read()
+	if err != nil {
+		return err
+	}
+	if err := f(d); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *FileState) getString(get func(d *fileStateData) string) (string, error) {
+	var v string
+	err := s.view(func(d *fileStateData) error {
+		v = get(d)
+		return nil
+	})
+	return v, err
+}
+
+func (s *FileState) tryLock(lock **fileLock, tag string, window time.Duration) bool {
+	if (*lock).held(s.now()) {
+		return false
+	}
+	*lock = &fileLock{Tag: tag, Holder: s.me, ExpiresAt: s.now().Add(window)}
+	return true
+}
+
+// extendLock extends the lock to ttl from now when this node holds it.
+func (s *FileState) extendLock(lock func(d *fileStateData) *fileLock, ttl time.Duration) (bool, error) {
+	var ok bool
+	err := s.update(func(d *fileStateData) error {
+		l := lock(d)
+		if !l.held(s.now()) || l.Holder != s.me {
+			return nil
+		}
+		l.ExpiresAt = s.now().Add(ttl)
+		ok = true
+		return nil
+	})
+	return ok, err
+}
+
+func (s *FileState) ExtendCanaryReleaseLock(ttl time.Duration) (bool, error) {
+	return s.extendLock(func(d *fileStateData) *fileLock { return d.CanaryLock }, ttl)
+}
+
+func (s *FileState) ExtendRolloutLock() (bool, error) {
+	return s.extendLock(func(d *fileStateData) *fileLock { return d.RolloutLock }, RolloutLockTTL(s.config))
+}
+
+func (s *FileState) TryCanaryReleaseLock(tag string) (bool, error) {
+	var got bool
+	err := s.update(func(d *fileStateData) error {
+		got = s.tryLock(&d.CanaryLock, tag, CanaryLockLease(s.config))
+		return nil
+	})
+	return got, err
+}
+
+func (s *FileState) UnlockCanaryRelease() error {
+	return s.update(func(d *fileStateData) error {
+		if d.CanaryLock != nil && d.CanaryLock.Holder == s.me {
+			d.CanaryLock = nil
+		}
+		return nil
+	})
+}
+
+func (s *FileState) CanaryReleaseLocks() ([]CanaryLock, error) {
+	var locks []CanaryLock
+	err := s.view(func(d *fileStateData) error {
+		if d.CanaryLock.held(s.now()) {
+			locks = append(locks, CanaryLock{Tag: d.CanaryLock.Tag, Holders: []string{d.CanaryLock.Holder}})
+		}
+		return nil
+	})
+	return locks, err
+}
+
+// CanaryPassed is always true since this node is the whole cohort.
+func (s *FileState) CanaryPassed(tag string) (bool, error) {
+	return true, nil
+}
+
+func (s *FileState) TryRolloutLock(tag string) (bool, error) {
+	var got bool
+	err := s.update(func(d *fileStateData) error {
+		got = s.tryLock(&d.RolloutLock, tag, RolloutLockTTL(s.config))
+		return nil
+	})
+	return got, err
+}
+
+func (s *FileState) UnlockRollout() error {
+	return s.update(func(d *fileStateData) error {
+		if d.RolloutLock != nil && d.RolloutLock.Holder == s.me {
+			d.RolloutLock = nil
+		}
+		return nil
+	})
+}
+
+// ReleaseRolloutBatch does nothing because a single node has no rollout batch.
+func (s *FileState) ReleaseRolloutBatch() error {
+	return nil
+}
+
+func (s *FileState) CurrentStableTag() (string, error) {
+	return s.getString(func(d *fileStateData) string { return d.StableReleaseTag })
+}
+
+func (s *FileState) SaveStableReleaseTag(tag string) error {
+	if s.config.DryRun {
+		slog.Info("dry run: skip saving stable tag", "tag", tag)
+		return nil
+	}
+	return s.update(func(d *fileStateData) error {
+		d.StableReleaseTag = tag
+		d.appendReleaseHistory(ReleaseHistory{
+			Tag:    tag,
+			Host:   s.me,
+			Action: ReleaseActionStable,
+			At:     s.now().UTC(),
+		})
+		return nil
+	})
+}
+
+func (s *FileState) IsAvoidReleaseTag(tag string) error {
+	tags, err := s.AvoidReleaseTags()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(tags, tag) {
+		return ErrAvoidReleaseTag
+	}
+	return nil
+}
+
+func (s *FileState) SaveAvoidReleaseTag(tag, reason, output string) error {
+	if s.config.DryRun {
+		slog.Info("dry run: skip saving avoid tag", "tag", tag)
+		return nil
+	}
+	return s.update(func(d *fileStateData) error {
+		if d.AvoidReasons == nil {
+			d.AvoidReasons = map[string]*AvoidReason{}
+		}
+		d.AvoidReasons[tag] = newAvoidReason(tag, s.me, reason, output, s.now())
+		if s.config.AvoidTagTTL > 0 {
+			if d.AvoidTagExpiry == nil {
+				d.AvoidTagExpiry = map[string]time.Time{}
+			}
+			d.AvoidTagExpiry[tag] = s.now().Add(s.config.AvoidTagTTL)
+			return nil
+		}
+		if !slices.Contains(d.AvoidReleaseTags, tag) {
+			d.AvoidReleaseTags = append(d.AvoidReleaseTags, tag)
+		}
+		return nil
+	})
+}
+
+func (s *FileState) RemoveAvoidReleaseTag(tag string) error {
+	return s.update(func(d *fileStateData) error {
+		d.AvoidReleaseTags = slices.DeleteFunc(d.AvoidReleaseTags, func(t string) bool { return t == tag })
+		delete(d.AvoidTagExpiry, tag)
+		delete(d.AvoidReasons, tag)
+		return nil
+	})
+}
+
+func (s *FileState) AvoidReleaseTags() ([]string, error) {
+	var tags []string
+	err := s.view(func(d *fileStateData) error {
+		tags = slices.Clone(d.AvoidReleaseTags)
+		for t, expiry := range d.AvoidTagExpiry {
+			if s.now().Before(expiry) && !slices.Contains(tags, t) {
+				tags = append(tags, t)
+			}
+		}
+		return nil
+	})
+	return tags, err
+}
+
+// AvoidReasons returns the reasons of the avoid tags by tag.
+func (s *FileState) AvoidReasons() (map[string]*AvoidReason, error) {
+	tags, err := s.AvoidReleaseTags()
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]*AvoidReason{}
+	err = s.view(func(d *fileStateData) error {
+		for _, t := range tags {
+			if r, ok := d.AvoidReasons[t]; ok {
+				ret[t] = r
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (s *FileState) PendingReleaseTag() (string, error) {
+	return s.getString(func(d *fileStateData) string { return d.PendingReleaseTag })
+}
+
+func (s *FileState) SavePendingReleaseTag(tag string) error {
+	return s.update(func(d *fileStateData) error {
+		d.PendingReleaseTag = tag
+		return nil
+	})
+}
+
+func (s *FileState) PromotedReleaseTag() (string, error) {
+	return s.getString(func(d *fileStateData) string { return d.PromotedReleaseTag })
+}
+
+func (s *FileState) PromotePendingReleaseTag() (string, error) {
+	var tag string
+	err := s.update(func(d *fileStateData) error {
+		if d.PendingReleaseTag == "" {
+			return errors.New("no pending release tag")
+		}
+		tag = d.PendingReleaseTag
+		d.PromotedReleaseTag = tag
+		d.PendingReleaseTag = ""
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return tag, nil
+}
+
+func (s *FileState) CanInstallTag(tag string) error {
+	return s.canInstallTag(tag, s.IsAvoidReleaseTag)
+}
+
+func (s *FileState) RollbackTag(beforeInstall string) (string, error) {
+	return rollbackTag(beforeInstall, s.CurrentStableTag)
+}
+
+func (s *FileState) SaveMemberState() error {
+	currentVersion, err := s.reportedVersion()
+	if err != nil {
+		return err
+	}
+	return s.update(func(d *fileStateData) error {
+		d.Member = &MemberState{CurrentVersion: currentVersion}
+		return nil
+	})
+}
+
+// GetRolloutProgress counts this node as the only member.
+func (s *FileState) GetRolloutProgress(tag string) (int, int, error) {
+	states, err := s.MemberStates()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	installed := 0
+	for _, ms := range states {
+		if ms.CurrentVersion == tag {
+			installed++
+		}
+	}
+	return installed, len(states), nil
+}
+
+func (s *FileState) MemberStates() (map[string]*MemberState, error) {
+	states := map[string]*MemberState{}
+	err := s.view(func(d *fileStateData) error {
+		if d.Member != nil {
+			states[s.me] = d.Member
+		}
+		return nil
+	})
+	return states, err
+}
+
+func (s *FileState) VersionDistribution() (map[string]int, error) {
+	states, err := s.MemberStates()
+	if err != nil {
+		return nil, err
+	}
+	return versionDistribution(states), nil
+}
+
+func (s *FileState) MarkRolloutComplete(tag string) (bool, error) {
+	var first bool
+	err := s.update(func(d *fileStateData) error {
+		first = d.RolloutCompleteTag != tag
+		d.RolloutCompleteTag = tag
+		return nil
+	})
+	return first, err
+}
+
+func (s *FileState) MarkRolloutStarted(tag string) (bool, error) {
+	var first bool
+	err := s.update(func(d *fileStateData) error {
+		first = d.RolloutStartTag != tag
+		d.RolloutStartTag = tag
+		return nil
+	})
+	return first, err
+}
+
+func (s *FileState) MarkRolloutStalled(tag string, installed int) (bool, error) {
+	mark := fmt.Sprintf("%s:%d", tag, installed)
+	var first bool
+	err := s.update(func(d *fileStateData) error {
+		first = d.RolloutStall != mark
+		d.RolloutStall = mark
+		return nil
+	})
+	return first, err
+}
+
+func (s *FileState) HoldMember(tag string) error {
+	return s.update(func(d *fileStateData) error {
+		d.HeldTag = tag
+		return nil
+	})
+}
+
+func (s *FileState) HeldTag() (string, error) {
+	return s.getString(func(d *fileStateData) string { return d.HeldTag })
+}
+
+func (s *FileState) ClearHold() error {
+	return s.update(func(d *fileStateData) error {
+		d.HeldTag = ""
+		return nil
+	})
+}
+
+func (s *FileState) AbortCanaryRelease(tag string) error {
+	return s.update(func(d *fileStateData) error {
+		d.AbortCanary = &fileLock{Tag: tag, Holder: s.me, ExpiresAt: s.now().Add(CanaryLockTTL(s.config))}
+		return nil
+	})
+}
+
+func (s *FileState) CanaryAbortedTag() (string, error) {
+	return s.getString(func(d *fileStateData) string {
+		if !d.AbortCanary.held(s.now()) {
+			return ""
+		}
+		return d.AbortCanary.Tag
+	})
+}
+
+func (s *FileState) SaveDeployFailure(tag string) (*DeployFailure, error) {
+	var f *DeployFailure
+	err := s.update(func(d *fileStateData) error {
+		f = d.DeployFailure.next(tag, s.now())
+		d.DeployFailure = f
+		return nil
+	})
+	return f, err
+}
+
+func (s *FileState) DeployFailure() (*DeployFailure, error) {
+	var f *DeployFailure
+	err := s.view(func(d *fileStateData) error {
+		f = d.DeployFailure
+		return nil
+	})
+	return f, err
+}
+
+func (s *FileState) ClearDeployFailure() error {
+	return s.update(func(d *fileStateData) error {
+		d.DeployFailure = nil
+		return nil
+	})
+}
+
+func (s *FileState) SaveDeployProgress(tag, previousTag, file string) error {
+	return s.update(func(d *fileStateData) error {
+		d.DeployProgress = &DeployProgress{
+			Tag:         tag,
+			PreviousTag: previousTag,
+			File:        file,
+			Host:        s.me,
+			ExpiresAt:   s.now().Add(CanaryLockTTL(s.config)).UTC(),
+		}
+		return nil
+	})
+}
+
+func (s *FileState) DeployProgress() (*DeployProgress, error) {
+	var p *DeployProgress
+	err := s.view(func(d *fileStateData) error {
+		if d.DeployProgress != nil && s.now().Before(d.DeployProgress.ExpiresAt) {
+			p = d.DeployProgress
+		}
+		return nil
+	})
+	return p, err
+}
+
+func (s *FileState) ClearDeployProgress() error {
+	return s.update(func(d *fileStateData) error {
+		d.DeployProgress = nil
+		return nil
+	})
+}
+
+func (s *FileState) SaveHealthAttestation(tag string) error {
+	return s.update(func(d *fileStateData) error {
+		d.HealthAttestation = &HealthAttestation{
+			Tag:        tag,
+			Host:       s.me,
+			VerifiedAt: s.now().UTC(),
+		}
+		return nil
+	})
+}
+
+func (s *FileState) HealthAttestation(tag string) (*HealthAttestation, error) {
+	var a *HealthAttestation
+	err := s.view(func(d *fileStateData) error {
+		a = d.HealthAttestation
+		return nil
+	})
+	if err != nil || a == nil {
+		return nil, err
+	}
+	if a.Tag != tag || s.now().Sub(a.VerifiedAt) > s.config.TrustPeerHealth {
+		return nil, nil
+	}
+	return a, nil
+}
+
+func (s *FileState) StartRolloutReport(tag string) error {
+	return s.update(func(d *fileStateData) error {
+		d.RolloutReport = &RolloutReport{Tag: tag, StartedAt: s.now().UTC()}
+		return nil
+	})
+}
+
+func (s *FileState) CountRolloutRollback(tag string) error {
+	return s.update(func(d *fileStateData) error {
+		if d.RolloutReport != nil && d.RolloutReport.Tag == tag {
+			d.RolloutReport.Rollbacks++
+		}
+		return nil
+	})
+}
+
+func (s *FileState) RolloutReport(tag string) (*RolloutReport, error) {
+	var r *RolloutReport
+	err := s.view(func(d *fileStateData) error {
+		if d.RolloutReport != nil && d.RolloutReport.Tag == tag {
+			r = d.RolloutReport
+		}
+		return nil
+	})
+	return r, err
+}
+
+func (s *FileState) SaveDeployRecord(tag string) error {
+	r := DeployRecord{
+		Host:       s.me,
+		Tag:        tag,
+		DeployedAt: s.now().UTC(),
+	}
+	if s.config.DeployRecordKey != "" {
+		r.Signature = r.sign(s.config.DeployRecordKey)
+	}
+
+	return s.update(func(d *fileStateData) error {
+		d.DeployHistory = append([]DeployRecord{r}, d.DeployHistory...)
+		if len(d.DeployHistory) > deployHistoryLimit {
+			d.DeployHistory = d.DeployHistory[:deployHistoryLimit]
+		}
+		return nil
+	})
+}
+
+func (s *FileState) DeployHistory() ([]DeployRecord, error) {
+	var records []DeployRecord
+	err := s.view(func(d *fileStateData) error {
+		records = d.DeployHistory
+		return nil
+	})
+	return records, err
+}
+
+func (d *fileStateData) appendReleaseHistory(h ReleaseHistory) {
+	d.ReleaseHistory = append([]ReleaseHistory{h}, d.ReleaseHistory...)
+	if len(d.ReleaseHistory) > releaseHistoryLimit {
+		d.ReleaseHistory = d.ReleaseHistory[:releaseHistoryLimit]
+	}
+}
+
+func (s *FileState) SaveReleaseHistory(tag, action, reason string) error {
+	return s.update(func(d *fileStateData) error {
+		d.appendReleaseHistory(ReleaseHistory{
+			Tag:    tag,
+			Host:   s.me,
+			Action: action,
+			Reason: reason,
+			At:     s.now().UTC(),
+		})
+		return nil
+	})
+}
+
+func (s *FileState) GetReleaseHistory(limit int) ([]ReleaseHistory, error) {
+	var history []ReleaseHistory
+	err := s.view(func(d *fileStateData) error {
+		history = d.ReleaseHistory
+		if limit > 0 && len(history) > limit {
+			history = history[:limit]
+		}
+		return nil
+	})
+	return history, err
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+)
+
+func newTestFileState(t *testing.T) *FileState {
+	config := newTestConfig()
+	config.StateBackend = StateBackendFile
+	config.StateFile = filepath.Join(t.TempDir(), "state", "state.json")
+	config.TrustPeerHealth = time.Minute
+
+	state, err := NewFileState(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestFileStateLock(t *testing.T) {
+	state := newTestFileState(t)
+
+	got, err := state.TryCanaryReleaseLock("v1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+
+	got, err = state.TryCanaryReleaseLock("v1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, got)
+
+	locks, err := state.CanaryReleaseLocks()
+	assert.NoError(t, err)
+	assert.Equal(t, []CanaryLock{{Tag: "v1.0.0", Holders: []string{state.me}}}, locks)
+
+	assert.NoError(t, state.UnlockCanaryRelease())
+	got, err = state.TryCanaryReleaseLock("v1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+
+	got, err = state.TryRolloutLock("v1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+	got, err = state.TryRolloutLock("v1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, got)
+
+	state.config.RolloutWindow = 0
+	assert.NoError(t, state.UnlockRollout())
+	got, err = state.TryRolloutLock("v1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+	// the lock expires after rollout_window
+	got, err = state.TryRolloutLock("v1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+}
+
+func TestFileStateReleaseTags(t *testing.T) {
+	state := newTestFileState(t)
+
+	assert.NoError(t, state.SaveStableReleaseTag("v1.0.0"))
+	assert.NoError(t, state.SaveAvoidReleaseTag("v1.0.1", "health check failed", ""))
+	assert.NoError(t, state.SaveAvoidReleaseTag("v1.0.1", "health check failed", ""))
+
+	// reopen to read from the file
+	state, err := NewFileState(state.config)
+	assert.NoError(t, err)
+
+	tag, err := state.CurrentStableTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+
+	tags, err := state.AvoidReleaseTags()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v1.0.1"}, tags)
+	assert.Equal(t, ErrAvoidReleaseTag, state.CanInstallTag("v1.0.1"))
+
+	assert.NoError(t, state.SavePendingReleaseTag("v1.1.0"))
+	tag, err = state.PromotePendingReleaseTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+	_, err = state.PromotePendingReleaseTag()
+	assert.Error(t, err)
+}
+
+func TestFileStateRolloutProgress(t *testing.T) {
+	state := newTestFileState(t)
+
+	installed, all, err := state.GetRolloutProgress("v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, installed)
+	assert.Equal(t, 0, all)
+
+	assert.NoError(t, state.SaveMemberState())
+	installed, all, err = state.GetRolloutProgress("v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, installed)
+	assert.Equal(t, 1, all)
+
+	first, err := state.MarkRolloutComplete("v1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, first)
+	first, err = state.MarkRolloutComplete("v1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, first)
+
+	assert.NoError(t, state.StartRolloutReport("v1.0.0"))
+	assert.NoError(t, state.CountRolloutRollback("v1.0.0"))
+	r, err := state.RolloutReport("v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, r.Rollbacks)
+
+	assert.NoError(t, state.SaveDeployRecord("v1.0.0"))
+	assert.NoError(t, state.SaveDeployRecord("v1.0.1"))
+	records, err := state.DeployHistory()
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "v1.0.1", records[0].Tag)
+}
+
+func TestFileStateHealthAttestation(t *testing.T) {
+	state := newTestFileState(t)
+	clock := &stepClock{now: time.Now()}
+	state.config.Clock = clock
+
+	assert.NoError(t, state.SaveHealthAttestation("v1.1.0"))
+	a, err := state.HealthAttestation("v1.1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", a.Tag)
+
+	// the attestation goes stale after trust_peer_health
+	clock.step(state.config.TrustPeerHealth + time.Second)
+	a, err = state.HealthAttestation("v1.1.0")
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+}
@@ -1,16 +1,27 @@
 package lib
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Masterminds/semver/v3"
+	"github.com/avast/retry-go"
+	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/pkg/errors"
 
 	"github.com/google/go-github/v55/github"
@@ -18,17 +29,99 @@ import (
 )
 
 type GitHub struct {
-	client                *github.Client
-	config                *Config
-	owner                 string
-	repo                  string
-	regPackageNamePattern *regexp.Regexp
-	lastTag               string
-	lastAssetFile         string
+	client *github.Client
+	// httpClient requests the hosts other than the API without the token
+	httpClient             *http.Client
+	config                 *Config
+	owner                  string
+	repo                   string
+	regPackageNamePatterns assetPatterns
+	regChecksumPattern     *regexp.Regexp
+	regSignaturePattern    *regexp.Regexp
+	signatureKey           *minisignPublicKey
+	regTagPattern          *regexp.Regexp
+	versionConstraint      *semver.Constraints
+	lastTag                string
+	lastAssetFiles         []string
+	// the release list is reused while the first page returns 304 for its ETag
+	releasesETag string
+	releases     []*github.RepositoryRelease
 }
 
 type GitHuber interface {
-	DownloadReleaseAsset(tag string) (string, string, error)
+	DownloadReleaseAssets(ctx context.Context, tag string) (string, []string, error)
+	ReleaseTag(ctx context.Context, tag string) (string, error)
+	OpenReleaseAsset(ctx context.Context, tag string) (string, io.ReadCloser, error)
+}
+
+// newGitHubAppTransport returns the transport authenticated as the installation of the GitHub App
+// in GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID and GITHUB_APP_PRIVATE_KEY like the factory does.
+// The installation of the repo is looked up when GITHUB_APP_INSTALLATION_ID is not set.
+func newGitHubAppTransport(config *Config, transport http.RoundTripper, ep string) (*ghinstallation.Transport, error) {
+	appID, err := strconv.ParseInt(os.Getenv("GITHUB_APP_ID"), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	privateKey := []byte(repairPrivateKey(os.Getenv("GITHUB_APP_PRIVATE_KEY")))
+
+	var installationID int64
+	if id := os.Getenv("GITHUB_APP_INSTALLATION_ID"); id != "" {
+		installationID, err = strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		atr, err := ghinstallation.NewAppsTransport(transport, appID, privateKey)
+		if err != nil {
+			return nil, err
+		}
+		atr.BaseURL = strings.TrimSuffix(ep, "/")
+		client := github.NewClient(&http.Client{Timeout: 30 * time.Second, Transport: atr})
+		client.BaseURL, err = url.Parse(strings.TrimSuffix(ep, "/") + "/")
+		if err != nil {
+			return nil, err
+		}
+		owner, repo, _ := strings.Cut(config.Repo, "/")
+		installation, _, err := client.Apps.FindRepositoryInstallation(context.Background(), owner, repo)
+		if err != nil {
+			return nil, err
+		}
+		installationID = installation.GetID()
+	}
+
+	itr, err := ghinstallation.New(transport, appID, installationID, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	itr.BaseURL = strings.TrimSuffix(ep, "/")
+	return itr, nil
+}
+
+// repairPrivateKey restores the newlines of the private key given in one line with spaces.
+func repairPrivateKey(key string) string {
+	var pairs []string
+	for _, kind := range []string{"OPENSSH PRIVATE KEY", "RSA PRIVATE KEY"} {
+		for _, l := range []string{"-----BEGIN " + kind + "-----", "-----END " + kind + "-----"} {
+			pairs = append(pairs, l, strings.ReplaceAll(l, " ", "_"))
+		}
+	}
+	protect := strings.NewReplacer(pairs...)
+	var restore []string
+	for i := 0; i < len(pairs); i += 2 {
+		restore = append(restore, pairs[i+1], pairs[i])
+	}
+	return strings.NewReplacer(restore...).Replace(strings.ReplaceAll(protect.Replace(key), " ", "\n"))
+}
+
+// NewGitHuber returns the client of the releases selected by provider.
+func NewGitHuber(config *Config) (GitHuber, error) {
+	if len(config.Repos) > 0 {
+		return nil, ErrRepoNotSelected
+	}
+	if config.Provider == ProviderGitLab {
+		return NewGitLab(config)
+	}
+	return NewGitHub(config)
 }
 
 func NewGitHub(config *Config) (*GitHub, error) {
@@ -37,34 +130,272 @@ func NewGitHub(config *Config) (*GitHub, error) {
 		os.Setenv("GITHUB_TOKEN", token)
 	}
 
-	client, _ := factory.NewGithubClient()
+	endpoint, err := ParseGitHubAPIEndpoint(config.GitHubAPIEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// the client of the factory doesn't use the proxy, so the client with the proxy is given
+	// for both the token and the GitHub App authentication.
+	transport := NewTransport(config)
+	opts := []factory.Option{}
+	t, v3ep, _, _ := factory.GetTokenAndEndpoints()
+	if endpoint != nil {
+		v3ep = endpoint.String()
+	}
+	switch {
+	case t != "":
+		opts = append(opts, factory.HTTPClient(&http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &tokenTransport{base: transport, token: t},
+		}))
+	case os.Getenv("GITHUB_APP_ID") != "" && os.Getenv("GITHUB_APP_PRIVATE_KEY") != "":
+		tr, err := newGitHubAppTransport(config, transport, v3ep)
+		if err != nil {
+			return nil, fmt.Errorf("can't authenticate as github app:%s", err)
+		}
+		opts = append(opts, factory.HTTPClient(&http.Client{
+			Timeout:   30 * time.Second,
+			Transport: tr,
+		}))
+	}
+
+	var client *github.Client
+	if endpoint != nil {
+		client, err = factory.NewGithubClient(append(opts, factory.Endpoint(endpoint.String()))...)
+		if err != nil {
+			return nil, fmt.Errorf("can't create github client:%s", err)
+		}
+		if !strings.HasSuffix(endpoint.Host, "github.com") {
+			// GitHub Enterprise serves uploads and asset downloads under /api/uploads of the same host
+			client.UploadURL = &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host, Path: "/api/uploads/"}
+		}
+	} else {
+		client, err = factory.NewGithubClient(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("can't create github client:%s", err)
+		}
+	}
+
 	ownerRepo := strings.Split(config.Repo, "/")
 	if len(ownerRepo) != 2 {
 		return nil, fmt.Errorf("invalid repo: %s", config.Repo)
 	}
+	regPackageNamePatterns, err := packageNamePatterns(config)
+	if err != nil {
+		return nil, err
+	}
+	regChecksumPattern, err := compilePattern("checksum_pattern", config.ChecksumPattern)
+	if err != nil {
+		return nil, err
+	}
+	regSignaturePattern, err := compilePattern("signature_pattern", config.SignaturePattern)
+	if err != nil {
+		return nil, err
+	}
+	var signatureKey *minisignPublicKey
+	if config.SignaturePattern != "" {
+		k, err := loadMinisignPublicKey(config.SignaturePublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't load signature public key:%s", err)
+		}
+		signatureKey = k
+	}
+	regTagPattern, err := compilePattern("tag_pattern", config.TagPattern)
+	if err != nil {
+		return nil, err
+	}
+	var versionConstraint *semver.Constraints
+	if config.VersionConstraint != "" {
+		c, err := semver.NewConstraint(config.VersionConstraint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version_constraint %q:%s", config.VersionConstraint, err)
+		}
+		versionConstraint = c
+	}
 	return &GitHub{
-		client:                client,
-		config:                config,
-		owner:                 ownerRepo[0],
-		repo:                  ownerRepo[1],
-		regPackageNamePattern: regexp.MustCompile(config.PackageNamePattern),
+		client:                 client,
+		httpClient:             &http.Client{Transport: transport},
+		config:                 config,
+		owner:                  ownerRepo[0],
+		repo:                   ownerRepo[1],
+		regPackageNamePatterns: regPackageNamePatterns,
+		regChecksumPattern:     regChecksumPattern,
+		regSignaturePattern:    regSignaturePattern,
+		signatureKey:           signatureKey,
+		regTagPattern:          regTagPattern,
+		versionConstraint:      versionConstraint,
 	}, nil
 }
 
+// packageNamePatterns compiles package_name_pattern followed by package_name_patterns.
+func packageNamePatterns(config *Config) (assetPatterns, error) {
+	var patterns assetPatterns
+	if config.PackageNamePattern != "" {
+		p, err := newAssetPattern("package_name_pattern", config.PackageNamePattern)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	for _, pattern := range config.PackageNamePatterns {
+		p, err := newAssetPattern("package_name_patterns", pattern)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// ParseGitHubAPIEndpoint parses the github_api endpoint.
+// A GitHub Enterprise host without a path is completed to its REST API base, /api/v3/.
+func ParseGitHubAPIEndpoint(endpoint string) (*url.URL, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github_api endpoint %q:%s", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid github_api endpoint %q: must be an absolute http(s) URL", endpoint)
+	}
+
+	if u.Host != "api.github.com" && strings.Trim(u.Path, "/") == "" {
+		u.Path = "/api/v3/"
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u, nil
+}
+
 var ErrAssetsNotFound = errors.New("no match assets")
 
 const LatestTag = "latest"
 
-func (g *GitHub) searchReleaseWithPreRelease(owner, repo string) (*github.RepositoryRelease, error) {
+// callAPI calls the GitHub API and retries it with exponential backoff on transient errors.
+// With respect_rate_limit, it waits until the rate limit is reset instead of failing, up to
+// maxRateLimitWaits times. The wait and the retries end when ctx is canceled.
+func (g *GitHub) callAPI(ctx context.Context, name string, f func() error) error {
+	return retry.Do(
+		func() error {
+			for i := 0; ; i++ {
+				err := f()
+				wait, limited := rateLimitWait(err)
+				if !limited || !g.config.RespectRateLimit || i >= maxRateLimitWaits {
+					return err
+				}
+				slog.Warn("github rate limit exceeded, wait until reset", "api", name, "wait", wait)
+				t := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return ctx.Err()
+				case <-t.C:
+				}
+			}
+		},
+		retry.Context(ctx),
+		retry.Attempts(g.config.GitHubMaxRetries+1),
+		retry.Delay(g.config.GitHubRetryDelay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(isTransientError),
+		retry.OnRetry(func(n uint, err error) {
+			slog.Debug("retry github api", "api", name, "attempt", n+1, "err", err)
+		}),
+	)
+}
+
+// the primary rate limit is reset every hour
+const maxRateLimitWait = time.Hour
+
+// maxRateLimitWaits is the waits for the rate limit in a call, which is enough for the reset
+// unless another client keeps consuming the limit.
+const maxRateLimitWaits = 3
+
+// rateLimitWait returns how long to wait when err is caused by the rate limit.
+func rateLimitWait(err error) (time.Duration, bool) {
+	var wait time.Duration
+	var rle *github.RateLimitError
+	var are *github.AbuseRateLimitError
+	switch {
+	case errors.As(err, &rle):
+		// X-RateLimit-Reset is in seconds
+		wait = time.Until(rle.Rate.Reset.Time) + time.Second
+	case errors.As(err, &are):
+		wait = time.Minute
+		if are.RetryAfter != nil {
+			wait = *are.RetryAfter
+		}
+	default:
+		return 0, false
+	}
+
+	if wait < time.Second {
+		wait = time.Second
+	}
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
+	return wait, true
+}
+
+// isTransientError reports whether the error of the GitHub API is worth retrying.
+// Not found and unauthorized never recover by retrying, and the rate limit doesn't
+// recover until it is reset.
+func isTransientError(err error) bool {
+	if _, limited := rateLimitWait(err); limited {
+		return false
+	}
+	var er *github.ErrorResponse
+	if errors.As(err, &er) && er.Response != nil {
+		switch er.Response.StatusCode {
+		case http.StatusNotFound, http.StatusUnauthorized:
+			return false
+		}
+	}
+	return true
+}
+
+func (g *GitHub) getReleaseByTag(ctx context.Context, tag string) (*github.RepositoryRelease, error) {
+	var r *github.RepositoryRelease
+	err := g.callAPI(ctx, "GetReleaseByTag", func() error {
+		var err error
+		r, _, err = g.client.Repositories.GetReleaseByTag(ctx, g.owner, g.repo, tag)
+		return err
+	})
+	return r, err
+}
+
+// listReleases returns all releases sorted by published date desc.
+func (g *GitHub) listReleases(ctx context.Context, owner, repo string) ([]*github.RepositoryRelease, error) {
 	var allReleases []*github.RepositoryRelease
 	opts := &github.ListOptions{Page: 1, PerPage: 100}
 
+	var etag string
 	for {
-		releases, resp, err := g.client.Repositories.ListReleases(context.Background(), owner, repo, opts)
+		var releases []*github.RepositoryRelease
+		var resp *github.Response
+		err := g.callAPI(ctx, "ListReleases", func() error {
+			var err error
+			releases, resp, err = g.listReleasesPage(ctx, owner, repo, opts)
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
 
+		if opts.Page == 1 {
+			if resp.StatusCode == http.StatusNotModified {
+				slog.Debug("release list is not modified", "etag", g.releasesETag)
+				return g.releases, nil
+			}
+			etag = resp.Header.Get("ETag")
+		}
 		allReleases = append(allReleases, releases...)
 
 		if resp.NextPage == 0 {
@@ -74,16 +405,70 @@ func (g *GitHub) searchReleaseWithPreRelease(owner, repo string) (*github.Reposi
 	}
 
 	// sort by published date desc
-	for i := 0; i < len(allReleases); i++ {
-		for j := i + 1; j < len(allReleases); j++ {
-			if allReleases[i].PublishedAt.Before(allReleases[j].PublishedAt.Time) {
-				allReleases[i], allReleases[j] = allReleases[j], allReleases[i]
-			}
-		}
+	sort.Slice(allReleases, func(i, j int) bool {
+		return newerRelease(allReleases[i], allReleases[j])
+	})
+	g.releasesETag = etag
+	g.releases = allReleases
+	return allReleases, nil
+}
+
+// listReleasesPage lists a page of the releases. The first page is requested with If-None-Match
+// of the cached release list, and 304 is returned without an error.
+func (g *GitHub) listReleasesPage(ctx context.Context, owner, repo string, opts *github.ListOptions) ([]*github.RepositoryRelease, *github.Response, error) {
+	u := fmt.Sprintf("repos/%s/%s/releases?page=%d&per_page=%d", owner, repo, opts.Page, opts.PerPage)
+	req, err := g.client.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Page == 1 && g.releasesETag != "" {
+		req.Header.Set("If-None-Match", g.releasesETag)
+	}
+
+	var releases []*github.RepositoryRelease
+	resp, err := g.client.Do(ctx, req, &releases)
+	if resp != nil && resp.StatusCode == http.StatusNotModified {
+		return nil, resp, nil
+	}
+	return releases, resp, err
+}
+
+// matchTag reports whether the tag is eligible by tag_pattern.
+func (g *GitHub) matchTag(tag string) bool {
+	return g.regTagPattern == nil || g.regTagPattern.MatchString(tag)
+}
+
+// matchRelease reports whether the release is eligible by tag_pattern and release_branch.
+func (g *GitHub) matchRelease(r *github.RepositoryRelease) bool {
+	if g.config.ReleaseBranch != "" && r.GetTargetCommitish() != g.config.ReleaseBranch {
+		return false
+	}
+	return g.matchTag(r.GetTagName())
+}
+
+// releaseAged reports whether the release was published at least release_min_age ago.
+// A draft has no published date, so it is aged by the creation time.
+func (g *GitHub) releaseAged(r *github.RepositoryRelease) bool {
+	publishedAt := r.GetPublishedAt().Time
+	if r.GetDraft() {
+		publishedAt = r.GetCreatedAt().Time
+	}
+	return releaseAged(g.config, publishedAt)
+}
+
+// releaseAged reports whether publishedAt is at least release_min_age ago.
+func releaseAged(config *Config, publishedAt time.Time) bool {
+	return config.ReleaseMinAge <= 0 || ClockOf(config).Now().Sub(publishedAt) >= config.ReleaseMinAge
+}
+
+func (g *GitHub) searchReleaseWithPreRelease(ctx context.Context, owner, repo string) (*github.RepositoryRelease, error) {
+	allReleases, err := g.listReleases(ctx, owner, repo)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, r := range allReleases {
-		if r.GetDraft() {
+		if r.GetDraft() || !g.matchRelease(r) || !g.releaseAged(r) {
 			continue
 		}
 		if r.GetPrerelease() {
@@ -93,28 +478,125 @@ func (g *GitHub) searchReleaseWithPreRelease(owner, repo string) (*github.Reposi
 	return nil, ErrAssetsNotFound
 }
 
+// searchDraftRelease returns the newest draft release by the creation time, because a draft
+// has no published date. The tag can be given to find the draft of the tag.
+func (g *GitHub) searchDraftRelease(ctx context.Context, owner, repo, tag string) (*github.RepositoryRelease, error) {
+	allReleases, err := g.listReleases(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var draft *github.RepositoryRelease
+	for _, r := range allReleases {
+		if !r.GetDraft() || !g.matchRelease(r) || (tag != "" && r.GetTagName() != tag) {
+			continue
+		}
+		// the draft of the tag is given explicitly, so it isn't subject to release_min_age
+		if tag == "" && !g.releaseAged(r) {
+			continue
+		}
+		if draft == nil || r.GetCreatedAt().Time.After(draft.GetCreatedAt().Time) {
+			draft = r
+		}
+	}
+	if draft == nil {
+		return nil, ErrAssetsNotFound
+	}
+	return draft, nil
+}
+
+// searchLatestRelease returns the newest published release whose tag matches tag_pattern.
+func (g *GitHub) searchLatestRelease(ctx context.Context, owner, repo string) (*github.RepositoryRelease, error) {
+	allReleases, err := g.listReleases(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range allReleases {
+		if r.GetDraft() || r.GetPrerelease() || !g.matchRelease(r) || !g.releaseAged(r) {
+			continue
+		}
+		return r, nil
+	}
+	return nil, ErrAssetsNotFound
+}
+
+// searchHighestRelease returns the release with the highest semver tag for version_selection = semver.
+func (g *GitHub) searchHighestRelease(ctx context.Context, owner, repo string) (*github.RepositoryRelease, error) {
+	allReleases, err := g.listReleases(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]*github.RepositoryRelease, 0, len(allReleases))
+	for _, r := range allReleases {
+		if (r.GetDraft() && !g.config.IncludeDraft) || !g.matchRelease(r) || !g.releaseAged(r) {
+			continue
+		}
+		if r.GetPrerelease() && !g.config.IncludePreRelease {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+
+	release := highestRelease(candidates, g.config.VersionPrefix, g.versionConstraint)
+	if release == nil {
+		return nil, ErrAssetsNotFound
+	}
+	return release, nil
+}
+
 var ErrAssetsCannotDownload = errors.New("assets cannot download")
 
-func (g *GitHub) DownloadReleaseAsset(tag string) (string, string, error) {
+// getRelease returns the release of the tag. LatestTag resolves the latest release.
+func (g *GitHub) getRelease(ctx context.Context, tag string) (*github.RepositoryRelease, error) {
 	var release *github.RepositoryRelease
-
-	if tag != "" && tag == g.lastTag && g.lastAssetFile != "" {
-		return tag, g.lastAssetFile, nil
+	if tag == LatestTag && g.config.Channel != "" {
+		t, err := g.channelTag(ctx)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("latest is resolved by channel", "channel", g.config.Channel, "tag", t)
+		tag = t
 	}
-	if tag == LatestTag {
-		r, _, err := g.client.Repositories.GetLatestRelease(context.Background(), g.owner, g.repo)
+
+	if tag == LatestTag && g.config.VersionSelection == VersionSelectionSemver {
+		r, err := g.searchHighestRelease(ctx, g.owner, g.repo)
+		if err != nil && err != ErrAssetsNotFound {
+			return nil, fmt.Errorf("repositories.ListReleases returned error: %v", err)
+		}
+		release = r
+	} else if tag == LatestTag {
+		var r *github.RepositoryRelease
+		err := g.callAPI(ctx, "GetLatestRelease", func() error {
+			var err error
+			r, _, err = g.client.Repositories.GetLatestRelease(ctx, g.owner, g.repo)
+			return err
+		})
 		if err != nil {
-			if !g.config.IncludePreRelease {
-				return "", "", errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("repositories.GetRelease returned tag:%s error: %v", tag, err))
+			if !g.config.IncludePreRelease && !g.config.IncludeDraft {
+				return nil, errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("repositories.GetRelease returned tag:%s error: %v", tag, err))
+			}
+		}
+
+		if r != nil && (!g.matchRelease(r) || !g.releaseAged(r)) {
+			if !g.releaseAged(r) {
+				slog.Debug("latest release is younger than release_min_age", "tag", r.GetTagName(), "published_at", r.GetPublishedAt().Time)
+			} else {
+				slog.Debug("latest release does not match tag pattern or release branch", "tag", r.GetTagName(), "target_commitish", r.GetTargetCommitish())
+			}
+			r, err = g.searchLatestRelease(ctx, g.owner, g.repo)
+			if err != nil && err != ErrAssetsNotFound {
+				return nil, fmt.Errorf("repositories.ListReleases returned error: %v", err)
 			}
 		}
 
 		release = r
 		if g.config.IncludePreRelease {
-			inPrerelease, err := g.searchReleaseWithPreRelease(g.owner, g.repo)
+			inPrerelease, err := g.searchReleaseWithPreRelease(ctx, g.owner, g.repo)
 			if err != nil {
 				if err != ErrAssetsNotFound {
-					return "", "", fmt.Errorf("repositories.ListReleases returned error: %v", err)
+					return nil, fmt.Errorf("repositories.ListReleases returned error: %v", err)
 				}
 			}
 
@@ -123,60 +605,491 @@ func (g *GitHub) DownloadReleaseAsset(tag string) (string, string, error) {
 				release = inPrerelease
 			}
 		}
+		if g.config.IncludeDraft {
+			draft, err := g.searchDraftRelease(ctx, g.owner, g.repo, "")
+			if err != nil && err != ErrAssetsNotFound {
+				return nil, fmt.Errorf("repositories.ListReleases returned error: %v", err)
+			}
+			// the draft created after the latest release is published is the latest
+			if draft != nil && (release == nil || draft.GetCreatedAt().Time.After(release.GetPublishedAt().Time)) {
+				release = draft
+			}
+		}
 	} else {
-		r, _, err := g.client.Repositories.GetReleaseByTag(context.Background(), g.owner, g.repo, tag)
+		r, err := g.getReleaseByTag(ctx, tag)
+		if err != nil && g.config.IncludeDraft {
+			// a draft can't be got by the tag
+			if draft, derr := g.searchDraftRelease(ctx, g.owner, g.repo, tag); derr == nil {
+				r, err = draft, nil
+			}
+		}
 		if err != nil {
-			return "", "", errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("repositories.GetRelease returned tag:%s error: %v", tag, err))
+			return nil, errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("repositories.GetRelease returned tag:%s error: %v", tag, err))
 		}
 		release = r
 	}
 
+	if release == nil {
+		return nil, errors.Wrap(ErrAssetsNotFound, fmt.Sprintf("no release found for tag:%s", tag))
+	}
+	return release, nil
+}
+
+const channelFile = "channels.json"
+
+// channelTag reads the tag of the channel from channels.json attached to
+// the release of channel_source_tag, e.g. {"stable": "v1.2.3", "beta": "v1.3.0-rc1"}.
+func (g *GitHub) channelTag(ctx context.Context) (string, error) {
+	r, err := g.getReleaseByTag(ctx, g.config.ChannelSourceTag)
+	if err != nil {
+		return "", errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("repositories.GetRelease returned tag:%s error: %v", g.config.ChannelSourceTag, err))
+	}
+
+	for _, asset := range r.Assets {
+		if asset.GetName() != channelFile {
+			continue
+		}
+
+		ret, err := g.openAsset(ctx, asset.GetID())
+		if err != nil {
+			return "", err
+		}
+		defer ret.Close()
+
+		channels := map[string]string{}
+		if err := json.NewDecoder(ret).Decode(&channels); err != nil {
+			return "", fmt.Errorf("can't parse %s:%s", channelFile, err)
+		}
+		tag, ok := channels[g.config.Channel]
+		if !ok || tag == "" {
+			return "", fmt.Errorf("channel %s is not found in %s", g.config.Channel, channelFile)
+		}
+		return tag, nil
+	}
+	return "", fmt.Errorf("%s is not found in release %s", channelFile, g.config.ChannelSourceTag)
+}
+
+// ReleaseTag resolves the tag which has a matching asset without downloading it.
+func (g *GitHub) ReleaseTag(ctx context.Context, tag string) (string, error) {
+	release, err := g.getRelease(ctx, tag)
+	if err != nil {
+		return "", err
+	}
+	if g.matchAsset(release) == nil {
+		return "", ErrAssetsNotFound
+	}
+	return *release.TagName, nil
+}
+
+// OpenReleaseAsset returns the content of the matching asset without saving it to disk.
+func (g *GitHub) OpenReleaseAsset(ctx context.Context, tag string) (string, io.ReadCloser, error) {
+	// the stream can't be verified before it is deployed
+	if g.regSignaturePattern != nil {
+		return "", nil, errors.Wrap(ErrSignatureInvalid, "signature verification is not available with deploy_from_stdin")
+	}
+	release, err := g.getRelease(ctx, tag)
+	if err != nil {
+		return "", nil, err
+	}
+	asset := g.matchAsset(release)
+	if asset == nil {
+		return "", nil, ErrAssetsNotFound
+	}
+	r, err := g.openReleaseAsset(ctx, *asset.Name, *asset.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	return *release.TagName, r, nil
+}
+
+func (g *GitHub) matchAsset(release *github.RepositoryRelease) *github.ReleaseAsset {
+	assets := g.matchAssets(release)
+	if len(assets) == 0 {
+		return nil
+	}
+	return assets[0]
+}
+
+// matchAssets returns the assets matching the package name patterns in the order of the patterns.
+// It returns nil unless every pattern matches at least one asset.
+func (g *GitHub) matchAssets(release *github.RepositoryRelease) []*github.ReleaseAsset {
+	patterns, err := g.regPackageNamePatterns.forTag(release.GetTagName())
+	if err != nil {
+		slog.Error(err.Error())
+		return nil
+	}
+
+	var ret []*github.ReleaseAsset
+	seen := map[int64]bool{}
+	for _, pattern := range patterns {
+		matched := false
+		for _, asset := range release.Assets {
+			if !pattern.MatchString(asset.GetName()) {
+				continue
+			}
+			matched = true
+			if !seen[asset.GetID()] {
+				seen[asset.GetID()] = true
+				ret = append(ret, asset)
+			}
+		}
+		if !matched {
+			return nil
+		}
+	}
+	return ret
+}
+
+// DownloadReleaseAsset downloads the assets of the release and returns the first one.
+func (g *GitHub) DownloadReleaseAsset(ctx context.Context, tag string) (string, string, error) {
+	releaseTag, files, err := g.DownloadReleaseAssets(ctx, tag)
+	if err != nil {
+		return "", "", err
+	}
+	return releaseTag, files[0], nil
+}
+
+// DownloadReleaseAssets downloads all the assets matching the package name patterns.
+func (g *GitHub) DownloadReleaseAssets(ctx context.Context, tag string) (string, []string, error) {
+	if tag != "" && tag == g.lastTag && len(g.lastAssetFiles) > 0 {
+		return tag, g.lastAssetFiles, nil
+	}
+
+	release, err := g.getRelease(ctx, tag)
+	if err != nil {
+		return "", nil, err
+	}
+
 	slog.Debug("tag info", "latest release Tag", *release.TagName)
+
 	for _, asset := range release.Assets {
 		slog.Debug("assets info", "name", *asset.Name, "download url", *asset.URL)
-		if g.regPackageNamePattern.MatchString(*asset.Name) {
-			filePath := filepath.Join(g.config.SaveAssetsPath, *asset.Name)
+	}
 
-			if _, err := os.Stat(filePath); err == nil {
-				return *release.TagName, filePath, nil
-			} else if !os.IsNotExist(err) {
-				return "", "", err
-			}
+	assets := g.matchAssets(release)
+	if len(assets) == 0 {
+		return "", nil, ErrAssetsNotFound
+	}
 
-			ret, loc, err := g.client.Repositories.DownloadReleaseAsset(context.Background(), g.owner, g.repo, *asset.ID, nil)
-			if err != nil {
-				return "", "", fmt.Errorf("repositories.DownloadReleaseAsset returned error: %v", err)
-			}
+	var checksums map[string]string
+	if g.regChecksumPattern != nil {
+		c, err := g.releaseChecksums(ctx, release)
+		if err != nil {
+			return "", nil, err
+		}
+		checksums = c
+	}
 
-			if loc != "" {
-				req, err := http.NewRequestWithContext(context.Background(), "GET", loc, nil)
-				if err != nil {
-					return "", "", err
-				}
-				res, err := g.client.Client().Do(req)
-				if err != nil {
-					return "", "", err
-				}
-				ret = res.Body
-				if ret != nil {
-					defer ret.Close()
-				}
+	files := make([]string, 0, len(assets))
+	for _, asset := range assets {
+		filePath, err := g.downloadAsset(ctx, release, asset, checksums)
+		if err != nil {
+			return "", nil, err
+		}
+		if g.regSignaturePattern != nil {
+			if err := g.verifySignature(ctx, release, asset, filePath); err != nil {
+				return "", nil, errors.Wrap(err, fmt.Sprintf("asset:%s tag:%s", *asset.Name, *release.TagName))
 			}
+		}
+		files = append(files, filePath)
+	}
 
-			out, err := os.Create(filePath)
-			if err != nil {
-				return "", "", err
+	g.lastTag = *release.TagName
+	g.lastAssetFiles = files
+	return *release.TagName, files, nil
+}
+
+func (g *GitHub) downloadAsset(ctx context.Context, release *github.RepositoryRelease, asset *github.ReleaseAsset, checksums map[string]string) (string, error) {
+	filePath := g.regPackageNamePatterns.assetPath(g.config.SaveAssetsPath, *release.TagName, *asset.Name)
+	if g.regPackageNamePatterns.templated() {
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return "", err
+		}
+	}
+
+	checksum := ""
+	if checksums != nil {
+		c, ok := checksums[*asset.Name]
+		if !ok {
+			return "", fmt.Errorf("checksum of %s is not found in release %s", *asset.Name, *release.TagName)
+		}
+		checksum = c
+	}
+
+	// an existing file may be left truncated by a crash or be another version with the same name
+	if fi, err := os.Stat(filePath); err == nil {
+		if !g.assetSizeMatches(asset, fi.Size()) {
+			slog.Warn("existing asset size mismatch, download again", "path", filePath, "size", fi.Size(), "expected", asset.GetSize())
+		} else if checksum == "" {
+			return filePath, nil
+		} else if err := verifyChecksum(filePath, checksum); err == nil {
+			return filePath, nil
+		} else {
+			slog.Warn("existing asset checksum mismatch, download again", "path", filePath)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if g.restoreCachedAsset(checksum, filePath) {
+		return filePath, nil
+	}
+
+	for i := uint(0); ; i++ {
+		if err := g.saveAsset(ctx, asset, *release.TagName, filePath); err != nil {
+			return "", err
+		}
+
+		if checksum == "" {
+			break
+		}
+
+		err := verifyChecksum(filePath, checksum)
+		if err == nil {
+			break
+		}
+		os.Remove(filePath)
+		if i >= g.config.ChecksumRetries {
+			return "", errors.Wrap(err, fmt.Sprintf("asset:%s tag:%s", *asset.Name, *release.TagName))
+		}
+		slog.Warn("checksum mismatch, download again", "asset", *asset.Name, "tag", *release.TagName, "attempt", i+1)
+	}
+	g.cacheAsset(checksum, filePath)
+	return filePath, nil
+}
+
+// assetSizeMatches compares the size with the asset. The size is unknown when the asset
+// has no size or is resolved from git lfs.
+func (g *GitHub) assetSizeMatches(asset *github.ReleaseAsset, size int64) bool {
+	if asset.GetSize() == 0 || g.config.ResolveLFS {
+		return true
+	}
+	return int64(asset.GetSize()) == size
+}
+
+// openAsset returns the content of the release asset following the redirect to the storage.
+func (g *GitHub) openAsset(ctx context.Context, id int64) (io.ReadCloser, error) {
+	var ret io.ReadCloser
+	var loc string
+	err := g.callAPI(ctx, "DownloadReleaseAsset", func() error {
+		var err error
+		ret, loc, err = g.client.Repositories.DownloadReleaseAsset(ctx, g.owner, g.repo, id, nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("repositories.DownloadReleaseAsset returned error: %v", err)
+	}
+
+	if loc != "" {
+		res, err := g.followAssetRedirect(ctx, loc, nil)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("asset download returned status %d", res.StatusCode)
+		}
+		ret = res.Body
+	}
+	return ret, nil
+}
+
+// followAssetRedirect requests the asset storage which the API redirected to. The API client
+// adds the Authorization header to every request, which the storage on another host rejects
+// and which leaks the token, so the storage is requested with httpClient like
+// DownloadReleaseAsset of go-github. GitHub Enterprise serving the asset on the same host
+// still gets the token.
+func (g *GitHub) followAssetRedirect(ctx context.Context, loc string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid asset location %q:%s", loc, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	client := g.httpClient
+	if u.Host == g.client.BaseURL.Host {
+		client = g.client.Client()
+	}
+	return client.Do(req)
+}
+
+// openAssetRange requests the content of the asset from offset.
+// It returns nil without error when the server doesn't support the range request.
+func (g *GitHub) openAssetRange(ctx context.Context, id int64, offset int64) (io.ReadCloser, error) {
+	req, err := g.client.NewRequest("GET", fmt.Sprintf("repos/%s/%s/releases/assets/%d", g.owner, g.repo, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	// the redirect is followed by followAssetRedirect without the Authorization header
+	client := &http.Client{
+		Transport: g.client.Client().Transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if loc, err := res.Location(); err == nil && res.StatusCode >= 300 && res.StatusCode < 400 {
+		res.Body.Close()
+		res, err = g.followAssetRedirect(ctx, loc.String(), http.Header{"Range": req.Header.Values("Range")})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("range request returned status %d", res.StatusCode)
+	}
+	return res.Body, nil
+}
+
+// openAssetFrom opens the asset to be written to the part file. It resumes from the
+// size of an existing part file when the server supports the range request.
+func (g *GitHub) openAssetFrom(ctx context.Context, asset *github.ReleaseAsset, part string) (io.ReadCloser, bool, error) {
+	if fi, err := os.Stat(part); err == nil && fi.Size() > 0 {
+		ret, err := g.openAssetRange(ctx, *asset.ID, fi.Size())
+		if err != nil {
+			slog.Warn("can't resume download, start over", "asset", *asset.Name, "err", err)
+		}
+		if ret != nil {
+			slog.Info("resume download", "asset", *asset.Name, "offset", fi.Size())
+			return ret, true, nil
+		}
+	}
+	os.Remove(part)
+
+	ret, err := g.openReleaseAsset(ctx, *asset.Name, *asset.ID)
+	return ret, false, err
+}
+
+// saveAsset writes the asset to "<filePath>.part" and renames it to filePath only after
+// the whole content is written, so that a partial file is never taken for a complete
+// download. A failed write is retried once from where it was interrupted, and the
+// part file is left to be resumed by the next download.
+func (g *GitHub) saveAsset(ctx context.Context, asset *github.ReleaseAsset, tag, filePath string) error {
+	part := filePath + ".part"
+	for i := 0; ; i++ {
+		ret, resume, err := g.openAssetFrom(ctx, asset, part)
+		if err != nil {
+			return err
+		}
+		err = writeFile(part, ret, resume)
+		ret.Close()
+		if err == nil {
+			if err := os.Rename(part, filePath); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("can't save asset:%s tag:%s path:%s", *asset.Name, tag, filePath))
 			}
-			defer out.Close()
-			_, err = io.Copy(out, ret)
-			if err != nil {
-				return "", "", err
+			return nil
+		}
+
+		err = errors.Wrap(err, fmt.Sprintf("can't save asset:%s tag:%s path:%s", *asset.Name, tag, filePath))
+		if i >= 1 {
+			return err
+		}
+		slog.Warn("failed to save asset, retry", "err", err)
+	}
+}
+
+func writeFile(filePath string, r io.Reader, resume bool) error {
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	out, err := os.OpenFile(filePath, flag, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// releaseChecksums reads the checksum asset of the release.
+// The format is same as sha256sum output (e.g. checksums.txt of goreleaser).
+func (g *GitHub) releaseChecksums(ctx context.Context, release *github.RepositoryRelease) (map[string]string, error) {
+	for _, asset := range release.Assets {
+		if !g.regChecksumPattern.MatchString(*asset.Name) {
+			continue
+		}
+
+		ret, err := g.openAsset(ctx, *asset.ID)
+		if err != nil {
+			return nil, err
+		}
+		defer ret.Close()
+
+		checksums := map[string]string{}
+		scanner := bufio.NewScanner(ret)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 {
+				continue
 			}
-			g.lastTag = *release.TagName
-			g.lastAssetFile = filePath
+			checksums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return checksums, nil
+	}
+	return nil, fmt.Errorf("checksum asset is not found in release %s", *release.TagName)
+}
+
+// verifySignature verifies the asset with the signature asset of the release which matches
+// signature_pattern and is named after the asset (e.g. app.tar.gz.minisig for app.tar.gz).
+func (g *GitHub) verifySignature(ctx context.Context, release *github.RepositoryRelease, asset *github.ReleaseAsset, filePath string) error {
+	for _, a := range release.Assets {
+		if !strings.HasPrefix(a.GetName(), asset.GetName()+".") || !g.regSignaturePattern.MatchString(a.GetName()) {
+			continue
+		}
+
+		ret, err := g.openAsset(ctx, a.GetID())
+		if err != nil {
+			return err
+		}
+		defer ret.Close()
 
-			return *release.TagName, filePath, nil
+		sig, err := io.ReadAll(ret)
+		if err != nil {
+			return err
 		}
+		return g.signatureKey.verify(filePath, sig)
+	}
+	return errors.Wrap(ErrSignatureInvalid, "signature asset is not found")
+}
+
+func verifyChecksum(filePath, checksum string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != checksum {
+		return errors.Wrap(ErrChecksumMismatch, fmt.Sprintf("want:%s got:%s", checksum, got))
 	}
-	return "", "", ErrAssetsNotFound
+	return nil
 }
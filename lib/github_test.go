@@ -0,0 +1,1084 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-github/v55/github"
+	"github.com/tj/assert"
+)
+
+// newTestGitHub returns GitHub which talks to the test server.
+func newTestGitHub(t *testing.T, config *Config, mux *http.ServeMux) *GitHub {
+	t.Helper()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client := github.NewClient(nil)
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = u
+
+	if config.SaveAssetsPath == "" {
+		config.SaveAssetsPath = t.TempDir()
+	}
+
+	patterns, err := packageNamePatterns(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &GitHub{
+		client:                 client,
+		httpClient:             http.DefaultClient,
+		config:                 config,
+		owner:                  "owner",
+		repo:                   "repo",
+		regPackageNamePatterns: patterns,
+	}
+	if config.ChecksumPattern != "" {
+		g.regChecksumPattern = regexp.MustCompile(config.ChecksumPattern)
+	}
+	if config.TagPattern != "" {
+		g.regTagPattern = regexp.MustCompile(config.TagPattern)
+	}
+	if config.SignaturePattern != "" {
+		g.regSignaturePattern = regexp.MustCompile(config.SignaturePattern)
+		k, err := loadMinisignPublicKey(config.SignaturePublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.signatureKey = k
+	}
+	if config.VersionConstraint != "" {
+		c, err := semver.NewConstraint(config.VersionConstraint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.versionConstraint = c
+	}
+	return g
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, v any) {
+	t.Helper()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestDownloadReleaseAssetChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []string
+		wantErr  error
+	}{
+		{
+			name:     "match",
+			contents: []string{"good"},
+		},
+		{
+			name:     "retry on transient mismatch",
+			contents: []string{"broken", "good"},
+		},
+		{
+			name:     "persistent mismatch",
+			contents: []string{"broken", "broken", "broken"},
+			wantErr:  ErrChecksumMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloads := 0
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(t, w, &github.RepositoryRelease{
+					TagName: github.String("v1.0.0"),
+					Assets: []*github.ReleaseAsset{
+						{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app")},
+						{ID: github.Int64(2), Name: github.String("checksums.txt"), URL: github.String("checksums.txt")},
+					},
+				})
+			})
+			mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.contents[downloads])
+				downloads++
+			})
+			mux.HandleFunc("/repos/owner/repo/releases/assets/2", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "%s  app\n%s  other\n", sha256Hex("good"), sha256Hex("other"))
+			})
+
+			g := newTestGitHub(t, &Config{
+				PackageNamePattern: "^app$",
+				ChecksumPattern:    "^checksums.txt$",
+				ChecksumRetries:    2,
+			}, mux)
+
+			tag, file, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+			assert.Equal(t, len(tt.contents), downloads)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+				_, err := os.Stat(filepath.Join(g.config.SaveAssetsPath, "app"))
+				assert.True(t, os.IsNotExist(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "v1.0.0", tag)
+			b, err := os.ReadFile(file)
+			assert.NoError(t, err)
+			assert.Equal(t, "good", string(b))
+		})
+	}
+}
+
+func TestDownloadReleaseAssetNoRelease(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, []*github.RepositoryRelease{})
+	})
+
+	g := newTestGitHub(t, &Config{
+		PackageNamePattern: ".*",
+		IncludePreRelease:  true,
+	}, mux)
+
+	_, _, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+	assert.True(t, errors.Is(err, ErrAssetsNotFound))
+}
+
+func TestDownloadReleaseAssetTagPattern(t *testing.T) {
+	now := time.Now()
+	release := func(tag string, published time.Time, prerelease bool) *github.RepositoryRelease {
+		return &github.RepositoryRelease{
+			TagName:     github.String(tag),
+			Prerelease:  github.Bool(prerelease),
+			PublishedAt: &github.Timestamp{Time: published},
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app-" + tag), URL: github.String("app")},
+			},
+		}
+	}
+	releases := []*github.RepositoryRelease{
+		release("v1.0.0", now.Add(-2*time.Hour), false),
+		release("nightly", now, false),
+		release("v1.1.0-rc1", now.Add(-time.Hour), true),
+		release("edge", now.Add(-time.Minute), true),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases[1])
+	})
+	mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases)
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+
+	tests := []struct {
+		name              string
+		includePreRelease bool
+		want              string
+	}{
+		{name: "release", want: "v1.0.0"},
+		{name: "prerelease", includePreRelease: true, want: "v1.1.0-rc1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGitHub(t, &Config{
+				PackageNamePattern: "^app-",
+				TagPattern:         `^v\d+\.\d+\.\d+`,
+				IncludePreRelease:  tt.includePreRelease,
+			}, mux)
+
+			tag, _, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tag)
+		})
+	}
+}
+
+func TestDownloadReleaseAssetDraft(t *testing.T) {
+	now := time.Now()
+	released := &github.RepositoryRelease{
+		TagName:     github.String("v1.0.0"),
+		PublishedAt: &github.Timestamp{Time: now.Add(-2 * time.Hour)},
+		CreatedAt:   &github.Timestamp{Time: now.Add(-2 * time.Hour)},
+		Assets: []*github.ReleaseAsset{
+			{ID: github.Int64(1), Name: github.String("app-v1.0.0"), URL: github.String("app")},
+		},
+	}
+	draft := &github.RepositoryRelease{
+		TagName:   github.String("v1.1.0"),
+		Draft:     github.Bool(true),
+		CreatedAt: &github.Timestamp{Time: now.Add(-time.Hour)},
+		Assets: []*github.ReleaseAsset{
+			{ID: github.Int64(1), Name: github.String("app-v1.1.0"), URL: github.String("app")},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, released)
+	})
+	mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, []*github.RepositoryRelease{draft, released})
+	})
+	// a draft can't be got by the tag
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.1.0", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+
+	tests := []struct {
+		name         string
+		includeDraft bool
+		tag          string
+		want         string
+		wantErr      bool
+	}{
+		{name: "latest", tag: LatestTag, want: "v1.0.0"},
+		{name: "latest draft", includeDraft: true, tag: LatestTag, want: "v1.1.0"},
+		{name: "draft tag", includeDraft: true, tag: "v1.1.0", want: "v1.1.0"},
+		{name: "draft tag excluded", tag: "v1.1.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGitHub(t, &Config{
+				PackageNamePattern: "^app-",
+				IncludeDraft:       tt.includeDraft,
+			}, mux)
+
+			tag, _, err := g.DownloadReleaseAsset(context.Background(), tt.tag)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tag)
+		})
+	}
+}
+
+func TestDownloadReleaseAssetMinAge(t *testing.T) {
+	now := time.Now()
+	release := func(tag string, published time.Time, prerelease bool) *github.RepositoryRelease {
+		return &github.RepositoryRelease{
+			TagName:     github.String(tag),
+			Prerelease:  github.Bool(prerelease),
+			PublishedAt: &github.Timestamp{Time: published},
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app-" + tag), URL: github.String("app")},
+			},
+		}
+	}
+	releases := []*github.RepositoryRelease{
+		release("v1.2.0-rc1", now.Add(-time.Minute), true),
+		release("v1.1.0", now.Add(-10*time.Minute), false),
+		release("v1.1.0-rc1", now.Add(-2*time.Hour), true),
+		release("v1.0.0", now.Add(-3*time.Hour), false),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases[1])
+	})
+	mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases)
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.1.0", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases[1])
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+
+	tests := []struct {
+		name              string
+		minAge            time.Duration
+		elapsed           time.Duration
+		includePreRelease bool
+		versionSelection  string
+		tag               string
+		want              string
+	}{
+		{name: "disabled", tag: LatestTag, want: "v1.1.0"},
+		{name: "young latest", minAge: time.Hour, tag: LatestTag, want: "v1.0.0"},
+		{name: "aged latest", minAge: time.Hour, elapsed: time.Hour, tag: LatestTag, want: "v1.1.0"},
+		{name: "young prerelease", minAge: 5 * time.Minute, includePreRelease: true, tag: LatestTag, want: "v1.1.0"},
+		{name: "young semver", minAge: time.Hour, includePreRelease: true, versionSelection: VersionSelectionSemver, tag: LatestTag, want: "v1.1.0-rc1"},
+		{name: "explicit tag", minAge: time.Hour, tag: "v1.1.0", want: "v1.1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGitHub(t, &Config{
+				PackageNamePattern: "^app-",
+				ReleaseMinAge:      tt.minAge,
+				IncludePreRelease:  tt.includePreRelease,
+				VersionSelection:   tt.versionSelection,
+				VersionPrefix:      "v",
+				Clock:              &stepClock{now: now.Add(tt.elapsed)},
+			}, mux)
+
+			tag, _, err := g.DownloadReleaseAsset(context.Background(), tt.tag)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tag)
+		})
+	}
+}
+
+func TestDownloadReleaseAssetReleaseBranch(t *testing.T) {
+	now := time.Now()
+	release := func(tag, branch string, published time.Time, prerelease bool) *github.RepositoryRelease {
+		return &github.RepositoryRelease{
+			TagName:         github.String(tag),
+			TargetCommitish: github.String(branch),
+			Prerelease:      github.Bool(prerelease),
+			PublishedAt:     &github.Timestamp{Time: published},
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app-" + tag), URL: github.String("app")},
+			},
+		}
+	}
+	releases := []*github.RepositoryRelease{
+		release("v1.0.0", "main", now.Add(-3*time.Hour), false),
+		release("v0.9.1", "release-0.9", now, false),
+		release("v1.1.0-rc1", "main", now.Add(-2*time.Hour), true),
+		release("v0.9.2-rc1", "release-0.9", now.Add(-time.Hour), true),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases[1])
+	})
+	mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases)
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+
+	tests := []struct {
+		name              string
+		branch            string
+		includePreRelease bool
+		want              string
+	}{
+		{name: "release", branch: "main", want: "v1.0.0"},
+		{name: "prerelease", branch: "main", includePreRelease: true, want: "v1.1.0-rc1"},
+		{name: "other branch", branch: "release-0.9", want: "v0.9.1"},
+		{name: "not set", want: "v0.9.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGitHub(t, &Config{
+				PackageNamePattern: "^app-",
+				ReleaseBranch:      tt.branch,
+				IncludePreRelease:  tt.includePreRelease,
+			}, mux)
+
+			tag, _, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tag)
+		})
+	}
+}
+
+func TestDownloadReleaseAssetSemver(t *testing.T) {
+	now := time.Now()
+	release := func(tag string, published time.Time, prerelease bool) *github.RepositoryRelease {
+		return &github.RepositoryRelease{
+			TagName:     github.String(tag),
+			Prerelease:  github.Bool(prerelease),
+			PublishedAt: &github.Timestamp{Time: published},
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app-" + tag), URL: github.String("app")},
+			},
+		}
+	}
+	releases := []*github.RepositoryRelease{
+		release("v1.2.5", now, false),
+		release("nightly", now.Add(-time.Minute), false),
+		release("v2.1.0", now.Add(-time.Hour), false),
+		release("v2.2.0-rc1", now.Add(-2*time.Hour), true),
+		release("v1.3.0", now.Add(-3*time.Hour), false),
+		release("v1.10", now.Add(-4*time.Hour), false),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases[0])
+	})
+	mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases)
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+
+	tests := []struct {
+		name              string
+		selection         string
+		constraint        string
+		includePreRelease bool
+		want              string
+	}{
+		{name: "date", want: "v1.2.5"},
+		{name: "semver", selection: VersionSelectionSemver, want: "v2.1.0"},
+		{name: "semver prerelease", selection: VersionSelectionSemver, includePreRelease: true, want: "v2.2.0-rc1"},
+		{name: "semver constraint", selection: VersionSelectionSemver, constraint: ">=1.2.0 <2.0.0", want: "v1.3.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGitHub(t, &Config{
+				PackageNamePattern: "^app-",
+				VersionSelection:   tt.selection,
+				VersionPrefix:      "v",
+				VersionConstraint:  tt.constraint,
+				IncludePreRelease:  tt.includePreRelease,
+			}, mux)
+
+			tag, _, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, tag)
+		})
+	}
+}
+
+func TestListReleasesSamePublishedAt(t *testing.T) {
+	published := &github.Timestamp{Time: time.Now().Truncate(time.Second)}
+	release := func(id int64, tag string) *github.RepositoryRelease {
+		return &github.RepositoryRelease{
+			ID:          github.Int64(id),
+			TagName:     github.String(tag),
+			PublishedAt: published,
+		}
+	}
+
+	orders := [][]*github.RepositoryRelease{
+		{release(1, "v1.0.0"), release(2, "v1.1.0"), release(3, "nightly"), release(4, "edge")},
+		{release(4, "edge"), release(3, "nightly"), release(2, "v1.1.0"), release(1, "v1.0.0")},
+		{release(3, "nightly"), release(1, "v1.0.0"), release(4, "edge"), release(2, "v1.1.0")},
+	}
+
+	var want []string
+	for _, releases := range orders {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(t, w, releases)
+		})
+		g := newTestGitHub(t, &Config{PackageNamePattern: "^app-"}, mux)
+
+		got, err := g.listReleases(context.Background(), "owner", "repo")
+		assert.NoError(t, err)
+
+		tags := make([]string, 0, len(got))
+		for _, r := range got {
+			tags = append(tags, r.GetTagName())
+		}
+		if want == nil {
+			want = tags
+			assert.Equal(t, "v1.1.0", tags[0])
+			continue
+		}
+		assert.Equal(t, want, tags)
+	}
+}
+
+func TestListReleasesOrder(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	releases := []*github.RepositoryRelease{
+		{ID: github.Int64(1), TagName: github.String("v1.0.0"), PublishedAt: &github.Timestamp{Time: now.Add(-3 * time.Hour)}},
+		{ID: github.Int64(2), TagName: github.String("v1.1.0"), PublishedAt: &github.Timestamp{Time: now.Add(-2 * time.Hour)}},
+		{ID: github.Int64(3), TagName: github.String("v1.2.0"), PublishedAt: &github.Timestamp{Time: now.Add(-1 * time.Hour)}},
+		{ID: github.Int64(4), TagName: github.String("v1.3.0"), PublishedAt: &github.Timestamp{Time: now}},
+		{ID: github.Int64(5), TagName: github.String("unpublished")},
+	}
+	rand.Shuffle(len(releases), func(i, j int) {
+		releases[i], releases[j] = releases[j], releases[i]
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, releases)
+	})
+	g := newTestGitHub(t, &Config{PackageNamePattern: "^app-"}, mux)
+
+	got, err := g.listReleases(context.Background(), "owner", "repo")
+	assert.NoError(t, err)
+
+	tags := make([]string, 0, len(got))
+	for _, r := range got {
+		tags = append(tags, r.GetTagName())
+	}
+	assert.Equal(t, []string{"v1.3.0", "v1.2.0", "v1.1.0", "v1.0.0", "unpublished"}, tags)
+}
+
+func TestListReleasesETag(t *testing.T) {
+	releases := []*github.RepositoryRelease{
+		{ID: github.Int64(1), TagName: github.String("v1.0.0"), PublishedAt: &github.Timestamp{Time: time.Now()}},
+	}
+	etag := `"v1"`
+	var requests, notModified int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		writeJSON(t, w, releases)
+	})
+	g := newTestGitHub(t, &Config{PackageNamePattern: "^app-"}, mux)
+
+	for i := 0; i < 3; i++ {
+		got, err := g.listReleases(context.Background(), "owner", "repo")
+		assert.NoError(t, err)
+		assert.Len(t, got, 1)
+		assert.Equal(t, "v1.0.0", got[0].GetTagName())
+	}
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, 2, notModified)
+
+	// the list is fetched again when it is modified
+	releases = append(releases, &github.RepositoryRelease{ID: github.Int64(2), TagName: github.String("v1.1.0"), PublishedAt: &github.Timestamp{Time: time.Now().Add(time.Hour)}})
+	etag = `"v2"`
+	got, err := g.listReleases(context.Background(), "owner", "repo")
+	assert.NoError(t, err)
+	assert.Len(t, got, 2)
+	assert.Equal(t, "v1.1.0", got[0].GetTagName())
+}
+
+func TestDownloadReleaseAssetLFSPointer(t *testing.T) {
+	content := "real binary"
+	pointer := fmt.Sprintf("%s\noid sha256:%s\nsize %d\n", lfsPointerVersion, sha256Hex(content), len(content))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("v1.0.0"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app")},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, pointer)
+	})
+	mux.HandleFunc("/owner/repo.git/info/lfs/objects/batch", func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Objects []lfsBatchObject `json:"objects"`
+		}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, sha256Hex(content), req.Objects[0].Oid)
+
+		w.Header().Set("Content-Type", lfsMediaType)
+		fmt.Fprintf(w, `{"objects":[{"oid":"%s","size":%d,"actions":{"download":{"href":"http://%s/lfs/object"}}}]}`,
+			req.Objects[0].Oid, req.Objects[0].Size, r.Host)
+	})
+	mux.HandleFunc("/lfs/object", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, content)
+	})
+
+	t.Run("error without resolve_lfs", func(t *testing.T) {
+		g := newTestGitHub(t, &Config{PackageNamePattern: "^app$"}, mux)
+		_, _, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+		assert.True(t, errors.Is(err, ErrLFSPointer))
+		_, err = os.Stat(filepath.Join(g.config.SaveAssetsPath, "app"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("resolve_lfs", func(t *testing.T) {
+		g := newTestGitHub(t, &Config{PackageNamePattern: "^app$", ResolveLFS: true}, mux)
+		_, file, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+		assert.NoError(t, err)
+		b, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(b))
+	})
+}
+
+func TestDownloadReleaseAssetCache(t *testing.T) {
+	downloads := 0
+	mux := http.NewServeMux()
+	for _, tag := range []string{"v1.0.0", "v1.0.1"} {
+		tag := tag
+		mux.HandleFunc("/repos/owner/repo/releases/tags/"+tag, func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(t, w, &github.RepositoryRelease{
+				TagName: github.String(tag),
+				Assets: []*github.ReleaseAsset{
+					{ID: github.Int64(1), Name: github.String("app-" + tag), URL: github.String("app")},
+					{ID: github.Int64(2), Name: github.String("checksums.txt"), URL: github.String("checksums.txt")},
+				},
+			})
+		})
+	}
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+		downloads++
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/2", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s  app-v1.0.0\n%s  app-v1.0.1\n", sha256Hex("app"), sha256Hex("app"))
+	})
+
+	g := newTestGitHub(t, &Config{
+		PackageNamePattern: "^app-",
+		ChecksumPattern:    "^checksums.txt$",
+		AssetCacheDir:      t.TempDir(),
+	}, mux)
+
+	_, _, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	_, file, err := g.DownloadReleaseAsset(context.Background(), "v1.0.1")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, downloads)
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", string(b))
+}
+
+func TestDownloadReleaseAssetExistingSize(t *testing.T) {
+	downloads := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("v1.0.0"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app"), Size: github.Int(3)},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+		downloads++
+	})
+
+	g := newTestGitHub(t, &Config{PackageNamePattern: "^app"}, mux)
+	// truncated by a crash
+	assert.NoError(t, os.WriteFile(filepath.Join(g.config.SaveAssetsPath, "app"), nil, 0644))
+
+	for i := 0; i < 2; i++ {
+		_, file, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+		assert.NoError(t, err)
+		b, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.Equal(t, "app", string(b))
+		g.lastTag = ""
+	}
+	assert.Equal(t, 1, downloads)
+}
+
+func TestDownloadReleaseAssetRedirect(t *testing.T) {
+	var authorizations []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		http.ServeContent(w, r, "app", time.Time{}, strings.NewReader("app"))
+	}))
+	t.Cleanup(storage.Close)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("v1.0.0"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app")},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		http.Redirect(w, r, storage.URL+"/app", http.StatusFound)
+	})
+
+	g := newTestGitHub(t, &Config{PackageNamePattern: "^app"}, mux)
+	g.client = g.client.WithAuthToken("secret")
+
+	_, file, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", string(b))
+
+	// resume from the part file
+	ret, err := g.openAssetRange(context.Background(), 1, 1)
+	assert.NoError(t, err)
+	b, err = io.ReadAll(ret)
+	ret.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "pp", string(b))
+
+	assert.Equal(t, []string{"", ""}, authorizations)
+}
+
+func TestDownloadReleaseAssetWriteError(t *testing.T) {
+	downloads := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("v1.0.0"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app")},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+		downloads++
+	})
+
+	savePath := filepath.Join(t.TempDir(), "notfound")
+	g := newTestGitHub(t, &Config{
+		PackageNamePattern: "^app$",
+		SaveAssetsPath:     savePath,
+	}, mux)
+
+	_, _, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "asset:app tag:v1.0.0 path:"+filepath.Join(savePath, "app"))
+	assert.Equal(t, 2, downloads)
+}
+
+func TestDownloadReleaseAssets(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("v1.0.0"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app.service"), URL: github.String("app.service")},
+				{ID: github.Int64(2), Name: github.String("app"), URL: github.String("app")},
+				{ID: github.Int64(3), Name: github.String("README"), URL: github.String("README")},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "unit")
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/2", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+
+	g := newTestGitHub(t, &Config{
+		PackageNamePattern:  "^app$",
+		PackageNamePatterns: []string{`\.service$`},
+	}, mux)
+
+	tag, files, err := g.DownloadReleaseAssets(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+	assert.Equal(t, []string{
+		filepath.Join(g.config.SaveAssetsPath, "app"),
+		filepath.Join(g.config.SaveAssetsPath, "app.service"),
+	}, files)
+
+	_, file, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, files[0], file)
+
+	g = newTestGitHub(t, &Config{
+		PackageNamePatterns: []string{"^app$", `\.conf$`},
+	}, mux)
+	_, _, err = g.DownloadReleaseAssets(context.Background(), "v1.0.0")
+	assert.Equal(t, ErrAssetsNotFound, err)
+}
+
+func TestDownloadReleaseAssetTagTemplate(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("v1.0.0"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app-v0.9.0.tar.gz"), URL: github.String("app-v0.9.0.tar.gz")},
+				{ID: github.Int64(2), Name: github.String("app-v1.0.0.tar.gz"), URL: github.String("app-v1.0.0.tar.gz")},
+				{ID: github.Int64(3), Name: github.String("app-v1x0x0.tar.gz"), URL: github.String("app-v1x0x0.tar.gz")},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/2", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+
+	g := newTestGitHub(t, &Config{
+		PackageNamePattern: `^app-{{.Tag}}\.tar\.gz$`,
+	}, mux)
+
+	_, file, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(g.config.SaveAssetsPath, "v1.0.0", "app-v1.0.0.tar.gz"), file)
+
+	_, err = newAssetPattern("package_name_pattern", "^app-{{.Version}}$")
+	assert.Error(t, err)
+}
+
+func TestDownloadReleaseAssetChannel(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/tags/channels", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("channels"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(9), Name: github.String("channels.json"), URL: github.String("channels.json")},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/9", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"stable": "v1.2.3", "beta": "v1.3.0-rc1"}`)
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.3.0-rc1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("v1.3.0-rc1"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app")},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+
+	g := newTestGitHub(t, &Config{
+		PackageNamePattern: "^app$",
+		ChannelSourceTag:   "channels",
+		Channel:            "beta",
+	}, mux)
+
+	tag, _, err := g.DownloadReleaseAsset(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.3.0-rc1", tag)
+
+	g.config.Channel = "alpha"
+	_, _, err = g.DownloadReleaseAsset(context.Background(), LatestTag)
+	assert.Error(t, err)
+}
+
+func TestDownloadReleaseAssetResume(t *testing.T) {
+	content := "0123456789"
+	ranges := []string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("v1.0.0"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app")},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Header.Get("Range") == "bytes=4-" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 4-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			fmt.Fprint(w, content[4:])
+			return
+		}
+		// interrupt the first download in the middle
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		fmt.Fprint(w, content[:4])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+
+	g := newTestGitHub(t, &Config{PackageNamePattern: "^app$"}, mux)
+
+	_, file, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "bytes=4-"}, ranges)
+
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(b))
+	_, err = os.Stat(file + ".part")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGitHubAPIRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "transient error", status: http.StatusBadGateway, wantCalls: 3},
+		{name: "not found", status: http.StatusNotFound, wantCalls: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls < 3 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				writeJSON(t, w, &github.RepositoryRelease{
+					TagName: github.String("v1.0.0"),
+					Assets: []*github.ReleaseAsset{
+						{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app")},
+					},
+				})
+			})
+			mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "app")
+			})
+
+			g := newTestGitHub(t, &Config{
+				PackageNamePattern: "^app$",
+				GitHubMaxRetries:   3,
+				GitHubRetryDelay:   time.Millisecond,
+			}, mux)
+
+			_, _, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+			assert.Equal(t, tt.wantCalls, calls)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrAssetsCannotDownload))
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestGitHubAPIRateLimit(t *testing.T) {
+	calls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusForbidden)
+			writeJSON(t, w, map[string]string{
+				"message":           "You have exceeded a secondary rate limit.",
+				"documentation_url": "https://docs.github.com/rest/overview/resources-in-the-rest-api#secondary-rate-limits",
+			})
+			return
+		}
+		writeJSON(t, w, &github.RepositoryRelease{
+			TagName: github.String("v1.0.0"),
+			Assets: []*github.ReleaseAsset{
+				{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app")},
+			},
+		})
+	})
+	mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "app")
+	})
+
+	g := newTestGitHub(t, &Config{
+		PackageNamePattern: "^app$",
+		RespectRateLimit:   true,
+	}, mux)
+
+	start := time.Now()
+	_, _, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.True(t, time.Since(start) >= time.Second)
+}
+
+func TestGitHubAPIRateLimitWait(t *testing.T) {
+	g := &GitHub{config: &Config{RespectRateLimit: true}}
+	limited := func(wait time.Duration) func() error {
+		return func() error {
+			return &github.AbuseRateLimitError{Message: "rate limit", RetryAfter: &wait}
+		}
+	}
+
+	// the wait ends with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := g.callAPI(ctx, "test", limited(time.Hour))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 10*time.Second)
+
+	// the waits are capped
+	calls := 0
+	err = g.callAPI(context.Background(), "test", func() error {
+		calls++
+		return limited(time.Millisecond)()
+	})
+	var are *github.AbuseRateLimitError
+	assert.True(t, errors.As(err, &are))
+	assert.Equal(t, maxRateLimitWaits+1, calls)
+}
+
+func TestParseGitHubAPIEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{name: "empty", endpoint: "", want: ""},
+		{name: "github.com", endpoint: "https://api.github.com", want: "https://api.github.com/"},
+		{name: "enterprise host", endpoint: "https://github.example.com", want: "https://github.example.com/api/v3/"},
+		{name: "enterprise api path", endpoint: "https://github.example.com/api/v3", want: "https://github.example.com/api/v3/"},
+		{name: "no scheme", endpoint: "github.example.com", wantErr: true},
+		{name: "broken", endpoint: "https://github.example.com:port", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseGitHubAPIEndpoint(tt.endpoint)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.want == "" {
+				assert.Nil(t, got)
+				return
+			}
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func TestNewGitHubEnterpriseEndpoint(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "dummy")
+	g, err := NewGitHub(&Config{
+		Repo:               "owner/repo",
+		GitHubAPIEndpoint:  "https://github.example.com",
+		PackageNamePattern: ".*",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://github.example.com/api/v3/", g.client.BaseURL.String())
+	assert.Equal(t, "https://github.example.com/api/uploads/", g.client.UploadURL.String())
+}
@@ -0,0 +1,290 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultGitLabAPIEndpoint = "https://gitlab.com/api/v4/"
+
+// GitLab implements GitHuber with the releases API of GitLab.
+// The assets are the links of the release.
+type GitLab struct {
+	client                 *http.Client
+	config                 *Config
+	endpoint               *url.URL
+	token                  string
+	project                string
+	regPackageNamePatterns assetPatterns
+	regTagPattern          *regexp.Regexp
+	lastTag                string
+	lastAssetFiles         []string
+}
+
+type gitLabRelease struct {
+	TagName         string    `json:"tag_name"`
+	ReleasedAt      time.Time `json:"released_at"`
+	UpcomingRelease bool      `json:"upcoming_release"`
+	Assets          struct {
+		Links []gitLabAssetLink `json:"links"`
+	} `json:"assets"`
+}
+
+type gitLabAssetLink struct {
+	ID             int64  `json:"id"`
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	DirectAssetURL string `json:"direct_asset_url"`
+}
+
+func (l *gitLabAssetLink) downloadURL() string {
+	if l.DirectAssetURL != "" {
+		return l.DirectAssetURL
+	}
+	return l.URL
+}
+
+func NewGitLab(config *Config) (*GitLab, error) {
+	// the features verifying the assets must not be ignored silently
+	if config.ChecksumPattern != "" || config.SignaturePattern != "" {
+		return nil, errors.New("checksum_pattern and signature_pattern are not supported with gitlab provider")
+	}
+
+	endpoint := config.GitLabAPIEndpoint
+	if endpoint == "" {
+		endpoint = defaultGitLabAPIEndpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid gitlab_api endpoint %q: must be an absolute http(s) URL", endpoint)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+
+	token := config.GitLabToken
+	if token == "" {
+		token = os.Getenv("GITLAB_TOKEN")
+	}
+
+	regPackageNamePatterns, err := packageNamePatterns(config)
+	if err != nil {
+		return nil, err
+	}
+	regTagPattern, err := compilePattern("tag_pattern", config.TagPattern)
+	if err != nil {
+		return nil, err
+	}
+	return &GitLab{
+		client: &http.Client{
+			Transport:     NewTransport(config),
+			CheckRedirect: stripTokenOnRedirect(u.Host),
+		},
+		config:                 config,
+		endpoint:               u,
+		token:                  token,
+		project:                config.Repo,
+		regPackageNamePatterns: regPackageNamePatterns,
+		regTagPattern:          regTagPattern,
+	}, nil
+}
+
+// stripTokenOnRedirect drops the token when a redirect leaves the host of the API.
+// http.Client copies the custom headers like PRIVATE-TOKEN to another host, unlike Authorization.
+func stripTokenOnRedirect(host string) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if req.URL.Host != host {
+			req.Header.Del("PRIVATE-TOKEN")
+		}
+		return nil
+	}
+}
+
+// get requests the url with the token only when it is on the host of the API,
+// so that the token isn't sent to the external storage of the asset links.
+func (g *GitLab) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if g.token != "" && req.URL.Host == g.endpoint.Host {
+		req.Header.Set("PRIVATE-TOKEN", g.token)
+	}
+	res, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %s returned status %d", req.URL.Redacted(), res.StatusCode)
+	}
+	return res, nil
+}
+
+func (g *GitLab) getJSON(ctx context.Context, path string, v interface{}) error {
+	u, err := g.endpoint.Parse(path)
+	if err != nil {
+		return err
+	}
+	res, err := g.get(ctx, u.String())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (g *GitLab) projectPath() string {
+	return "projects/" + url.PathEscape(g.project)
+}
+
+// getRelease returns the release of the tag, or the newest released one matching tag_pattern for LatestTag.
+func (g *GitLab) getRelease(ctx context.Context, tag string) (*gitLabRelease, error) {
+	if tag != LatestTag {
+		var r gitLabRelease
+		if err := g.getJSON(ctx, fmt.Sprintf("%s/releases/%s", g.projectPath(), url.PathEscape(tag)), &r); err != nil {
+			return nil, errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("gitlab release tag:%s error: %v", tag, err))
+		}
+		return &r, nil
+	}
+
+	for page := 1; ; page++ {
+		var releases []*gitLabRelease
+		if err := g.getJSON(ctx, fmt.Sprintf("%s/releases?order_by=released_at&sort=desc&per_page=100&page=%d", g.projectPath(), page), &releases); err != nil {
+			return nil, errors.Wrap(ErrAssetsCannotDownload, fmt.Sprintf("gitlab releases error: %v", err))
+		}
+		for _, r := range releases {
+			if r.UpcomingRelease || (g.regTagPattern != nil && !g.regTagPattern.MatchString(r.TagName)) || !releaseAged(g.config, r.ReleasedAt) {
+				continue
+			}
+			return r, nil
+		}
+		if len(releases) < 100 {
+			return nil, errors.Wrap(ErrAssetsNotFound, fmt.Sprintf("no release found for tag:%s", tag))
+		}
+	}
+}
+
+// matchAssets returns the links matching the package name patterns in the order of the patterns.
+// It returns nil unless every pattern matches at least one link.
+func (g *GitLab) matchAssets(release *gitLabRelease) []gitLabAssetLink {
+	patterns, err := g.regPackageNamePatterns.forTag(release.TagName)
+	if err != nil {
+		slog.Error(err.Error())
+		return nil
+	}
+
+	var ret []gitLabAssetLink
+	seen := map[int64]bool{}
+	for _, pattern := range patterns {
+		matched := false
+		for _, link := range release.Assets.Links {
+			if !pattern.MatchString(link.Name) {
+				continue
+			}
+			matched = true
+			if !seen[link.ID] {
+				seen[link.ID] = true
+				ret = append(ret, link)
+			}
+		}
+		if !matched {
+			return nil
+		}
+	}
+	return ret
+}
+
+func (g *GitLab) ReleaseTag(ctx context.Context, tag string) (string, error) {
+	release, err := g.getRelease(ctx, tag)
+	if err != nil {
+		return "", err
+	}
+	if len(g.matchAssets(release)) == 0 {
+		return "", ErrAssetsNotFound
+	}
+	return release.TagName, nil
+}
+
+// OpenReleaseAsset returns the content of the matching asset without saving it to disk.
+func (g *GitLab) OpenReleaseAsset(ctx context.Context, tag string) (string, io.ReadCloser, error) {
+	release, err := g.getRelease(ctx, tag)
+	if err != nil {
+		return "", nil, err
+	}
+	links := g.matchAssets(release)
+	if len(links) == 0 {
+		return "", nil, ErrAssetsNotFound
+	}
+	res, err := g.get(ctx, links[0].downloadURL())
+	if err != nil {
+		return "", nil, errors.Wrap(ErrAssetsCannotDownload, err.Error())
+	}
+	return release.TagName, res.Body, nil
+}
+
+// DownloadReleaseAssets downloads all the assets matching the package name patterns.
+func (g *GitLab) DownloadReleaseAssets(ctx context.Context, tag string) (string, []string, error) {
+	if tag != "" && tag == g.lastTag && len(g.lastAssetFiles) > 0 {
+		return tag, g.lastAssetFiles, nil
+	}
+
+	release, err := g.getRelease(ctx, tag)
+	if err != nil {
+		return "", nil, err
+	}
+	slog.Debug("tag info", "latest release Tag", release.TagName)
+
+	links := g.matchAssets(release)
+	if len(links) == 0 {
+		return "", nil, ErrAssetsNotFound
+	}
+
+	files := make([]string, 0, len(links))
+	for _, link := range links {
+		filePath := g.regPackageNamePatterns.assetPath(g.config.SaveAssetsPath, release.TagName, link.Name)
+		if g.regPackageNamePatterns.templated() {
+			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+				return "", nil, err
+			}
+		}
+		if err := g.saveAsset(ctx, link, filePath); err != nil {
+			return "", nil, errors.Wrap(err, fmt.Sprintf("can't save asset:%s tag:%s path:%s", link.Name, release.TagName, filePath))
+		}
+		files = append(files, filePath)
+	}
+
+	g.lastTag = release.TagName
+	g.lastAssetFiles = files
+	return release.TagName, files, nil
+}
+
+// saveAsset writes the asset to "<filePath>.part" and renames it to filePath after the whole content is written.
+func (g *GitLab) saveAsset(ctx context.Context, link gitLabAssetLink, filePath string) error {
+	res, err := g.get(ctx, link.downloadURL())
+	if err != nil {
+		return errors.Wrap(ErrAssetsCannotDownload, err.Error())
+	}
+	defer res.Body.Close()
+
+	part := filePath + ".part"
+	if err := writeFile(part, res.Body, false); err != nil {
+		return err
+	}
+	return os.Rename(part, filePath)
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+)
+
+func TestGitLabDownloadReleaseAssets(t *testing.T) {
+	var storageTokens []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storageTokens = append(storageTokens, r.Header.Get("PRIVATE-TOKEN"))
+		fmt.Fprint(w, "service")
+	}))
+	t.Cleanup(storage.Close)
+
+	var api *httptest.Server
+	now := time.Now()
+	release := func(tag string, released time.Time, upcoming bool) map[string]interface{} {
+		return map[string]interface{}{
+			"tag_name":         tag,
+			"released_at":      released,
+			"upcoming_release": upcoming,
+			"assets": map[string]interface{}{
+				"links": []map[string]interface{}{
+					{"id": 1, "name": "app-" + tag, "url": "https://example.com/app", "direct_asset_url": api.URL + "/api/v4/projects/group%2Fsub%2Fapp/packages/generic/app/" + tag},
+					{"id": 2, "name": "app.service", "url": storage.URL + "/app.service"},
+					{"id": 3, "name": "app.conf", "url": api.URL + "/uploads/app.conf"},
+				},
+			},
+		}
+	}
+	api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("PRIVATE-TOKEN"))
+		var v interface{}
+		switch r.URL.EscapedPath() {
+		case "/api/v4/projects/group%2Fsub%2Fapp/releases":
+			v = []interface{}{
+				release("v2.0.0", now.Add(time.Hour), true),
+				release("nightly", now, false),
+				release("v1.1.0", now.Add(-time.Hour), false),
+				release("v1.0.0", now.Add(-2*time.Hour), false),
+			}
+		case "/api/v4/projects/group%2Fsub%2Fapp/releases/v1.0.0":
+			v = release("v1.0.0", now.Add(-2*time.Hour), false)
+		case "/uploads/app.conf":
+			// the upload on the API host is served from the storage
+			http.Redirect(w, r, storage.URL+"/app.conf", http.StatusFound)
+			return
+		case "/api/v4/projects/group%2Fsub%2Fapp/packages/generic/app/v1.1.0",
+			"/api/v4/projects/group%2Fsub%2Fapp/packages/generic/app/v1.0.0":
+			fmt.Fprint(w, "app")
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	config := &Config{
+		Provider:            ProviderGitLab,
+		Repo:                "group/sub/app",
+		GitLabToken:         "secret",
+		GitLabAPIEndpoint:   api.URL + "/api/v4",
+		PackageNamePatterns: []string{"^app-", `\.service$`, `\.conf$`},
+		TagPattern:          `^v\d+\.\d+\.\d+$`,
+		SaveAssetsPath:      t.TempDir(),
+	}
+	g, err := NewGitHuber(config)
+	assert.NoError(t, err)
+
+	tag, files, err := g.DownloadReleaseAssets(context.Background(), LatestTag)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+	assert.Equal(t, []string{
+		filepath.Join(config.SaveAssetsPath, "app-v1.1.0"),
+		filepath.Join(config.SaveAssetsPath, "app.service"),
+		filepath.Join(config.SaveAssetsPath, "app.conf"),
+	}, files)
+	b, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "app", string(b))
+
+	tag, err = g.ReleaseTag(context.Background(), "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+
+	// the token isn't sent to the storage on another host, even by the redirect from the API host
+	assert.Equal(t, []string{"", ""}, storageTokens)
+
+	config.ChecksumPattern = "checksums.txt"
+	_, err = NewGitHuber(config)
+	assert.Error(t, err)
+}
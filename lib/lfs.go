@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+	// pointer files are around 130 bytes, anything bigger is a real asset
+	lfsPointerMaxSize = 1024
+	lfsMediaType      = "application/vnd.git-lfs+json"
+)
+
+var ErrLFSPointer = errors.New("asset is a git lfs pointer")
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// parseLFSPointer returns oid and size when b is a git lfs pointer file.
+func parseLFSPointer(b []byte) (string, int64, bool) {
+	if !bytes.HasPrefix(b, []byte(lfsPointerVersion)) {
+		return "", 0, false
+	}
+
+	var oid string
+	var size int64 = -1
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "oid":
+			oid = strings.TrimPrefix(v, "sha256:")
+		case "size":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return "", 0, false
+			}
+			size = n
+		}
+	}
+	if oid == "" || size < 0 {
+		return "", 0, false
+	}
+	return oid, size, true
+}
+
+// openReleaseAsset opens the asset like openAsset, and resolves the content by
+// the LFS batch API when the asset is a git lfs pointer and resolve_lfs is enabled.
+// Otherwise ErrLFSPointer is returned instead of the pointer.
+func (g *GitHub) openReleaseAsset(ctx context.Context, name string, id int64) (io.ReadCloser, error) {
+	ret, err := g.openAsset(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(ret, lfsPointerMaxSize+1)
+	head, err := br.Peek(lfsPointerMaxSize + 1)
+	if err != io.EOF {
+		// too large to be a pointer. a read error is returned by the reader after the peeked content
+		return readCloser{br, ret}, nil
+	}
+
+	oid, size, ok := parseLFSPointer(head)
+	if !ok {
+		return readCloser{br, ret}, nil
+	}
+	ret.Close()
+
+	if !g.config.ResolveLFS {
+		return nil, errors.Wrap(ErrLFSPointer, fmt.Sprintf("asset:%s oid:%s", name, oid))
+	}
+	return g.openLFSObject(ctx, oid, size)
+}
+
+type lfsBatchObject struct {
+	Oid     string `json:"oid"`
+	Size    int64  `json:"size"`
+	Actions struct {
+		Download *struct {
+			Href   string            `json:"href"`
+			Header map[string]string `json:"header"`
+		} `json:"download"`
+	} `json:"actions"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// lfsEndpoint returns the LFS endpoint of the repository on the GitHub host.
+func (g *GitHub) lfsEndpoint() string {
+	host := g.client.BaseURL.Host
+	if host == "api.github.com" {
+		host = "github.com"
+	}
+	return fmt.Sprintf("%s://%s/%s/%s.git/info/lfs", g.client.BaseURL.Scheme, host, g.owner, g.repo)
+}
+
+func (g *GitHub) openLFSObject(ctx context.Context, oid string, size int64) (io.ReadCloser, error) {
+	body, err := json.Marshal(map[string]any{
+		"operation": "download",
+		"transfers": []string{"basic"},
+		"objects":   []map[string]any{{"oid": oid, "size": size}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", g.lfsEndpoint()+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	if g.config.GitHubToken != "" {
+		req.SetBasicAuth("x-access-token", g.config.GitHubToken)
+	}
+
+	res, err := g.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lfs batch api returned status %d", res.StatusCode)
+	}
+
+	batch := struct {
+		Objects []lfsBatchObject `json:"objects"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("can't parse lfs batch response:%s", err)
+	}
+	if len(batch.Objects) == 0 {
+		return nil, fmt.Errorf("lfs object %s is not found", oid)
+	}
+	obj := batch.Objects[0]
+	if obj.Error != nil {
+		return nil, fmt.Errorf("lfs object %s: %d %s", oid, obj.Error.Code, obj.Error.Message)
+	}
+	if obj.Actions.Download == nil {
+		return nil, fmt.Errorf("lfs object %s has no download action", oid)
+	}
+
+	dreq, err := http.NewRequestWithContext(ctx, "GET", obj.Actions.Download.Href, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range obj.Actions.Download.Header {
+		dreq.Header.Set(k, v)
+	}
+	dres, err := g.httpClient.Do(dreq)
+	if err != nil {
+		return nil, err
+	}
+	if dres.StatusCode != http.StatusOK {
+		dres.Body.Close()
+		return nil, fmt.Errorf("lfs object download returned status %d", dres.StatusCode)
+	}
+	return dres.Body, nil
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxyConfig returns the proxy of http_proxy, https_proxy and no_proxy. The one
+// which is not configured falls back to the environment variable like http.ProxyFromEnvironment.
+func proxyConfig(config *Config) *httpproxy.Config {
+	c := httpproxy.FromEnvironment()
+	if config.HTTPProxy != "" {
+		c.HTTPProxy = config.HTTPProxy
+	}
+	if config.HTTPSProxy != "" {
+		c.HTTPSProxy = config.HTTPSProxy
+	}
+	if config.NoProxy != "" {
+		c.NoProxy = config.NoProxy
+	}
+	return c
+}
+
+// NewTransport returns the transport to reach the release provider through the configured proxy.
+func NewTransport(config *Config) *http.Transport {
+	proxy := proxyConfig(config).ProxyFunc()
+	return &http.Transport{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			return proxy(req.URL)
+		},
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+}
+
+// tokenTransport adds the token to the requests like the client of go-github-client does.
+type tokenTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "token "+t.token)
+	return t.base.RoundTrip(req)
+}
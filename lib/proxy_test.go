@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+func TestNewTransportProxy(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://env-proxy.example.com:3128")
+	t.Setenv("HTTPS_PROXY", "http://env-proxy.example.com:3128")
+	t.Setenv("NO_PROXY", "")
+
+	tests := []struct {
+		name   string
+		config *Config
+		url    string
+		want   string
+	}{
+		{
+			name:   "environment",
+			config: &Config{},
+			url:    "https://api.github.com/repos",
+			want:   "http://env-proxy.example.com:3128",
+		},
+		{
+			name:   "configured https_proxy",
+			config: &Config{HTTPSProxy: "http://proxy.example.com:8080"},
+			url:    "https://api.github.com/repos",
+			want:   "http://proxy.example.com:8080",
+		},
+		{
+			name:   "http_proxy falls back to the environment",
+			config: &Config{HTTPSProxy: "http://proxy.example.com:8080"},
+			url:    "http://github.example.com/api/v3/repos",
+			want:   "http://env-proxy.example.com:3128",
+		},
+		{
+			name:   "no_proxy",
+			config: &Config{HTTPSProxy: "http://proxy.example.com:8080", NoProxy: "github.example.com"},
+			url:    "https://github.example.com/api/v3/repos",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			assert.NoError(t, err)
+			p, err := NewTransport(tt.config).Proxy(&http.Request{URL: u})
+			assert.NoError(t, err)
+			if tt.want == "" {
+				assert.Nil(t, p)
+				return
+			}
+			assert.Equal(t, tt.want, p.String())
+		})
+	}
+}
+
+func TestNewGitHubProxy(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "")
+	var got *http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+	}))
+	defer proxy.Close()
+
+	g, err := NewGitHub(&Config{
+		Repo:              "owner/repo",
+		GitHubToken:       "dummy",
+		GitHubAPIEndpoint: "http://github.example.com",
+		HTTPProxy:         proxy.URL,
+	})
+	assert.NoError(t, err)
+
+	_, _, err = g.client.Repositories.ListReleases(context.Background(), "owner", "repo", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, got)
+	assert.Equal(t, "http://github.example.com/api/v3/repos/owner/repo/releases", got.RequestURI)
+	assert.Equal(t, "token dummy", got.Header.Get("Authorization"))
+}
+
+func TestNewGitHubAppProxy(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("GH_TOKEN", "")
+	t.Setenv("GITHUB_APP_ID", "1")
+	t.Setenv("GITHUB_APP_INSTALLATION_ID", "")
+	t.Setenv("GITHUB_APP_PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+
+	var got []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.RequestURI)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v3/repos/owner/repo/installation":
+			w.Write([]byte(`{"id": 2}`))
+		case "/api/v3/app/installations/2/access_tokens":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"token": "installation-token"}`))
+		default:
+			assert.Equal(t, "token installation-token", r.Header.Get("Authorization"))
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer proxy.Close()
+
+	g, err := NewGitHub(&Config{
+		Repo:              "owner/repo",
+		GitHubAPIEndpoint: "http://github.example.com",
+		HTTPProxy:         proxy.URL,
+	})
+	assert.NoError(t, err)
+
+	_, _, err = g.client.Repositories.ListReleases(context.Background(), "owner", "repo", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"http://github.example.com/api/v3/repos/owner/repo/installation",
+		"http://github.example.com/api/v3/app/installations/2/access_tokens",
+		"http://github.example.com/api/v3/repos/owner/repo/releases",
+	}, got)
+}
@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// keep_assets bounds the assets accumulated in save_assets_path. The assets matching
+// the package name patterns are pruned by mtime, and with the templated patterns the
+// directory of each tag is pruned as a whole.
+
+type savedAsset struct {
+	path    string
+	name    string
+	modTime time.Time
+}
+
+// PruneAssets removes all but the config.KeepAssets most recent assets in save_assets_path.
+// keepFiles and the assets of keepTags are kept regardless. It returns the removed paths.
+func PruneAssets(config *Config, keepFiles []string, keepTags ...string) ([]string, error) {
+	if config.KeepAssets <= 0 {
+		return nil, nil
+	}
+
+	patterns, err := packageNamePatterns(config)
+	if err != nil {
+		return nil, err
+	}
+
+	assets, err := savedAssets(config.SaveAssetsPath, patterns)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(assets, func(i, j int) bool {
+		return assets[i].modTime.After(assets[j].modTime)
+	})
+
+	keep := map[string]bool{}
+	for _, f := range keepFiles {
+		keep[filepath.Clean(f)] = true
+	}
+
+	var removed []string
+	for i, a := range assets {
+		if i < config.KeepAssets || keep[a.path] || assetOfTags(patterns, a, keepTags) {
+			continue
+		}
+		if err := os.RemoveAll(a.path); err != nil {
+			return removed, fmt.Errorf("can't remove asset:%s %s", a.path, err)
+		}
+		slog.Info("pruned old asset", "path", a.path)
+		removed = append(removed, a.path)
+	}
+	return removed, nil
+}
+
+// savedAssets lists the assets matching patterns, or the tag directories with the templated patterns.
+func savedAssets(root string, patterns assetPatterns) ([]savedAsset, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ret []savedAsset
+	for _, e := range entries {
+		if patterns.templated() {
+			if !e.IsDir() || e.Name() == snapshotVersionsDir {
+				continue
+			}
+		} else if !e.Type().IsRegular() || !patterns.match(e.Name()) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, savedAsset{
+			path:    filepath.Join(root, e.Name()),
+			name:    e.Name(),
+			modTime: fi.ModTime(),
+		})
+	}
+	return ret, nil
+}
+
+func (ps assetPatterns) match(name string) bool {
+	for _, p := range ps {
+		if p.regexp != nil && p.regexp.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// assetOfTags reports whether the asset belongs to one of tags. The name of the
+// asset without the template has to contain the tag, with or without the "v" prefix.
+func assetOfTags(patterns assetPatterns, a savedAsset, tags []string) bool {
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		if patterns.templated() {
+			if a.name == assetDirName(tag) {
+				return true
+			}
+			continue
+		}
+		for _, t := range []string{tag, strings.TrimPrefix(tag, "v")} {
+			if regexp.MustCompile(`(^|[^0-9A-Za-z])` + regexp.QuoteMeta(t) + `($|[^0-9])`).MatchString(a.name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tj/assert"
+)
+
+func writeAsset(t *testing.T, path string, modTime time.Time) {
+	t.Helper()
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, []byte("asset"), 0644))
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestPruneAssets(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, tag := range []string{"v1.0.0", "v1.0.1", "v1.0.2", "v1.0.3", "v1.0.10"} {
+		writeAsset(t, filepath.Join(dir, "app-"+tag+".tar.gz"), now.Add(time.Duration(i)*time.Minute))
+	}
+	writeAsset(t, filepath.Join(dir, "README"), now.Add(-time.Hour))
+
+	config := &Config{
+		PackageNamePattern: `^app-.*\.tar\.gz$`,
+		SaveAssetsPath:     dir,
+	}
+	removed, err := PruneAssets(config, nil, "v1.0.10", "v1.0.1")
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+
+	config.KeepAssets = 2
+	removed, err = PruneAssets(config, []string{filepath.Join(dir, "app-v1.0.10.tar.gz")}, "v1.0.10", "v1.0.1")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "app-v1.0.2.tar.gz"),
+		filepath.Join(dir, "app-v1.0.0.tar.gz"),
+	}, removed)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"README", "app-v1.0.1.tar.gz", "app-v1.0.3.tar.gz", "app-v1.0.10.tar.gz"}, names)
+}
+
+func TestPruneAssetsTagTemplate(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for i, tag := range []string{"v1.0.0", "v1.0.1", "v1.0.2"} {
+		writeAsset(t, filepath.Join(dir, tag, "app-"+tag), now.Add(time.Duration(i)*time.Minute))
+	}
+	writeAsset(t, filepath.Join(SnapshotDir(dir, "v0.9.0"), "app-v0.9.0"), now.Add(-time.Hour))
+
+	config := &Config{
+		PackageNamePattern: "^app-{{.Tag}}$",
+		SaveAssetsPath:     dir,
+		KeepAssets:         1,
+	}
+	removed, err := PruneAssets(config, nil, "v1.0.2", "v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "v1.0.1")}, removed)
+	assert.True(t, HasSnapshot(dir, "v0.9.0"))
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+const releaseHistoryLimit = 1000
+
+const (
+	ReleaseActionStable   = "stable"
+	ReleaseActionRollback = "rollback"
+)
+
+// ReleaseHistory is an entry of the audit trail of the stable tags and the rollbacks.
+type ReleaseHistory struct {
+	Tag    string    `json:"tag"`
+	Host   string    `json:"host"`
+	Action string    `json:"action"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// SaveReleaseHistory appends an entry of this node to the release history.
+func (s *State) SaveReleaseHistory(tag, action, reason string) error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	pipe := s.client.TxPipeline()
+	if err := s.pushReleaseHistory(ctx, pipe, tag, action, reason); err != nil {
+		return err
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// pushReleaseHistory queues an entry of this node to the release history in pipe, so that
+// the entry is written in the same transaction as the change it records.
+func (s *State) pushReleaseHistory(ctx context.Context, pipe redis.Pipeliner, tag, action, reason string) error {
+	b, err := json.Marshal(&ReleaseHistory{
+		Tag:    tag,
+		Host:   s.me,
+		Action: action,
+		Reason: reason,
+		At:     s.now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	pipe.LPush(ctx, s.releaseHistoryKey, b)
+	pipe.LTrim(ctx, s.releaseHistoryKey, 0, releaseHistoryLimit-1)
+	return nil
+}
+
+// GetReleaseHistory returns up to limit entries of the release history, newest first.
+// All the entries are returned when limit is 0.
+func (s *State) GetReleaseHistory(limit int) ([]ReleaseHistory, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	vs, err := s.client.LRange(ctx, s.releaseHistoryKey, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]ReleaseHistory, 0, len(vs))
+	for _, v := range vs {
+		h := ReleaseHistory{}
+		if err := json.Unmarshal([]byte(v), &h); err != nil {
+			return nil, fmt.Errorf("can't parse release history:%s", err)
+		}
+		history = append(history, h)
+	}
+	return history, nil
+}
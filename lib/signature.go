@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+var ErrSignatureInvalid = errors.New("signature invalid")
+
+// minisignPublicKey is a public key of minisign (https://jedisct1.github.io/minisign/).
+type minisignPublicKey struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+// lastLine returns the last line which is not a comment of minisign.
+func lastLine(b []byte) string {
+	var ret string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "untrusted comment:") {
+			continue
+		}
+		ret = l
+	}
+	return ret
+}
+
+// loadMinisignPublicKey reads the public key file written by `minisign -G`.
+func loadMinisignPublicKey(path string) (*minisignPublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMinisignPublicKey(lastLine(b))
+}
+
+func parseMinisignPublicKey(s string) (*minisignPublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode minisign public key:%s", err)
+	}
+	if len(b) != 2+8+ed25519.PublicKeySize || string(b[:2]) != "Ed" {
+		return nil, errors.New("invalid minisign public key")
+	}
+
+	k := &minisignPublicKey{key: ed25519.PublicKey(b[10:])}
+	copy(k.keyID[:], b[2:10])
+	return k, nil
+}
+
+// verify checks the minisign signature of the file, both the signature of the content
+// and the global signature of the trusted comment.
+func (k *minisignPublicKey) verify(filePath string, sig []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) < 4 {
+		return errors.Wrap(ErrSignatureInvalid, "malformed minisign signature")
+	}
+
+	s, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(s) != 2+8+ed25519.SignatureSize {
+		return errors.Wrap(ErrSignatureInvalid, "malformed minisign signature")
+	}
+	if !bytes.Equal(s[2:10], k.keyID[:]) {
+		return errors.Wrap(ErrSignatureInvalid, "signed with another key")
+	}
+
+	msg, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	switch string(s[:2]) {
+	case "Ed":
+	case "ED":
+		// prehashed with BLAKE2b-512, the default since minisign 0.10
+		h := blake2b.Sum512(msg)
+		msg = h[:]
+	default:
+		return errors.Wrap(ErrSignatureInvalid, fmt.Sprintf("unknown signature algorithm %q", s[:2]))
+	}
+	if !ed25519.Verify(k.key, msg, s[10:]) {
+		return ErrSignatureInvalid
+	}
+
+	comment, ok := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	if !ok {
+		return errors.Wrap(ErrSignatureInvalid, "trusted comment is not found")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return errors.Wrap(ErrSignatureInvalid, "malformed global signature")
+	}
+	signed := append(append([]byte{}, s[10:]...), comment...)
+	if !ed25519.Verify(k.key, signed, global) {
+		return errors.Wrap(ErrSignatureInvalid, "trusted comment is forged")
+	}
+	return nil
+}
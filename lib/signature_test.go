@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-github/v55/github"
+	"github.com/tj/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignFiles returns a public key file and a signature of content in the format of minisign.
+func minisignFiles(t *testing.T, content string) (string, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte("12345678")
+
+	pubKey := filepath.Join(t.TempDir(), "minisign.pub")
+	b := append(append([]byte("Ed"), keyID...), pub...)
+	if err := os.WriteFile(pubKey, []byte("untrusted comment: minisign public key\n"+base64.StdEncoding.EncodeToString(b)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h := blake2b.Sum512([]byte(content))
+	sig := ed25519.Sign(priv, h[:])
+	comment := "timestamp:1700000000\tfile:app"
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), comment...))
+	s := fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte("ED"), keyID...), sig...)),
+		comment,
+		base64.StdEncoding.EncodeToString(global),
+	)
+	return pubKey, s
+}
+
+func TestDownloadReleaseAssetSignature(t *testing.T) {
+	pubKey, sig := minisignFiles(t, "good")
+
+	tests := []struct {
+		name    string
+		content string
+		sigName string
+		wantErr error
+	}{
+		{
+			name:    "valid",
+			content: "good",
+			sigName: "app.minisig",
+		},
+		{
+			name:    "tampered",
+			content: "evil",
+			sigName: "app.minisig",
+			wantErr: ErrSignatureInvalid,
+		},
+		{
+			name:    "signature not found",
+			content: "good",
+			sigName: "other.minisig",
+			wantErr: ErrSignatureInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/owner/repo/releases/tags/v1.0.0", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(t, w, &github.RepositoryRelease{
+					TagName: github.String("v1.0.0"),
+					Assets: []*github.ReleaseAsset{
+						{ID: github.Int64(1), Name: github.String("app"), URL: github.String("app")},
+						{ID: github.Int64(2), Name: github.String(tt.sigName), URL: github.String(tt.sigName)},
+					},
+				})
+			})
+			mux.HandleFunc("/repos/owner/repo/releases/assets/1", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.content)
+			})
+			mux.HandleFunc("/repos/owner/repo/releases/assets/2", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, sig)
+			})
+
+			g := newTestGitHub(t, &Config{
+				PackageNamePattern: "^app$",
+				SignaturePattern:   `\.minisig$`,
+				SignaturePublicKey: pubKey,
+			}, mux)
+
+			_, _, err := g.DownloadReleaseAsset(context.Background(), "v1.0.0")
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr))
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Snapshots keep the asset of every deployed tag in <save_assets_path>/versions/<tag>
+// and <save_assets_path>/current links to the deployed one, so that rollback is a
+// switch of the link.
+
+const (
+	snapshotVersionsDir = "versions"
+	snapshotCurrentLink = "current"
+)
+
+func SnapshotDir(root, tag string) string {
+	return filepath.Join(root, snapshotVersionsDir, strings.ReplaceAll(tag, "/", "_"))
+}
+
+func SnapshotCurrentLink(root string) string {
+	return filepath.Join(root, snapshotCurrentLink)
+}
+
+// SaveSnapshot places the asset files in the snapshot directory of tag and returns the directory.
+func SaveSnapshot(root, tag string, files ...string) (string, error) {
+	dir := SnapshotDir(root, tag)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("can't create snapshot dir:%s", err)
+	}
+	for _, file := range files {
+		if err := linkOrCopy(file, filepath.Join(dir, filepath.Base(file))); err != nil {
+			return "", fmt.Errorf("can't save snapshot:%s", err)
+		}
+	}
+	return dir, nil
+}
+
+func HasSnapshot(root, tag string) bool {
+	fi, err := os.Stat(SnapshotDir(root, tag))
+	return err == nil && fi.IsDir()
+}
+
+// SwitchSnapshot atomically points the current link to the snapshot of tag.
+func SwitchSnapshot(root, tag string) error {
+	if !HasSnapshot(root, tag) {
+		return fmt.Errorf("snapshot of %s is not found", tag)
+	}
+
+	link := SnapshotCurrentLink(root)
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join(snapshotVersionsDir, filepath.Base(SnapshotDir(root, tag))), tmp); err != nil {
+		return fmt.Errorf("can't create current link:%s", err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("can't switch current link:%s", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	root := t.TempDir()
+	for _, tag := range []string{"v1.0.0", "v1.1.0"} {
+		file := filepath.Join(root, "app-"+tag)
+		assert.NoError(t, os.WriteFile(file, []byte(tag), 0644))
+		_, err := SaveSnapshot(root, tag, file)
+		assert.NoError(t, err)
+		assert.NoError(t, SwitchSnapshot(root, tag))
+	}
+
+	b, err := os.ReadFile(filepath.Join(SnapshotCurrentLink(root), "app-v1.1.0"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", string(b))
+
+	assert.NoError(t, SwitchSnapshot(root, "v1.0.0"))
+	b, err = os.ReadFile(filepath.Join(SnapshotCurrentLink(root), "app-v1.0.0"))
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", string(b))
+
+	assert.False(t, HasSnapshot(root, "v0.9.0"))
+	assert.Error(t, SwitchSnapshot(root, "v0.9.0"))
+}
@@ -2,79 +2,818 @@ package lib
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	redis "github.com/redis/go-redis/v9"
 )
 
+// Stater is the state shared by the nodes, implemented by State on Redis and FileState on a local file.
+type Stater interface {
+	TryCanaryReleaseLock(tag string) (bool, error)
+	UnlockCanaryRelease() error
+	CanaryReleaseLocks() ([]CanaryLock, error)
+	CanaryPassed(tag string) (bool, error)
+	TryRolloutLock(tag string) (bool, error)
+	UnlockRollout() error
+	ReleaseRolloutBatch() error
+	ExtendCanaryReleaseLock(ttl time.Duration) (bool, error)
+	ExtendRolloutLock() (bool, error)
+	CurrentStableTag() (string, error)
+	SaveStableReleaseTag(tag string) error
+	IsAvoidReleaseTag(tag string) error
+	SaveAvoidReleaseTag(tag, reason, output string) error
+	AvoidReleaseTags() ([]string, error)
+	AvoidReasons() (map[string]*AvoidReason, error)
+	RemoveAvoidReleaseTag(tag string) error
+	PendingReleaseTag() (string, error)
+	SavePendingReleaseTag(tag string) error
+	PromotedReleaseTag() (string, error)
+	PromotePendingReleaseTag() (string, error)
+	ObserveLatestTag(tag string) uint
+	CanInstallTag(tag string) error
+	GetLastInstalledTag() (string, error)
+	ForgetInstalledTag()
+	RollbackTag(beforeInstall string) (string, error)
+	SaveMemberState() error
+	GetRolloutProgress(tag string) (int, int, error)
+	MemberStates() (map[string]*MemberState, error)
+	VersionDistribution() (map[string]int, error)
+	MarkRolloutComplete(tag string) (bool, error)
+	MarkRolloutStarted(tag string) (bool, error)
+	MarkRolloutStalled(tag string, installed int) (bool, error)
+	HoldMember(tag string) error
+	HeldTag() (string, error)
+	ClearHold() error
+	AbortCanaryRelease(tag string) error
+	SaveDeployFailure(tag string) (*DeployFailure, error)
+	DeployFailure() (*DeployFailure, error)
+	ClearDeployFailure() error
+	SaveDeployProgress(tag, previousTag, file string) error
+	DeployProgress() (*DeployProgress, error)
+	ClearDeployProgress() error
+	CanaryAbortedTag() (string, error)
+	SaveHealthAttestation(tag string) error
+	HealthAttestation(tag string) (*HealthAttestation, error)
+	StartRolloutReport(tag string) error
+	CountRolloutRollback(tag string) error
+	RolloutReport(tag string) (*RolloutReport, error)
+	SaveDeployRecord(tag string) error
+	DeployHistory() ([]DeployRecord, error)
+	SaveReleaseHistory(tag, action, reason string) error
+	GetReleaseHistory(limit int) ([]ReleaseHistory, error)
+}
+
+var ErrRepoNotSelected = errors.New("select one of repos with --repo")
+
+// NewStater returns the state on the backend selected by state_backend.
+func NewStater(config *Config) (Stater, error) {
+	if len(config.Repos) > 0 {
+		return nil, ErrRepoNotSelected
+	}
+	if config.StateBackend == StateBackendFile {
+		return NewFileState(config)
+	}
+	return NewState(config)
+}
+
+// NewStaters returns the state of each config from Config.RepoConfigs.
+// The states on redis share a client.
+func NewStaters(configs []*Config) ([]Stater, error) {
+	var rc redis.UniversalClient
+	ret := make([]Stater, 0, len(configs))
+	for _, c := range configs {
+		if c.StateBackend == StateBackendFile {
+			s, err := NewFileState(c)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, s)
+			continue
+		}
+
+		if rc == nil {
+			var err error
+			rc, err = connectRedis(c.Redis)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s, err := newState(c, rc)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// nodeState is the state of this node kept in memory, shared by the backends.
+type nodeState struct {
+	config *Config
+
+	// last successful result of the version command and consecutive failures since then,
+	// used to report the member state over a transient failure.
+	lastVersion         string
+	versionFailureCount uint
+
+	// result of the version command reused for version_cache_ttl
+	versionMu       sync.Mutex
+	cachedVersion   string
+	versionCachedAt time.Time
+
+	// latest tag observed by the previous polls and how many times in a row.
+	observedTag      string
+	observedTagCount uint
+}
+
+// CanaryLockTTL returns canary_lock_ttl, or twice canary_rollout_window by default.
+func CanaryLockTTL(config *Config) time.Duration {
+	if config.CanaryLockTTL > 0 {
+		return config.CanaryLockTTL
+	}
+	return config.CanaryRolloutWindow * 2
+}
+
+// CanaryLockLease returns the ttl to take the canary release lock with. It is
+// canary_lock_heartbeat when the holder keeps the lock alive with the heartbeat,
+// so that the lock of a crashed holder expires quickly.
+func CanaryLockLease(config *Config) time.Duration {
+	if config.CanaryLockHeartbeat > 0 && config.CanaryLockHeartbeat < CanaryLockTTL(config) {
+		return config.CanaryLockHeartbeat
+	}
+	return CanaryLockTTL(config)
+}
+
+// RolloutLockTTL returns rollout_lock_ttl, or rollout_window by default.
+func RolloutLockTTL(config *Config) time.Duration {
+	if config.RolloutLockTTL > 0 {
+		return config.RolloutLockTTL
+	}
+	return config.RolloutWindow
+}
+
 type State struct {
-	me                  string
-	client              *redis.Client
-	canaryReleaseTagKey string
-	stableReleaseTagKey string
-	avoidReleaseTagKey  string
-	membersTagKey       string
-	rolloutKey          string
-	config              *Config
+	nodeState
+	me                   string
+	client               redis.UniversalClient
+	canaryReleaseTagKey  string
+	stableReleaseTagKey  string
+	avoidReleaseTagKey   string
+	avoidTagExpiryKey    string
+	avoidReasonKey       string
+	membersTagKey        string
+	rolloutKey           string
+	pendingTagKey        string
+	rolloutCompleteKey   string
+	promotedTagKey       string
+	deployHistoryKey     string
+	releaseHistoryKey    string
+	healthAttestationKey string
+	rolloutReportKey     string
+	rolloutStartKey      string
+	rolloutStallKey      string
+	abortCanaryKey       string
+
+	// tag of the canary cohort this node joined
+	cohortTag string
+
+	// tag of the rollout batch this node was admitted to
+	rolloutBatchTag string
 }
 
-func NewState(config *Config) (*State, error) {
-	rc := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", config.Redis.Host, config.Redis.Port),
-		Password: config.Redis.Password,
-		DB:       config.Redis.DB,
-	})
+func newRedisTLSConfig(config *RedisTLSConfig) (*tls.Config, error) {
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	tc := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CACert != "" {
+		b, err := os.ReadFile(config.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("can't read redis ca cert:%s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("can't parse redis ca cert:%s", config.CACert)
+		}
+		tc.RootCAs = pool
+	}
+	if config.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("can't load redis client cert:%s", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
 
-	if err := rc.Ping(context.Background()).Err(); err != nil {
-		return nil, fmt.Errorf("failed to create redis client: %s", err)
+func newRedisClient(config *RedisConfig) (redis.UniversalClient, error) {
+	tc, err := newRedisTLSConfig(&config.TLS)
+	if err != nil {
+		return nil, err
 	}
+
+	switch config.Mode {
+	case RedisModeSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.MasterName,
+			SentinelAddrs:    config.Addrs,
+			SentinelPassword: config.SentinelPassword,
+			Password:         config.Password,
+			DB:               config.DB,
+			TLSConfig:        tc,
+
+			ContextTimeoutEnabled: true,
+		}), nil
+	case RedisModeCluster:
+		addrs := config.Addrs
+		if len(addrs) == 0 {
+			addrs = []string{fmt.Sprintf("%s:%d", config.Host, config.Port)}
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     addrs,
+			Password:  config.Password,
+			TLSConfig: tc,
+
+			ContextTimeoutEnabled: true,
+		}), nil
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:      fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Password:  config.Password,
+		DB:        config.DB,
+		TLSConfig: tc,
+
+		ContextTimeoutEnabled: true,
+	}), nil
+}
+
+// keyPrefix returns the prefix of the keys. In cluster mode it is a hash tag so that
+// all the keys are in the same slot for the transactions and scripts over several keys.
+func keyPrefix(config *Config) string {
 	prefix := config.Repo
 	if config.Redis.KeyPrefix != "" {
 		prefix = config.Redis.KeyPrefix
 	}
+	if config.Redis.Mode == RedisModeCluster {
+		prefix = fmt.Sprintf("{%s}", prefix)
+	}
+	return prefix
+}
+
+func NewState(config *Config) (*State, error) {
+	rc, err := connectRedis(config.Redis)
+	if err != nil {
+		return nil, err
+	}
+	return newState(config, rc)
+}
+
+// connectRedis masks the passwords in the error, which may include the connection settings.
+func connectRedis(config *RedisConfig) (redis.UniversalClient, error) {
+	rc, err := newRedisClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create redis client: %s", RedactSecrets(err.Error(), config.Password, config.SentinelPassword))
+	}
+
+	ctx, cancel := redisContext(config)
+	defer cancel()
+	if err := rc.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("failed to create redis client: %s", RedactSecrets(err.Error(), config.Password, config.SentinelPassword))
+	}
+	return rc, nil
+}
+
+// redisContext bounds a call to Redis by redis.timeout so that an unreachable Redis
+// fails the call instead of blocking the loop.
+func redisContext(config *RedisConfig) (context.Context, context.CancelFunc) {
+	if config.Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), config.Timeout)
+}
+
+func (s *State) redisContext() (context.Context, context.CancelFunc) {
+	return redisContext(s.config.Redis)
+}
+
+func newState(config *Config, rc redis.UniversalClient) (*State, error) {
+	prefix := keyPrefix(config)
 
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get hostname: %s", err)
 	}
 
+	me := fmt.Sprintf("%s:%s", hostname, prefix)
+	if config.InstanceID != "" {
+		me = fmt.Sprintf("%s:%s", me, config.InstanceID)
+	}
+
 	return &State{
-		me:                  fmt.Sprintf("%s:%s", hostname, prefix),
-		client:              rc,
-		config:              config,
-		canaryReleaseTagKey: fmt.Sprintf("%s_canary_release_tag", prefix),
-		stableReleaseTagKey: fmt.Sprintf("%s_stable_release_tag", prefix),
-		avoidReleaseTagKey:  fmt.Sprintf("%s_avoid_release_tag", prefix),
-		membersTagKey:       fmt.Sprintf("%s_members_tag", prefix),
-		rolloutKey:          fmt.Sprintf("%s_rollout", prefix),
+		nodeState:            nodeState{config: config},
+		me:                   me,
+		client:               rc,
+		canaryReleaseTagKey:  fmt.Sprintf("%s_canary_release_tag", prefix),
+		stableReleaseTagKey:  fmt.Sprintf("%s_stable_release_tag", prefix),
+		avoidReleaseTagKey:   fmt.Sprintf("%s_avoid_release_tag", prefix),
+		avoidTagExpiryKey:    fmt.Sprintf("%s_avoid_release_tag_expiry", prefix),
+		avoidReasonKey:       fmt.Sprintf("%s_avoid_reason", prefix),
+		membersTagKey:        fmt.Sprintf("%s_members_tag", prefix),
+		rolloutKey:           fmt.Sprintf("%s_rollout", prefix),
+		pendingTagKey:        fmt.Sprintf("%s_pending_release_tag", prefix),
+		rolloutCompleteKey:   fmt.Sprintf("%s_rollout_complete_tag", prefix),
+		promotedTagKey:       fmt.Sprintf("%s_promoted_release_tag", prefix),
+		deployHistoryKey:     fmt.Sprintf("%s_deploy_history", prefix),
+		releaseHistoryKey:    fmt.Sprintf("%s_release_history", prefix),
+		healthAttestationKey: fmt.Sprintf("%s_health_attestation", prefix),
+		rolloutReportKey:     fmt.Sprintf("%s_rollout_report", prefix),
+		rolloutStartKey:      fmt.Sprintf("%s_rollout_start_tag", prefix),
+		rolloutStallKey:      fmt.Sprintf("%s_rollout_stall", prefix),
+		abortCanaryKey:       fmt.Sprintf("%s_abort_canary", prefix),
 	}, nil
 }
 
 func (s *State) UnlockCanaryRelease() error {
-	return s.client.Del(context.Background(), s.canaryReleaseTagKey).Err()
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	if s.cohortTag != "" {
+		tag := s.cohortTag
+		s.cohortTag = ""
+		return s.client.SRem(ctx, s.canaryCohortKey(tag), s.me).Err()
+	}
+	return unlockCanaryReleaseScript.Run(ctx, s.client,
+		[]string{s.canaryReleaseTagKey, s.canaryHolderKey()}, s.me).Err()
+}
+
+// unlockCanaryReleaseScript releases the canary release lock only when this node holds it,
+// so that a late unlock doesn't release the lock another node took over.
+var unlockCanaryReleaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[2]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1], KEYS[2])
+end
+return 0
+`)
+
+func (s *State) UnlockRollout() error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	if s.config.RolloutBatchPercent > 0 {
+		return s.ReleaseRolloutBatch()
+	}
+	if s.config.MaxConcurrentRollout > 1 {
+		return s.client.ZRem(ctx, s.rolloutSlotsKey(), s.me).Err()
+	}
+	return s.client.Del(ctx, s.rolloutKey, s.rolloutHolderKey()).Err()
+}
+
+// ReleaseRolloutBatch removes this node from the rollout batch it was admitted to, so that
+// a failed deploy doesn't keep the place in the batch until the batch state expires.
+func (s *State) ReleaseRolloutBatch() error {
+	if s.rolloutBatchTag == "" {
+		return nil
+	}
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	tag := s.rolloutBatchTag
+	s.rolloutBatchTag = ""
+	return s.client.SRem(ctx, s.rolloutBatchKey(tag), s.me).Err()
+}
+
+// extendLockScript extends the lock and its holder key only when this node holds it.
+var extendLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[2]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// ExtendCanaryReleaseLock extends the canary release lock held by this node to ttl from now,
+// and reports false when the lock is no longer held.
+func (s *State) ExtendCanaryReleaseLock(ttl time.Duration) (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	if s.cohortTag != "" {
+		ok, err := extendCohortScript.Run(ctx, s.client,
+			[]string{s.canaryCohortKey(s.cohortTag)}, s.me, ttl.Milliseconds()).Int()
+		return ok == 1, err
+	}
+	ok, err := extendLockScript.Run(ctx, s.client,
+		[]string{s.canaryReleaseTagKey, s.canaryHolderKey()}, s.me, ttl.Milliseconds()).Int()
+	return ok == 1, err
+}
+
+var extendCohortScript = redis.NewScript(`
+if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+var extendRolloutSlotScript = redis.NewScript(`
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// ExtendRolloutLock extends the rollout lock held by this node to rollout_lock_ttl from now,
+// and reports false when the lock is no longer held. The admission to a rollout batch is not
+// a lease and is always kept.
+func (s *State) ExtendRolloutLock() (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	ttl := RolloutLockTTL(s.config)
+	if s.config.RolloutBatchPercent > 0 {
+		return s.rolloutBatchTag != "", nil
+	}
+	if s.config.MaxConcurrentRollout > 1 {
+		ok, err := extendRolloutSlotScript.Run(ctx, s.client,
+			[]string{s.rolloutSlotsKey()}, s.me, s.now().Add(ttl).UnixMilli()).Int()
+		return ok == 1, err
+	}
+	ok, err := extendLockScript.Run(ctx, s.client,
+		[]string{s.rolloutKey, s.rolloutHolderKey()}, s.me, ttl.Milliseconds()).Int()
+	return ok == 1, err
 }
 
 func (s *State) TryCanaryReleaseLock(tag string) (bool, error) {
-	return s.getLock(s.canaryReleaseTagKey, tag, s.config.CanaryRolloutWindow*2)
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	if s.config.CanaryCohortSize > 1 {
+		return s.joinCanaryCohort(tag)
+	}
+	if s.config.CanaryLockQueue {
+		first, err := s.waitCanaryQueue()
+		if err != nil || !first {
+			return false, err
+		}
+	}
+	got, err := s.getLock(s.canaryReleaseTagKey, tag, CanaryLockLease(s.config))
+	if err != nil || !got {
+		return got, err
+	}
+	if err := s.client.Set(ctx, s.canaryHolderKey(), s.me, CanaryLockLease(s.config)).Err(); err != nil {
+		return false, err
+	}
+	if s.config.CanaryLockQueue {
+		pipe := s.client.TxPipeline()
+		pipe.LRem(ctx, s.canaryQueueKey(), 0, s.me)
+		pipe.ZRem(ctx, s.canaryQueueExpiryKey(), s.me)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// waitCanaryQueueScript keeps the waiters for the canary release lock in a list in the order
+// of their first try, and the expiry of each waiter in a sorted set. A waiter which hasn't
+// tried within the expiry is skipped and goes to the tail when it tries again.
+var waitCanaryQueueScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", ARGV[2])
+if not redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	redis.call("LREM", KEYS[1], 0, ARGV[1])
+	redis.call("RPUSH", KEYS[1], ARGV[1])
+end
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+local head = redis.call("LINDEX", KEYS[1], 0)
+while head and not redis.call("ZSCORE", KEYS[2], head) do
+	redis.call("LPOP", KEYS[1])
+	head = redis.call("LINDEX", KEYS[1], 0)
+end
+redis.call("PEXPIREAT", KEYS[1], ARGV[3])
+redis.call("PEXPIREAT", KEYS[2], ARGV[3])
+if head == ARGV[1] then
+	return 1
+end
+return 0
+`)
+
+// waitCanaryQueue registers this node as a waiter for the canary release lock and reports
+// whether it is the earliest live waiter, which is the only one allowed to take the lock.
+func (s *State) waitCanaryQueue() (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	now := s.now()
+	ok, err := waitCanaryQueueScript.Run(ctx, s.client,
+		[]string{s.canaryQueueKey(), s.canaryQueueExpiryKey()},
+		s.me, now.UnixMilli(), now.Add(CanaryQueueTTL(s.config)).UnixMilli(),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	return ok == 1, nil
+}
+
+// CanaryQueueTTL returns how long a waiter keeps its place in the canary lock queue without
+// trying again, three polls.
+func CanaryQueueTTL(config *Config) time.Duration {
+	return config.RepositryPollingInterval * 3
+}
+
+func (s *State) canaryQueueKey() string {
+	return fmt.Sprintf("%s_queue", s.canaryReleaseTagKey)
+}
+
+func (s *State) canaryQueueExpiryKey() string {
+	return fmt.Sprintf("%s_queue_expiry", s.canaryReleaseTagKey)
+}
+
+// canaryHolderKey keeps the member holding the canary release lock for status.
+func (s *State) canaryHolderKey() string {
+	return fmt.Sprintf("%s_holder", s.canaryReleaseTagKey)
+}
+
+type CanaryLock struct {
+	Tag     string   `json:"tag"`
+	Holders []string `json:"holders"`
+}
+
+// scanKeys returns the keys matching the pattern, from every master in cluster mode.
+func (s *State) scanKeys(match string) ([]string, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	var keys []string
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, match, 0).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		return iter.Err()
+	}
+
+	if cc, ok := s.client.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		err := cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return scan(ctx, c)
+		})
+		return keys, err
+	}
+	return keys, scan(ctx, s.client)
+}
+
+// CanaryReleaseLocks returns the canary releases in progress, one per tag with canary_cohort_size.
+func (s *State) CanaryReleaseLocks() ([]CanaryLock, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	if s.config.CanaryCohortSize > 1 {
+		keys, err := s.scanKeys(s.canaryCohortKey("*"))
+		if err != nil {
+			return nil, err
+		}
+		var locks []CanaryLock
+		for _, key := range keys {
+			holders, err := s.client.SMembers(ctx, key).Result()
+			if err != nil {
+				return nil, err
+			}
+			locks = append(locks, CanaryLock{
+				Tag:     strings.TrimPrefix(key, s.canaryCohortKey("")),
+				Holders: holders,
+			})
+		}
+		return locks, nil
+	}
+
+	tag, err := s.getRelease(s.canaryReleaseTagKey)
+	if err != nil || tag == "" {
+		return nil, err
+	}
+	holder, err := s.getRelease(s.canaryHolderKey())
+	if err != nil {
+		return nil, err
+	}
+	lock := CanaryLock{Tag: tag}
+	if holder != "" {
+		lock.Holders = []string{holder}
+	}
+	return []CanaryLock{lock}, nil
+}
+
+func (s *State) canaryCohortKey(tag string) string {
+	return fmt.Sprintf("%s_cohort:%s", s.canaryReleaseTagKey, tag)
+}
+
+func (s *State) canaryPassedKey(tag string) string {
+	return fmt.Sprintf("%s_passed:%s", s.canaryReleaseTagKey, tag)
+}
+
+var joinCanaryCohortScript = redis.NewScript(`
+if redis.call("SISMEMBER", KEYS[1], ARGV[1]) == 1 then
+	return 1
+end
+if redis.call("SCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("SADD", KEYS[1], ARGV[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// joinCanaryCohort lets up to canary_cohort_size nodes become canaries of the tag.
+func (s *State) joinCanaryCohort(tag string) (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	ok, err := joinCanaryCohortScript.Run(ctx, s.client,
+		[]string{s.canaryCohortKey(tag)},
+		s.me, s.config.CanaryCohortSize, CanaryLockLease(s.config).Milliseconds(),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	if ok == 1 {
+		s.cohortTag = tag
+		return true, nil
+	}
+	return false, nil
+}
+
+// CanaryPassed records that this node passed the health check of the tag, and reports
+// whether the tag can be promoted to stable. With canary_cohort_size, it waits for the
+// whole cohort, capped by the number of live members, to pass.
+func (s *State) CanaryPassed(tag string) (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	if s.config.CanaryCohortSize <= 1 {
+		return true, nil
+	}
+
+	key := s.canaryPassedKey(tag)
+	pipe := s.client.TxPipeline()
+	pipe.SAdd(ctx, key, s.me)
+	pipe.Expire(ctx, key, s.config.CanaryRolloutWindow*2)
+	passed := pipe.SCard(ctx, key)
+	members := pipe.SCard(ctx, s.membersTagKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+
+	need := int64(s.config.CanaryCohortSize)
+	if members.Val() > 0 && members.Val() < need {
+		need = members.Val()
+	}
+	return passed.Val() >= need, nil
 }
 
 func (s *State) TryRolloutLock(tag string) (bool, error) {
-	return s.getLock(s.rolloutKey, tag, s.config.RolloutWindow)
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	if s.config.RolloutBatchPercent > 0 {
+		return s.acquireRolloutBatch(tag)
+	}
+	if s.config.MaxConcurrentRollout > 1 {
+		return s.acquireRolloutSlot()
+	}
+	got, err := s.getLock(s.rolloutKey, tag, RolloutLockTTL(s.config))
+	if err != nil || !got {
+		return got, err
+	}
+	if err := s.client.Set(ctx, s.rolloutHolderKey(), s.me, RolloutLockTTL(s.config)).Err(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rolloutHolderKey keeps the member holding the rollout lock to extend it.
+func (s *State) rolloutHolderKey() string {
+	return fmt.Sprintf("%s_holder", s.rolloutKey)
+}
+
+func (s *State) rolloutBatchStartKey(tag string) string {
+	return fmt.Sprintf("%s_batch_start:%s", s.rolloutKey, tag)
+}
+
+func (s *State) rolloutBatchKey(tag string) string {
+	return fmt.Sprintf("%s_batch:%s", s.rolloutKey, tag)
+}
+
+// the threshold grows by rollout_batch_percent of the members every rollout_window since
+// the first node tried the tag. a node is admitted while neither the admitted nodes nor
+// the installed nodes have reached the threshold.
+var acquireRolloutBatchScript = redis.NewScript(`
+redis.call("SET", KEYS[1], ARGV[2], "NX", "PX", ARGV[7])
+if redis.call("SISMEMBER", KEYS[2], ARGV[1]) == 1 then
+	return 0
+end
+local started = tonumber(redis.call("GET", KEYS[1]))
+local all = tonumber(ARGV[5])
+local size = math.max(1, math.ceil(all * tonumber(ARGV[6]) / 100))
+local batches = math.floor((tonumber(ARGV[2]) - started) / tonumber(ARGV[3])) + 1
+local threshold = math.min(all, size * batches)
+if math.max(redis.call("SCARD", KEYS[2]), tonumber(ARGV[4])) >= threshold then
+	return 0
+end
+redis.call("SADD", KEYS[2], ARGV[1])
+redis.call("PEXPIRE", KEYS[2], ARGV[7])
+return 1
+`)
+
+// acquireRolloutBatch lets the nodes roll out in batches of rollout_batch_percent of
+// the members per rollout_window instead of one node per window.
+func (s *State) acquireRolloutBatch(tag string) (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	installed, all, err := s.GetRolloutProgress(tag)
+	if err != nil {
+		return false, err
+	}
+
+	// keep the batch state until every batch has had its window
+	ttl := s.config.RolloutWindow * time.Duration(100/s.config.RolloutBatchPercent+2)
+	ok, err := acquireRolloutBatchScript.Run(ctx, s.client,
+		[]string{s.rolloutBatchStartKey(tag), s.rolloutBatchKey(tag)},
+		s.me, s.now().UnixMilli(), s.config.RolloutWindow.Milliseconds(), installed, all, s.config.RolloutBatchPercent, ttl.Milliseconds(),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	if ok == 1 {
+		s.rolloutBatchTag = tag
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *State) rolloutSlotsKey() string {
+	return fmt.Sprintf("%s_slots", s.rolloutKey)
+}
+
+// the slots are a sorted set of the holders scored by the expiry in milliseconds
+var acquireRolloutSlotScript = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[4]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// acquireRolloutSlot is a counting semaphore which lets up to max_concurrent_rollout
+// nodes roll out at once. Like the single lock, a slot is held for rollout_window.
+func (s *State) acquireRolloutSlot() (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	now := s.now()
+	ok, err := acquireRolloutSlotScript.Run(ctx, s.client,
+		[]string{s.rolloutSlotsKey()},
+		s.me, now.UnixMilli(), now.Add(RolloutLockTTL(s.config)).UnixMilli(), s.config.MaxConcurrentRollout,
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	return ok == 1, nil
 }
 
 func (s *State) getLock(key string, tag string, window time.Duration) (bool, error) {
-	ok, err := s.client.SetNX(context.Background(), key, tag, 0).Result()
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	ok, err := s.client.SetNX(ctx, key, tag, 0).Result()
 	if err != nil {
 		return false, err
 	}
 	if ok {
-		err := s.client.Expire(context.Background(), key, window).Err()
+		err := s.client.Expire(ctx, key, window).Err()
 		if err != nil {
 			return false, err
 		}
@@ -88,29 +827,204 @@ func (s *State) CurrentStableTag() (string, error) {
 
 var ErrAvoidReleaseTag = errors.New("avoid release tag")
 
+// IsAvoidReleaseTag returns ErrAvoidReleaseTag when the tag is in the avoid tags.
 func (s *State) IsAvoidReleaseTag(tag string) error {
-	return nil
+	ctx, cancel := s.redisContext()
+	defer cancel()
 
+	if tag == "" {
+		return nil
+	}
+	ok, err := s.client.SIsMember(ctx, s.avoidReleaseTagKey, tag).Result()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return ErrAvoidReleaseTag
+	}
+
+	expiry, err := s.client.ZScore(ctx, s.avoidTagExpiryKey, tag).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if int64(expiry) > s.now().UnixMilli() {
+		return ErrAvoidReleaseTag
+	}
+	return nil
 }
 
 func (s *State) saveRelease(key, tag string) error {
-	return s.client.Set(context.Background(), key, tag, 0).Err()
-}
+	ctx, cancel := s.redisContext()
+	defer cancel()
 
-func (s *State) saveReleases(key string, tags ...string) error {
-	return s.client.SAdd(context.Background(), key, tags).Err()
+	return s.client.Set(ctx, key, tag, 0).Err()
 }
 
 func (s *State) SaveStableReleaseTag(tag string) error {
-	return s.saveRelease(s.stableReleaseTagKey, tag)
+	if s.config.DryRun {
+		slog.Info("dry run: skip saving stable tag", "tag", tag)
+		return nil
+	}
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	// the stable tag and its history entry are written together
+	pipe := s.client.TxPipeline()
+	pipe.Set(ctx, s.stableReleaseTagKey, tag, 0)
+	if err := s.pushReleaseHistory(ctx, pipe, tag, ReleaseActionStable, ""); err != nil {
+		return err
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// maxAvoidOutputBytes is the size of the failure output kept in AvoidReason.
+const maxAvoidOutputBytes = 2048
+
+// AvoidReason records why the tag was avoided.
+type AvoidReason struct {
+	Tag       string    `json:"tag"`
+	Host      string    `json:"host"`
+	AvoidedAt time.Time `json:"avoided_at"`
+	Reason    string    `json:"reason"`
+	Output    string    `json:"output,omitempty"`
 }
 
-func (s *State) SaveAvoidReleaseTag(tag string) error {
-	return s.saveReleases(s.avoidReleaseTagKey, tag)
+// newAvoidReason keeps the tail of output, where the error usually is.
+func newAvoidReason(tag, host, reason, output string, now time.Time) *AvoidReason {
+	if len(output) > maxAvoidOutputBytes {
+		output = "..." + output[len(output)-maxAvoidOutputBytes:]
+	}
+	return &AvoidReason{
+		Tag:       tag,
+		Host:      host,
+		AvoidedAt: now.UTC(),
+		Reason:    reason,
+		Output:    output,
+	}
+}
+
+func (s *State) SaveAvoidReleaseTag(tag, reason, output string) error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	if s.config.DryRun {
+		slog.Info("dry run: skip saving avoid tag", "tag", tag)
+		return nil
+	}
+	b, err := json.Marshal(newAvoidReason(tag, s.me, reason, output, s.now()))
+	if err != nil {
+		return err
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, s.avoidReasonKey, tag, b)
+	// the avoid tags with avoid_tag_ttl are kept in a sorted set scored by the expiry in milliseconds
+	if s.config.AvoidTagTTL > 0 {
+		pipe.ZAdd(ctx, s.avoidTagExpiryKey, redis.Z{
+			Score:  float64(s.now().Add(s.config.AvoidTagTTL).UnixMilli()),
+			Member: tag,
+		})
+	} else {
+		pipe.SAdd(ctx, s.avoidReleaseTagKey, tag)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// RemoveAvoidReleaseTag allows the tag to be deployed again.
+func (s *State) RemoveAvoidReleaseTag(tag string) error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	pipe := s.client.TxPipeline()
+	pipe.SRem(ctx, s.avoidReleaseTagKey, tag)
+	pipe.ZRem(ctx, s.avoidTagExpiryKey, tag)
+	pipe.HDel(ctx, s.avoidReasonKey, tag)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// AvoidReasons returns the reasons of the avoid tags by tag. The reasons of the expired
+// avoid tags are removed. A tag avoided by an older version has no reason.
+func (s *State) AvoidReasons() (map[string]*AvoidReason, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	tags, err := s.AvoidReleaseTags()
+	if err != nil {
+		return nil, err
+	}
+	values, err := s.client.HGetAll(ctx, s.avoidReasonKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]*AvoidReason{}
+	var expired []string
+	for tag, v := range values {
+		if !slices.Contains(tags, tag) {
+			expired = append(expired, tag)
+			continue
+		}
+		r := &AvoidReason{}
+		if err := json.Unmarshal([]byte(v), r); err != nil {
+			return nil, err
+		}
+		ret[tag] = r
+	}
+	if len(expired) > 0 {
+		if err := s.client.HDel(ctx, s.avoidReasonKey, expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+var ErrPendingRelease = errors.New("release is pending")
+
+func (s *State) PendingReleaseTag() (string, error) {
+	return s.getRelease(s.pendingTagKey)
+}
+
+func (s *State) SavePendingReleaseTag(tag string) error {
+	return s.saveRelease(s.pendingTagKey, tag)
+}
+
+func (s *State) PromotedReleaseTag() (string, error) {
+	return s.getRelease(s.promotedTagKey)
+}
+
+// PromotePendingReleaseTag allows the pending tag to be deployed and returns it.
+func (s *State) PromotePendingReleaseTag() (string, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	tag, err := s.PendingReleaseTag()
+	if err != nil {
+		return "", err
+	}
+	if tag == "" {
+		return "", errors.New("no pending release tag")
+	}
+
+	pipe := s.client.TxPipeline()
+	pipe.Set(ctx, s.promotedTagKey, tag, 0)
+	pipe.Del(ctx, s.pendingTagKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", err
+	}
+	return tag, nil
 }
 
 func (s *State) getRelease(key string) (string, error) {
-	v, err := s.client.Get(context.Background(), key).Result()
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	v, err := s.client.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return "", nil
 	}
@@ -121,12 +1035,38 @@ func (s *State) getRelease(key string) (string, error) {
 }
 
 func (s *State) getReleases(key string) ([]string, error) {
-	return s.client.SMembers(context.Background(), key).Result()
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	return s.client.SMembers(ctx, key).Result()
+}
+
+var ErrUnconfirmedRelease = errors.New("latest release is not confirmed yet")
+
+// ObserveLatestTag records the latest tag of this poll and returns
+// how many consecutive polls have observed it.
+// now returns the time of the clock of the config, which the callers compare the times with.
+func (s *nodeState) now() time.Time {
+	return ClockOf(s.config).Now()
+}
+
+func (s *nodeState) ObserveLatestTag(tag string) uint {
+	if tag != s.observedTag {
+		s.observedTag = tag
+		s.observedTagCount = 0
+	}
+	s.observedTagCount++
+	return s.observedTagCount
 }
 
 var ErrAlreadyInstalled = errors.New("already installed")
+var ErrDowngrade = errors.New("downgrade is not allowed")
 
 func (s *State) CanInstallTag(tag string) error {
+	return s.canInstallTag(tag, s.IsAvoidReleaseTag)
+}
+
+func (s *nodeState) canInstallTag(tag string, isAvoidReleaseTag func(tag string) error) error {
 	if tag == "" {
 		return errors.New("tag is empty")
 	}
@@ -144,31 +1084,72 @@ func (s *State) CanInstallTag(tag string) error {
 		return ErrAlreadyInstalled
 	}
 
-	tags, err := s.getReleases(s.avoidReleaseTagKey)
-	if err != nil {
+	if err := isAvoidReleaseTag(tag); err != nil {
 		return err
 	}
-	for _, t := range tags {
-		if t == tag {
-			return ErrAvoidReleaseTag
-		}
+
+	if s.config.PreventDowngrade && !s.config.AllowDowngrade && isDowngrade(lastInstalledTag, tag) {
+		return ErrDowngrade
 	}
 
 	return nil
 }
 
-func (s *State) GetLastInstalledTag() (string, error) {
-	out, err := exec.Command("sh", "-c", s.config.VersionCommand).Output()
+// ErrVersionCommand is returned when the version command fails. It is distinct from
+// nothing installed yet, which is reported as an empty tag.
+var ErrVersionCommand = errors.New("version command failed")
+
+// GetLastInstalledTag returns the version reported by the version command, reusing the
+// result for version_cache_ttl.
+func (s *nodeState) GetLastInstalledTag() (string, error) {
+	s.versionMu.Lock()
+	defer s.versionMu.Unlock()
+
+	if !s.versionCachedAt.IsZero() && s.now().Sub(s.versionCachedAt) < s.config.VersionCacheTTL {
+		return s.cachedVersion, nil
+	}
+
+	v, err := installedVersion(s.config.VersionCommand)
 	if err != nil {
 		return "", err
 	}
+	s.cachedVersion = v
+	s.versionCachedAt = s.now()
+	return v, nil
+}
+
+// ForgetInstalledTag drops the cached version so that the next call runs the version
+// command. It is called after the deploy and rollback commands change the installed version.
+func (s *nodeState) ForgetInstalledTag() {
+	s.versionMu.Lock()
+	defer s.versionMu.Unlock()
+	s.versionCachedAt = time.Time{}
+}
+
+func installedVersion(command string) (string, error) {
+	out, err := exec.Command("sh", "-c", command).Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			// the shell exits with 127 when the command is not found, i.e. not installed yet
+			if ee.ExitCode() == 127 {
+				return "", nil
+			}
+			return "", fmt.Errorf("%w: %s %s", ErrVersionCommand, err, strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", fmt.Errorf("%w: %s", ErrVersionCommand, err)
+	}
 	return strings.TrimRight(strings.TrimSpace(string(out)), "\n"), nil
 }
 
 func (s *State) RollbackTag(beforeInstall string) (string, error) {
+	return rollbackTag(beforeInstall, s.CurrentStableTag)
+}
+
+func rollbackTag(beforeInstall string, currentStableTag func() (string, error)) (string, error) {
 	rollbackTag := beforeInstall
 	if beforeInstall == "" {
-		stableRelease, err := s.CurrentStableTag()
+		stableRelease, err := currentStableTag()
 		if err != nil {
 			return "", err
 		}
@@ -186,11 +1167,40 @@ type MemberState struct {
 	CurrentVersion string
 }
 
+const UnknownVersion = "unknown"
+
+// reportedVersion returns the installed version for the member state.
+// A failure of the version command is tolerated with the last successful version
+// (or "unknown") until it fails version_command_failure_threshold times in a row.
+func (s *nodeState) reportedVersion() (string, error) {
+	v, err := s.GetLastInstalledTag()
+	if err == nil {
+		s.lastVersion = v
+		s.versionFailureCount = 0
+		return v, nil
+	}
+
+	s.versionFailureCount++
+	if s.versionFailureCount >= s.config.VersionCommandFailureThreshold {
+		return "", fmt.Errorf("version command failed %d times in a row: %w", s.versionFailureCount, err)
+	}
+
+	v = s.lastVersion
+	if v == "" {
+		v = UnknownVersion
+	}
+	slog.Warn("version command failed, report the last known version", "version", v, "failures", s.versionFailureCount, "err", err)
+	return v, nil
+}
+
 func (s *State) SaveMemberState() error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
 	pipe := s.client.Pipeline()
 
-	pipe.SAdd(context.Background(), s.membersTagKey, s.me).Err()
-	currentVersion, err := s.GetLastInstalledTag()
+	pipe.SAdd(ctx, s.membersTagKey, s.me).Err()
+	currentVersion, err := s.reportedVersion()
 	if err != nil {
 		return err
 	}
@@ -203,20 +1213,23 @@ func (s *State) SaveMemberState() error {
 	if err != nil {
 		return err
 	}
-	pipe.SetEx(context.Background(), s.me, b, s.config.RolloutWindow*2)
-	if _, err := pipe.Exec(context.Background()); err != nil {
+	pipe.SetEx(ctx, s.me, b, s.config.RolloutWindow*2)
+	if _, err := pipe.Exec(ctx); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (s *State) GetRolloutProgress(tag string) (int, int, error) {
-	members := s.client.SMembers(context.Background(), s.membersTagKey).Val()
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	members := s.client.SMembers(ctx, s.membersTagKey).Val()
 	all := len(members)
 	deletedMembers := make([]string, 0, all)
 	installed := 0
 	for _, m := range members {
-		b, err := s.client.Get(context.Background(), m).Bytes()
+		b, err := s.client.Get(ctx, m).Bytes()
 		if err != nil {
 			if err == redis.Nil {
 				deletedMembers = append(deletedMembers, m)
@@ -233,9 +1246,452 @@ func (s *State) GetRolloutProgress(tag string) (int, int, error) {
 		}
 	}
 	if len(deletedMembers) > 0 {
-		if err := s.client.SRem(context.Background(), s.membersTagKey, deletedMembers).Err(); err != nil {
+		if err := s.client.SRem(ctx, s.membersTagKey, deletedMembers).Err(); err != nil {
 			return 0, 0, err
 		}
 	}
 	return installed, all, nil
 }
+
+// MemberStates returns the state of the live members.
+func (s *State) MemberStates() (map[string]*MemberState, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	members, err := s.client.SMembers(ctx, s.membersTagKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	states := map[string]*MemberState{}
+	for _, m := range members {
+		b, err := s.client.Get(ctx, m).Bytes()
+		if err != nil {
+			if err == redis.Nil {
+				continue
+			}
+			return nil, err
+		}
+		ms := &MemberState{}
+		if err := json.Unmarshal(b, ms); err != nil {
+			return nil, err
+		}
+		states[m] = ms
+	}
+	return states, nil
+}
+
+// VersionDistribution returns the number of live members per installed version.
+func (s *State) VersionDistribution() (map[string]int, error) {
+	states, err := s.MemberStates()
+	if err != nil {
+		return nil, err
+	}
+	return versionDistribution(states), nil
+}
+
+func versionDistribution(states map[string]*MemberState) map[string]int {
+	versions := map[string]int{}
+	for _, ms := range states {
+		versions[ms.CurrentVersion]++
+	}
+	return versions
+}
+
+func (s *State) AvoidReleaseTags() ([]string, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	now := strconv.FormatInt(s.now().UnixMilli(), 10)
+	pipe := s.client.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, s.avoidTagExpiryKey, "-inf", now)
+	expiring := pipe.ZRange(ctx, s.avoidTagExpiryKey, 0, -1)
+	tags := pipe.SMembers(ctx, s.avoidReleaseTagKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	ret := tags.Val()
+	for _, t := range expiring.Val() {
+		if !slices.Contains(ret, t) {
+			ret = append(ret, t)
+		}
+	}
+	return ret, nil
+}
+
+// MarkRolloutComplete records the tag as rollout completed.
+// It returns true only for the first caller for the tag.
+func (s *State) MarkRolloutComplete(tag string) (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	old, err := s.client.GetSet(ctx, s.rolloutCompleteKey, tag).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	return old != tag, nil
+}
+
+// MarkRolloutStarted records the tag as rollout started.
+// It returns true only for the first caller for the tag.
+func (s *State) MarkRolloutStarted(tag string) (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	old, err := s.client.GetSet(ctx, s.rolloutStartKey, tag).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	return old != tag, nil
+}
+
+// MarkRolloutStalled records that the rollout of the tag stalled at installed nodes.
+// It returns true only for the first caller for the tag and the progress.
+func (s *State) MarkRolloutStalled(tag string, installed int) (bool, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	mark := fmt.Sprintf("%s:%d", tag, installed)
+	old, err := s.client.GetSet(ctx, s.rolloutStallKey, mark).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	return old != mark, nil
+}
+
+type CheckResult struct {
+	Operation string
+	Err       error
+}
+
+// CheckOperations runs the redis operations which State relies on against a temporary key.
+func (s *State) CheckOperations() []CheckResult {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+	key := fmt.Sprintf("%s_check", s.me)
+	setKey := fmt.Sprintf("%s_check_set", s.me)
+	defer s.client.Del(ctx, key, setKey)
+
+	checks := []struct {
+		operation string
+		f         func() error
+	}{
+		{"PING", func() error { return s.client.Ping(ctx).Err() }},
+		{"SETNX", func() error { return s.client.SetNX(ctx, key, "check", 0).Err() }},
+		{"EXPIRE", func() error { return s.client.Expire(ctx, key, time.Minute).Err() }},
+		{"GET", func() error { return s.client.Get(ctx, key).Err() }},
+		{"SET", func() error { return s.client.Set(ctx, key, "check", time.Minute).Err() }},
+		{"GETSET", func() error { return s.client.GetSet(ctx, key, "check").Err() }},
+		{"SETEX", func() error { return s.client.SetEx(ctx, key, "check", time.Minute).Err() }},
+		{"SADD", func() error { return s.client.SAdd(ctx, setKey, "check").Err() }},
+		{"SMEMBERS", func() error { return s.client.SMembers(ctx, setKey).Err() }},
+		{"SREM", func() error { return s.client.SRem(ctx, setKey, "check").Err() }},
+		{"MULTI/EXEC", func() error {
+			pipe := s.client.TxPipeline()
+			pipe.Set(ctx, key, "check", time.Minute)
+			pipe.Del(ctx, key)
+			_, err := pipe.Exec(ctx)
+			return err
+		}},
+		{"DEL", func() error { return s.client.Del(ctx, key).Err() }},
+	}
+
+	results := make([]CheckResult, 0, len(checks))
+	for _, c := range checks {
+		results = append(results, CheckResult{Operation: c.operation, Err: c.f()})
+	}
+	return results
+}
+
+var ErrHeld = errors.New("this node is held on failed release")
+
+func (s *State) holdKey() string {
+	return fmt.Sprintf("%s_hold", s.me)
+}
+
+// HoldMember stops canary release and rollout on this node until ClearHold is called.
+func (s *State) HoldMember(tag string) error {
+	return s.saveRelease(s.holdKey(), tag)
+}
+
+func (s *State) HeldTag() (string, error) {
+	return s.getRelease(s.holdKey())
+}
+
+func (s *State) ClearHold() error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	return s.client.Del(ctx, s.holdKey()).Err()
+}
+
+var ErrCanaryAborted = errors.New("canary release is aborted")
+
+// AbortCanaryRelease asks the canary nodes running tag to fail the health check and roll back.
+// The request expires after canary_lock_ttl.
+func (s *State) AbortCanaryRelease(tag string) error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	return s.client.Set(ctx, s.abortCanaryKey, tag, CanaryLockTTL(s.config)).Err()
+}
+
+func (s *State) CanaryAbortedTag() (string, error) {
+	return s.getRelease(s.abortCanaryKey)
+}
+
+var ErrDeployBackoff = errors.New("deploy is backing off after failures")
+
+// DeployFailure is the consecutive deploy failures of this node on Tag.
+type DeployFailure struct {
+	Tag      string    `json:"tag"`
+	Count    uint      `json:"count"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// next returns the failure following f on tag. The count restarts for another tag.
+func (f *DeployFailure) next(tag string, now time.Time) *DeployFailure {
+	ret := &DeployFailure{Tag: tag, Count: 1, FailedAt: now.UTC()}
+	if f != nil && f.Tag == tag {
+		ret.Count = f.Count + 1
+	}
+	return ret
+}
+
+// DeployBackoff returns the wait before deploying the tag again after count consecutive failures.
+// It starts at repository_polling_interval and doubles up to deploy_backoff_max.
+func DeployBackoff(config *Config, count uint) time.Duration {
+	if config.DeployBackoffMax <= 0 || count == 0 {
+		return 0
+	}
+	d := config.RepositryPollingInterval
+	for i := uint(1); i < count && d < config.DeployBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, config.DeployBackoffMax)
+}
+
+func (s *State) deployFailureKey() string {
+	return fmt.Sprintf("%s_deploy_failure", s.me)
+}
+
+// SaveDeployFailure counts up the deploy failures of this node on tag.
+func (s *State) SaveDeployFailure(tag string) (*DeployFailure, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	f, err := s.DeployFailure()
+	if err != nil {
+		return nil, err
+	}
+	f = f.next(tag, s.now())
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.client.Set(ctx, s.deployFailureKey(), b, 0).Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// DeployFailure returns the last deploy failures of this node, or nil if the last deploy succeeded.
+func (s *State) DeployFailure() (*DeployFailure, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	b, err := s.client.Get(ctx, s.deployFailureKey()).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := &DeployFailure{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *State) ClearDeployFailure() error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	return s.client.Del(ctx, s.deployFailureKey()).Err()
+}
+
+var ErrDeployInterrupted = errors.New("deploy of this node was interrupted")
+
+// DeployProgress is the canary release of Tag which this node is running. It outlives the
+// process so that a restart doesn't deploy Tag again, and expires after canary_lock_ttl.
+type DeployProgress struct {
+	Tag         string    `json:"tag"`
+	PreviousTag string    `json:"previous_tag"`
+	File        string    `json:"file"`
+	Host        string    `json:"host"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func (s *State) deployProgressKey() string {
+	return fmt.Sprintf("%s_deploy_progress", s.me)
+}
+
+// SaveDeployProgress records that this node deploys tag over previousTag. It is saved again
+// with the asset file once the deploy command finishes.
+func (s *State) SaveDeployProgress(tag, previousTag, file string) error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	ttl := CanaryLockTTL(s.config)
+	b, err := json.Marshal(&DeployProgress{
+		Tag:         tag,
+		PreviousTag: previousTag,
+		File:        file,
+		Host:        s.me,
+		ExpiresAt:   s.now().Add(ttl).UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.deployProgressKey(), b, ttl).Err()
+}
+
+// DeployProgress returns the deploy left in progress by this node, or nil if there is none.
+func (s *State) DeployProgress() (*DeployProgress, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	b, err := s.client.Get(ctx, s.deployProgressKey()).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &DeployProgress{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *State) ClearDeployProgress() error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	return s.client.Del(ctx, s.deployProgressKey()).Err()
+}
+
+type HealthAttestation struct {
+	Tag        string    `json:"tag"`
+	Host       string    `json:"host"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// SaveHealthAttestation publishes that this node verified tag healthy.
+// It expires after trust_peer_health.
+func (s *State) SaveHealthAttestation(tag string) error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	b, err := json.Marshal(&HealthAttestation{
+		Tag:        tag,
+		Host:       s.me,
+		VerifiedAt: s.now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.healthAttestationKey, b, s.config.TrustPeerHealth).Err()
+}
+
+// HealthAttestation returns the fresh attestation for tag, or nil if there is none.
+func (s *State) HealthAttestation(tag string) (*HealthAttestation, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	b, err := s.client.Get(ctx, s.healthAttestationKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a := &HealthAttestation{}
+	if err := json.Unmarshal(b, a); err != nil {
+		return nil, err
+	}
+	if a.Tag != tag || s.now().Sub(a.VerifiedAt) > s.config.TrustPeerHealth {
+		return nil, nil
+	}
+	return a, nil
+}
+
+type RolloutReport struct {
+	Tag       string
+	StartedAt time.Time
+	Rollbacks int
+}
+
+// StartRolloutReport starts recording the rollout of tag for the summary at its completion.
+func (s *State) StartRolloutReport(tag string) error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	pipe := s.client.TxPipeline()
+	pipe.Del(ctx, s.rolloutReportKey)
+	pipe.HSet(ctx, s.rolloutReportKey,
+		"tag", tag,
+		"started_at", s.now().UTC().Format(time.RFC3339),
+		"rollbacks", 0,
+	)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// CountRolloutRollback counts a rollback of a node during the rollout of tag.
+func (s *State) CountRolloutRollback(tag string) error {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	current, err := s.client.HGet(ctx, s.rolloutReportKey, "tag").Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current != tag {
+		return nil
+	}
+	return s.client.HIncrBy(ctx, s.rolloutReportKey, "rollbacks", 1).Err()
+}
+
+// RolloutReport returns the report of the rollout of tag, or nil if it was not recorded.
+func (s *State) RolloutReport(tag string) (*RolloutReport, error) {
+	ctx, cancel := s.redisContext()
+	defer cancel()
+
+	v, err := s.client.HGetAll(ctx, s.rolloutReportKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if v["tag"] != tag {
+		return nil, nil
+	}
+
+	r := &RolloutReport{Tag: tag}
+	if r.StartedAt, err = time.Parse(time.RFC3339, v["started_at"]); err != nil {
+		return nil, fmt.Errorf("can't parse rollout start time:%s", err)
+	}
+	if r.Rollbacks, err = strconv.Atoi(v["rollbacks"]); err != nil {
+		return nil, fmt.Errorf("can't parse rollout rollbacks:%s", err)
+	}
+	return r, nil
+}
@@ -3,11 +3,16 @@ package lib
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pyama86/git-assets-canary-releaser/testutils"
+	"github.com/redis/go-redis/v9"
 	"github.com/tj/assert"
 )
 
@@ -74,3 +79,1000 @@ func TestGetRolloutProgress(t *testing.T) {
 	assert.Equal(t, 0, installed)
 	assert.Equal(t, 1, all)
 }
+
+func TestCanInstallTagDowngrade(t *testing.T) {
+	config := newTestConfig()
+	config.VersionCommand = "echo v1.2.0"
+	config.PreventDowngrade = true
+	state, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+
+	assert.Equal(t, ErrDowngrade, state.CanInstallTag("v1.1.9"))
+	assert.NoError(t, state.CanInstallTag("v1.3.0"))
+	assert.NoError(t, state.CanInstallTag("nightly"))
+
+	config.AllowDowngrade = true
+	assert.NoError(t, state.CanInstallTag("v1.1.9"))
+}
+
+func TestNewStateInstanceID(t *testing.T) {
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+
+	config := newTestConfig()
+	state, err := NewState(config)
+	assert.NoError(t, err)
+	assert.Equal(t, hostname+":test_prefix", state.me)
+
+	config.InstanceID = "container-1"
+	state, err = NewState(config)
+	assert.NoError(t, err)
+	assert.Equal(t, hostname+":test_prefix:container-1", state.me)
+}
+
+func TestPromotePendingReleaseTag(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	redisClient := testutils.RedisClient()
+	redisClient.Del(context.Background(), state.pendingTagKey, state.promotedTagKey)
+
+	_, err = state.PromotePendingReleaseTag()
+	assert.Error(t, err)
+
+	assert.NoError(t, state.SavePendingReleaseTag("v1.1.0"))
+	tag, err := state.PromotePendingReleaseTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+
+	promoted, err := state.PromotedReleaseTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", promoted)
+
+	pending, err := state.PendingReleaseTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "", pending)
+}
+
+func TestMarkRolloutComplete(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	testutils.RedisClient().Del(context.Background(), state.rolloutCompleteKey)
+
+	first, err := state.MarkRolloutComplete("v1.0.0")
+	assert.NoError(t, err)
+	assert.True(t, first)
+
+	first, err = state.MarkRolloutComplete("v1.0.0")
+	assert.NoError(t, err)
+	assert.False(t, first)
+
+	first, err = state.MarkRolloutComplete("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, first)
+}
+
+func TestCheckOperations(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+
+	for _, r := range state.CheckOperations() {
+		assert.NoError(t, r.Err, r.Operation)
+	}
+}
+
+func TestHoldMember(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+
+	assert.NoError(t, state.HoldMember("v1.1.0"))
+	tag, err := state.HeldTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+
+	assert.NoError(t, state.ClearHold())
+	tag, err = state.HeldTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "", tag)
+}
+
+func TestAvoidReasons(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	config := newTestConfig()
+	state, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), "test_prefix_avoid_release_tag", "test_prefix_avoid_release_tag_expiry", "test_prefix_avoid_reason")
+	})
+
+	output := strings.Repeat("a", maxAvoidOutputBytes) + "error"
+	assert.NoError(t, state.SaveAvoidReleaseTag("v1.0.0", "health check failed", output))
+	config.AvoidTagTTL = time.Millisecond
+	assert.NoError(t, state.SaveAvoidReleaseTag("v1.0.1", "deploy command failed", ""))
+	time.Sleep(10 * time.Millisecond)
+
+	reasons, err := state.AvoidReasons()
+	assert.NoError(t, err)
+	assert.Len(t, reasons, 1)
+	r := reasons["v1.0.0"]
+	if r == nil {
+		t.Fatal("no avoid reason of v1.0.0")
+	}
+	assert.Equal(t, "v1.0.0", r.Tag)
+	assert.Equal(t, "health check failed", r.Reason)
+	assert.True(t, strings.HasSuffix(r.Output, "error"))
+	assert.Equal(t, maxAvoidOutputBytes+len("..."), len(r.Output))
+	assert.NotEmpty(t, r.Host)
+	assert.False(t, r.AvoidedAt.IsZero())
+
+	// the reason of the expired tag is removed
+	exists, err := redisClient.HExists(context.Background(), "test_prefix_avoid_reason", "v1.0.1").Result()
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.NoError(t, state.RemoveAvoidReleaseTag("v1.0.0"))
+	reasons, err = state.AvoidReasons()
+	assert.NoError(t, err)
+	assert.Empty(t, reasons)
+}
+
+func TestDeployFailure(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	t.Cleanup(func() {
+		state.ClearDeployFailure()
+	})
+
+	f, err := state.DeployFailure()
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+
+	_, err = state.SaveDeployFailure("v1.0.0")
+	assert.NoError(t, err)
+	f, err = state.SaveDeployFailure("v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, uint(2), f.Count)
+
+	// the count restarts for a newer tag
+	_, err = state.SaveDeployFailure("v1.1.0")
+	assert.NoError(t, err)
+	f, err = state.DeployFailure()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", f.Tag)
+	assert.Equal(t, uint(1), f.Count)
+
+	assert.NoError(t, state.ClearDeployFailure())
+	f, err = state.DeployFailure()
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+}
+
+func TestDeployProgress(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	t.Cleanup(func() {
+		state.ClearDeployProgress()
+	})
+
+	p, err := state.DeployProgress()
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	assert.NoError(t, state.SaveDeployProgress("v1.1.0", "v1.0.0", ""))
+	assert.NoError(t, state.SaveDeployProgress("v1.1.0", "v1.0.0", "/tmp/app-v1.1.0.tar.gz"))
+	p, err = state.DeployProgress()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", p.Tag)
+	assert.Equal(t, "v1.0.0", p.PreviousTag)
+	assert.Equal(t, "/tmp/app-v1.1.0.tar.gz", p.File)
+	assert.True(t, p.ExpiresAt.After(time.Now()))
+
+	assert.NoError(t, state.ClearDeployProgress())
+	p, err = state.DeployProgress()
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+}
+
+func TestDeployBackoff(t *testing.T) {
+	config := &Config{RepositryPollingInterval: time.Minute}
+	assert.Equal(t, time.Duration(0), DeployBackoff(config, 3))
+
+	config.DeployBackoffMax = 10 * time.Minute
+	assert.Equal(t, time.Duration(0), DeployBackoff(config, 0))
+	assert.Equal(t, time.Minute, DeployBackoff(config, 1))
+	assert.Equal(t, 2*time.Minute, DeployBackoff(config, 2))
+	assert.Equal(t, 8*time.Minute, DeployBackoff(config, 4))
+	assert.Equal(t, 10*time.Minute, DeployBackoff(config, 5))
+	assert.Equal(t, 10*time.Minute, DeployBackoff(config, 100))
+}
+
+func TestAbortCanaryRelease(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), "test_prefix_abort_canary")
+	})
+
+	tag, err := state.CanaryAbortedTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "", tag)
+
+	assert.NoError(t, state.AbortCanaryRelease("v1.1.0"))
+	tag, err = state.CanaryAbortedTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+
+	ttl, err := redisClient.TTL(context.Background(), "test_prefix_abort_canary").Result()
+	assert.NoError(t, err)
+	assert.True(t, ttl > 0)
+}
+
+func TestDeployRecord(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	config := newTestConfig()
+	config.DeployRecordKey = "secret"
+	state, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	redisClient.Del(context.Background(), "test_prefix_deploy_history")
+
+	assert.NoError(t, state.SaveDeployRecord("v1.0.0"))
+	assert.NoError(t, state.SaveDeployRecord("v1.1.0"))
+
+	records, err := state.DeployHistory()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "v1.1.0", records[0].Tag)
+	assert.NoError(t, records[0].Verify("secret"))
+	assert.True(t, errors.Is(records[0].Verify("other"), ErrInvalidSignature))
+
+	forged := records[1]
+	forged.Tag = "v0.9.0"
+	assert.True(t, errors.Is(forged.Verify("secret"), ErrInvalidSignature))
+}
+
+func TestHealthAttestation(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	config := newTestConfig()
+	config.TrustPeerHealth = time.Minute
+	clock := &stepClock{now: time.Now()}
+	config.Clock = clock
+	state, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	redisClient.Del(context.Background(), "test_prefix_health_attestation")
+
+	a, err := state.HealthAttestation("v1.1.0")
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+
+	assert.NoError(t, state.SaveHealthAttestation("v1.1.0"))
+	a, err = state.HealthAttestation("v1.1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", a.Tag)
+
+	a, err = state.HealthAttestation("v1.2.0")
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+
+	// the attestation goes stale after trust_peer_health
+	clock.step(config.TrustPeerHealth + time.Second)
+	a, err = state.HealthAttestation("v1.1.0")
+	assert.NoError(t, err)
+	assert.Nil(t, a)
+}
+
+func TestSaveMemberStateVersionFailure(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	config := newTestConfig()
+	config.VersionCommandFailureThreshold = 2
+	state, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+
+	assert.NoError(t, state.SaveMemberState())
+
+	config.VersionCommand = "exit 1"
+	assert.NoError(t, state.SaveMemberState())
+	b, err := redisClient.Get(context.Background(), state.me).Bytes()
+	assert.NoError(t, err)
+	ms := &MemberState{}
+	assert.NoError(t, json.Unmarshal(b, ms))
+	assert.Equal(t, "v1.0.0", ms.CurrentVersion)
+
+	assert.Error(t, state.SaveMemberState())
+
+	config.VersionCommand = "echo v1.1.0"
+	assert.NoError(t, state.SaveMemberState())
+}
+
+func TestGetLastInstalledTag(t *testing.T) {
+	clock := &stepClock{now: time.Now()}
+	config := &Config{VersionCommand: "echo v1.0.0", VersionCacheTTL: time.Minute, Clock: clock}
+	s := &nodeState{config: config}
+
+	tag, err := s.GetLastInstalledTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+
+	// the cached version is returned until it is forgotten
+	config.VersionCommand = "echo v1.1.0"
+	tag, err = s.GetLastInstalledTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.0.0", tag)
+
+	s.ForgetInstalledTag()
+	tag, err = s.GetLastInstalledTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+
+	// or until version_cache_ttl passes
+	config.VersionCommand = "echo v1.2.0"
+	clock.step(config.VersionCacheTTL - time.Second)
+	tag, err = s.GetLastInstalledTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+	clock.step(time.Second)
+	tag, err = s.GetLastInstalledTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.2.0", tag)
+
+	// a failure is not cached
+	config.VersionCacheTTL = 0
+	config.VersionCommand = "echo broken >&2; exit 1"
+	_, err = s.GetLastInstalledTag()
+	assert.True(t, errors.Is(err, ErrVersionCommand))
+	assert.Contains(t, err.Error(), "broken")
+
+	// nothing is installed yet when the command is not found
+	config.VersionCommand = "not-installed-app --version"
+	tag, err = s.GetLastInstalledTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "", tag)
+}
+
+func TestObserveLatestTag(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+
+	assert.Equal(t, uint(1), state.ObserveLatestTag("v1.1.0"))
+	assert.Equal(t, uint(2), state.ObserveLatestTag("v1.1.0"))
+	assert.Equal(t, uint(1), state.ObserveLatestTag("v1.2.0"))
+	assert.Equal(t, uint(1), state.ObserveLatestTag("v1.1.0"))
+}
+
+func TestRolloutReport(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+
+	assert.NoError(t, state.StartRolloutReport("v1.1.0"))
+	assert.NoError(t, state.CountRolloutRollback("v1.1.0"))
+	assert.NoError(t, state.CountRolloutRollback("v1.0.0"))
+
+	r, err := state.RolloutReport("v1.1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, r.Rollbacks)
+	assert.True(t, time.Since(r.StartedAt) < time.Minute)
+
+	r, err = state.RolloutReport("v1.0.0")
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	// the error of redis is not taken for the rollout of another tag
+	assert.NoError(t, state.client.Close())
+	assert.Error(t, state.CountRolloutRollback("v1.1.0"))
+}
+
+func TestCanaryCohort(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	config := newTestConfig()
+	config.CanaryCohortSize = 2
+	redisClient.Del(context.Background(),
+		"test_prefix_canary_release_tag_cohort:v1.1.0",
+		"test_prefix_canary_release_tag_passed:v1.1.0",
+		"test_prefix_members_tag",
+	)
+
+	states := make([]*State, 3)
+	for i := range states {
+		state, err := NewState(config)
+		if err != nil {
+			t.Fatalf("failed to setup test: %v", err)
+		}
+		state.me = fmt.Sprintf("host%d", i)
+		redisClient.SAdd(context.Background(), "test_prefix_members_tag", state.me)
+		states[i] = state
+	}
+
+	for i, want := range []bool{true, true, false} {
+		got, err := states[i].TryCanaryReleaseLock("v1.1.0")
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	promote, err := states[0].CanaryPassed("v1.1.0")
+	assert.NoError(t, err)
+	assert.False(t, promote)
+
+	promote, err = states[1].CanaryPassed("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, promote)
+
+	assert.NoError(t, states[1].UnlockCanaryRelease())
+	got, err := states[2].TryCanaryReleaseLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+}
+
+func TestMarkRolloutStarted(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	redisClient.Del(context.Background(), "test_prefix_rollout_start_tag")
+
+	first, err := state.MarkRolloutStarted("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, first)
+
+	first, err = state.MarkRolloutStarted("v1.1.0")
+	assert.NoError(t, err)
+	assert.False(t, first)
+}
+
+func TestMarkRolloutStalled(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	redisClient.Del(context.Background(), "test_prefix_rollout_stall")
+
+	first, err := state.MarkRolloutStalled("v1.1.0", 1)
+	assert.NoError(t, err)
+	assert.True(t, first)
+
+	first, err = state.MarkRolloutStalled("v1.1.0", 1)
+	assert.NoError(t, err)
+	assert.False(t, first)
+
+	first, err = state.MarkRolloutStalled("v1.1.0", 2)
+	assert.NoError(t, err)
+	assert.True(t, first)
+}
+
+func TestTryRolloutLockConcurrent(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	config := newTestConfig()
+	config.MaxConcurrentRollout = 2
+	redisClient.Del(context.Background(), "test_prefix_rollout_slots")
+
+	states := make([]*State, 3)
+	for i := range states {
+		state, err := NewState(config)
+		if err != nil {
+			t.Fatalf("failed to setup test: %v", err)
+		}
+		state.me = fmt.Sprintf("host%d", i)
+		states[i] = state
+	}
+
+	for i, want := range []bool{true, true, false} {
+		got, err := states[i].TryRolloutLock("v1.1.0")
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	assert.NoError(t, states[0].UnlockRollout())
+	got, err := states[2].TryRolloutLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+}
+
+func TestVersionDistribution(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisClient.Del(context.Background(), "test_prefix_members_tag")
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	assert.NoError(t, state.SaveMemberState())
+
+	b, _ := json.Marshal(&MemberState{CurrentVersion: "v0.9.0"})
+	redisClient.Set(context.Background(), "other", b, time.Minute)
+	redisClient.SAdd(context.Background(), "test_prefix_members_tag", "other", "gone")
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), "other", "test_prefix_members_tag")
+	})
+
+	versions, err := state.VersionDistribution()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"v1.0.0": 1, "v0.9.0": 1}, versions)
+}
+
+func TestCanaryReleaseLocks(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisClient.Del(context.Background(), "test_prefix_canary_release_tag", "test_prefix_canary_release_tag_holder")
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	state.me = "host0"
+
+	locks, err := state.CanaryReleaseLocks()
+	assert.NoError(t, err)
+	assert.Empty(t, locks)
+
+	got, err := state.TryCanaryReleaseLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+
+	locks, err = state.CanaryReleaseLocks()
+	assert.NoError(t, err)
+	assert.Equal(t, []CanaryLock{{Tag: "v1.1.0", Holders: []string{"host0"}}}, locks)
+
+	assert.NoError(t, state.UnlockCanaryRelease())
+	locks, err = state.CanaryReleaseLocks()
+	assert.NoError(t, err)
+	assert.Empty(t, locks)
+
+	config := newTestConfig()
+	config.CanaryCohortSize = 2
+	redisClient.Del(context.Background(), "test_prefix_canary_release_tag_cohort:v1.2.0")
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), "test_prefix_canary_release_tag_cohort:v1.2.0")
+	})
+	cohort, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	cohort.me = "host1"
+	got, err = cohort.TryCanaryReleaseLock("v1.2.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+
+	locks, err = cohort.CanaryReleaseLocks()
+	assert.NoError(t, err)
+	assert.Contains(t, locks, CanaryLock{Tag: "v1.2.0", Holders: []string{"host1"}})
+}
+
+func TestUnlockCanaryReleaseOtherHolder(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisClient.Del(context.Background(), "test_prefix_canary_release_tag", "test_prefix_canary_release_tag_holder")
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), "test_prefix_canary_release_tag", "test_prefix_canary_release_tag_holder")
+	})
+
+	holder, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	holder.me = "host0"
+	other, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	other.me = "host1"
+
+	got, err := holder.TryCanaryReleaseLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+
+	assert.NoError(t, other.UnlockCanaryRelease())
+	tag, err := redisClient.Get(context.Background(), "test_prefix_canary_release_tag").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.1.0", tag)
+
+	assert.NoError(t, holder.UnlockCanaryRelease())
+	assert.Equal(t, int64(0), redisClient.Exists(context.Background(), "test_prefix_canary_release_tag").Val())
+}
+
+func TestCanaryLockQueue(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	keys := []string{
+		"test_prefix_canary_release_tag",
+		"test_prefix_canary_release_tag_holder",
+		"test_prefix_canary_release_tag_queue",
+		"test_prefix_canary_release_tag_queue_expiry",
+	}
+	redisClient.Del(context.Background(), keys...)
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), keys...)
+	})
+
+	config := newTestConfig()
+	config.CanaryLockQueue = true
+	config.RepositryPollingInterval = time.Minute
+	states := make([]*State, 4)
+	for i := range states {
+		s, err := NewState(config)
+		if err != nil {
+			t.Fatalf("failed to setup test: %v", err)
+		}
+		s.me = fmt.Sprintf("host%d", i)
+		states[i] = s
+	}
+	try := func(i int) bool {
+		got, err := states[i].TryCanaryReleaseLock("v1.1.0")
+		assert.NoError(t, err)
+		return got
+	}
+
+	assert.True(t, try(0))
+	assert.False(t, try(1))
+	assert.False(t, try(2))
+
+	// host1 waits longer than host2 and gets the lock first
+	assert.NoError(t, states[0].UnlockCanaryRelease())
+	assert.False(t, try(2))
+	assert.True(t, try(1))
+	assert.NoError(t, states[1].UnlockCanaryRelease())
+
+	// the crashed waiter is skipped
+	assert.False(t, try(3))
+	redisClient.ZRem(context.Background(), "test_prefix_canary_release_tag_queue_expiry", "host2")
+	assert.True(t, try(3))
+	queue, err := redisClient.LRange(context.Background(), "test_prefix_canary_release_tag_queue", 0, -1).Result()
+	assert.NoError(t, err)
+	assert.Empty(t, queue)
+}
+
+// stepClock is a Clock whose Now moves only by step.
+type stepClock struct {
+	RealClock
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	return c.now
+}
+
+func (c *stepClock) step(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestTryRolloutLockBatch(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	config := newTestConfig()
+	config.RolloutBatchPercent = 50
+	clock := &stepClock{now: time.Now()}
+	config.Clock = clock
+	redisClient.Del(context.Background(),
+		"test_prefix_members_tag",
+		"test_prefix_rollout_batch_start:v1.1.0",
+		"test_prefix_rollout_batch:v1.1.0",
+	)
+
+	states := make([]*State, 4)
+	b, _ := json.Marshal(&MemberState{CurrentVersion: "v1.0.0"})
+	for i := range states {
+		state, err := NewState(config)
+		if err != nil {
+			t.Fatalf("failed to setup test: %v", err)
+		}
+		state.me = fmt.Sprintf("host%d", i)
+		redisClient.Set(context.Background(), state.me, b, time.Minute)
+		redisClient.SAdd(context.Background(), "test_prefix_members_tag", state.me)
+		states[i] = state
+	}
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), "host0", "host1", "host2", "host3", "test_prefix_members_tag")
+	})
+
+	// the first batch is 2 of 4 members
+	for i, want := range []bool{true, true, false} {
+		got, err := states[i].TryRolloutLock("v1.1.0")
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	// the shutdown of an admitted node frees its place in the batch
+	assert.NoError(t, states[0].UnlockRollout())
+	got, err := states[2].TryRolloutLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+
+	// so does the failed deploy of an admitted node
+	assert.NoError(t, states[1].ReleaseRolloutBatch())
+	assert.NoError(t, states[1].ReleaseRolloutBatch())
+	got, err = states[0].TryRolloutLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+
+	// the next batch is allowed after rollout_window
+	got, err = states[3].TryRolloutLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.False(t, got)
+	clock.step(config.RolloutWindow - time.Second)
+	got, err = states[3].TryRolloutLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.False(t, got)
+	clock.step(time.Second)
+	got, err = states[3].TryRolloutLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+}
+
+func TestSaveReleaseTagDryRun(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	redisClient.Del(context.Background(), "test_prefix_stable_release_tag", "test_prefix_avoid_release_tag")
+	config := newTestConfig()
+	config.DryRun = true
+	state, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+
+	assert.NoError(t, state.SaveStableReleaseTag("v1.1.0"))
+	assert.NoError(t, state.SaveAvoidReleaseTag("v1.1.0", "health check failed", ""))
+
+	stable, err := state.CurrentStableTag()
+	assert.NoError(t, err)
+	assert.Equal(t, "", stable)
+	avoid, err := state.AvoidReleaseTags()
+	assert.NoError(t, err)
+	assert.Empty(t, avoid)
+}
+
+func TestNewRedisClientMode(t *testing.T) {
+	config := newTestConfig()
+
+	rc, err := newRedisClient(config.Redis)
+	assert.NoError(t, err)
+	_, ok := rc.(*redis.Client)
+	assert.True(t, ok)
+	assert.Equal(t, "test_prefix", keyPrefix(config))
+
+	config.Redis.Mode = RedisModeSentinel
+	config.Redis.MasterName = "mymaster"
+	config.Redis.Addrs = []string{"localhost:26379"}
+	rc, err = newRedisClient(config.Redis)
+	assert.NoError(t, err)
+	_, ok = rc.(*redis.Client)
+	assert.True(t, ok)
+	assert.Equal(t, "test_prefix", keyPrefix(config))
+
+	config.Redis.Mode = RedisModeCluster
+	config.Redis.Addrs = nil
+	rc, err = newRedisClient(config.Redis)
+	assert.NoError(t, err)
+	_, ok = rc.(*redis.ClusterClient)
+	assert.True(t, ok)
+	assert.Equal(t, "{test_prefix}", keyPrefix(config))
+}
+
+func TestRedisContext(t *testing.T) {
+	ctx, cancel := redisContext(&RedisConfig{})
+	defer cancel()
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+
+	ctx, cancel = redisContext(&RedisConfig{Timeout: 10 * time.Millisecond})
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(10*time.Millisecond), deadline, 10*time.Millisecond)
+	<-ctx.Done()
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+}
+
+func TestNewRedisTLSConfig(t *testing.T) {
+	tc, err := newRedisTLSConfig(&RedisTLSConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, tc)
+
+	tc, err = newRedisTLSConfig(&RedisTLSConfig{Enabled: true, InsecureSkipVerify: true})
+	assert.NoError(t, err)
+	assert.True(t, tc.InsecureSkipVerify)
+	assert.Nil(t, tc.RootCAs)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(ca, []byte("not a certificate"), 0600))
+	_, err = newRedisTLSConfig(&RedisTLSConfig{Enabled: true, CACert: ca})
+	assert.Error(t, err)
+
+	_, err = newRedisTLSConfig(&RedisTLSConfig{Enabled: true, Cert: "not_found.pem", Key: "not_found.key"})
+	assert.Error(t, err)
+}
+
+func TestReleaseHistory(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisClient := testutils.RedisClient()
+	redisClient.Del(context.Background(), state.releaseHistoryKey, state.stableReleaseTagKey)
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), state.releaseHistoryKey, state.stableReleaseTagKey)
+	})
+
+	assert.NoError(t, state.SaveStableReleaseTag("v1.0.0"))
+	assert.NoError(t, state.SaveReleaseHistory("v0.9.0", ReleaseActionRollback, "health check of v1.0.0 failed"))
+
+	history, err := state.GetReleaseHistory(0)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, ReleaseActionRollback, history[0].Action)
+	assert.Equal(t, "v0.9.0", history[0].Tag)
+	assert.Equal(t, "health check of v1.0.0 failed", history[0].Reason)
+	assert.Equal(t, ReleaseActionStable, history[1].Action)
+	assert.Equal(t, "v1.0.0", history[1].Tag)
+	assert.Equal(t, state.me, history[1].Host)
+
+	history, err = state.GetReleaseHistory(1)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestIsAvoidReleaseTag(t *testing.T) {
+	state, err := NewState(newTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisClient := testutils.RedisClient()
+	redisClient.Del(context.Background(), state.avoidReleaseTagKey)
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), state.avoidReleaseTagKey)
+	})
+
+	assert.NoError(t, state.SaveAvoidReleaseTag("v1.0.1", "health check failed", ""))
+
+	tests := []struct {
+		name string
+		tag  string
+		want error
+	}{
+		{name: "in the avoid tags", tag: "v1.0.1", want: ErrAvoidReleaseTag},
+		{name: "not in the avoid tags", tag: "v1.0.2", want: nil},
+		{name: "empty tag", tag: "", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, state.IsAvoidReleaseTag(tt.tag))
+		})
+	}
+}
+
+func TestAvoidReleaseTagTTL(t *testing.T) {
+	config := newTestConfig()
+	state, err := NewState(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisClient := testutils.RedisClient()
+	redisClient.Del(context.Background(), state.avoidReleaseTagKey, state.avoidTagExpiryKey)
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), state.avoidReleaseTagKey, state.avoidTagExpiryKey)
+	})
+
+	assert.NoError(t, state.SaveAvoidReleaseTag("v1.0.0", "health check failed", ""))
+	config.AvoidTagTTL = time.Hour
+	assert.NoError(t, state.SaveAvoidReleaseTag("v1.0.1", "health check failed", ""))
+	// an expired entry
+	redisClient.ZAdd(context.Background(), state.avoidTagExpiryKey, redis.Z{Score: float64(time.Now().Add(-time.Minute).UnixMilli()), Member: "v1.0.2"})
+
+	assert.Equal(t, ErrAvoidReleaseTag, state.IsAvoidReleaseTag("v1.0.0"))
+	assert.Equal(t, ErrAvoidReleaseTag, state.IsAvoidReleaseTag("v1.0.1"))
+	assert.NoError(t, state.IsAvoidReleaseTag("v1.0.2"))
+
+	tags, err := state.AvoidReleaseTags()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"v1.0.0", "v1.0.1"}, tags)
+
+	assert.NoError(t, state.RemoveAvoidReleaseTag("v1.0.0"))
+	assert.NoError(t, state.RemoveAvoidReleaseTag("v1.0.1"))
+	assert.NoError(t, state.IsAvoidReleaseTag("v1.0.0"))
+	assert.NoError(t, state.IsAvoidReleaseTag("v1.0.1"))
+}
+
+func TestExtendLock(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	keys := []string{"test_prefix_canary_release_tag", "test_prefix_canary_release_tag_holder", "test_prefix_rollout", "test_prefix_rollout_holder"}
+	redisClient.Del(context.Background(), keys...)
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), keys...)
+	})
+
+	config := newTestConfig()
+	config.CanaryLockTTL = time.Hour
+	config.RolloutLockTTL = 2 * time.Hour
+	holder, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	holder.me = "host0"
+	other, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	other.me = "host1"
+
+	got, err := holder.TryCanaryReleaseLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+	got, err = holder.TryRolloutLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+	assert.True(t, redisClient.TTL(context.Background(), "test_prefix_canary_release_tag").Val() > 59*time.Minute)
+	assert.True(t, redisClient.TTL(context.Background(), "test_prefix_rollout").Val() > 119*time.Minute)
+
+	redisClient.Expire(context.Background(), "test_prefix_canary_release_tag", time.Minute)
+	redisClient.Expire(context.Background(), "test_prefix_rollout", time.Minute)
+
+	ok, err := other.ExtendCanaryReleaseLock(time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = other.ExtendRolloutLock()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.True(t, redisClient.TTL(context.Background(), "test_prefix_canary_release_tag").Val() <= time.Minute)
+
+	ok, err = holder.ExtendCanaryReleaseLock(time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = holder.ExtendRolloutLock()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, redisClient.TTL(context.Background(), "test_prefix_canary_release_tag").Val() > 59*time.Minute)
+	assert.True(t, redisClient.TTL(context.Background(), "test_prefix_rollout").Val() > 119*time.Minute)
+
+	assert.NoError(t, holder.UnlockRollout())
+	ok, err = holder.ExtendRolloutLock()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCanaryLockHeartbeat(t *testing.T) {
+	redisClient := testutils.RedisClient()
+	keys := []string{"test_prefix_canary_release_tag", "test_prefix_canary_release_tag_holder"}
+	redisClient.Del(context.Background(), keys...)
+	t.Cleanup(func() {
+		redisClient.Del(context.Background(), keys...)
+	})
+
+	config := newTestConfig()
+	config.CanaryRolloutWindow = time.Hour
+	config.CanaryLockHeartbeat = 30 * time.Second
+	assert.Equal(t, 30*time.Second, CanaryLockLease(config))
+
+	state, err := NewState(config)
+	if err != nil {
+		t.Fatalf("failed to setup test: %v", err)
+	}
+	got, err := state.TryCanaryReleaseLock("v1.1.0")
+	assert.NoError(t, err)
+	assert.True(t, got)
+	for _, key := range keys {
+		assert.True(t, redisClient.TTL(context.Background(), key).Val() <= 30*time.Second)
+	}
+
+	// the heartbeat longer than canary_lock_ttl is ignored
+	config.CanaryLockHeartbeat = 3 * time.Hour
+	assert.Equal(t, 2*time.Hour, CanaryLockLease(config))
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-github/v55/github"
+)
+
+// isDowngrade reports whether next is a lower semantic version than current.
+// Tags that can't be parsed as semver are never treated as a downgrade.
+func isDowngrade(current, next string) bool {
+	cv, err := semver.NewVersion(current)
+	if err != nil {
+		return false
+	}
+	nv, err := semver.NewVersion(next)
+	if err != nil {
+		return false
+	}
+	return nv.LessThan(cv)
+}
+
+// newerRelease reports whether a should be picked before b.
+// Releases published at the same time are ordered by semver of the tag (semver tags first),
+// then by creation time and id so that the selection is deterministic.
+// Releases without the published date come last.
+func newerRelease(a, b *github.RepositoryRelease) bool {
+	if (a.PublishedAt == nil) != (b.PublishedAt == nil) {
+		return b.PublishedAt == nil
+	}
+	if !a.GetPublishedAt().Time.Equal(b.GetPublishedAt().Time) {
+		return a.GetPublishedAt().Time.After(b.GetPublishedAt().Time)
+	}
+
+	av, aerr := semver.NewVersion(a.GetTagName())
+	bv, berr := semver.NewVersion(b.GetTagName())
+	switch {
+	case aerr == nil && berr == nil && !av.Equal(bv):
+		return av.GreaterThan(bv)
+	case aerr == nil && berr != nil:
+		return true
+	case aerr != nil && berr == nil:
+		return false
+	}
+
+	if !a.GetCreatedAt().Time.Equal(b.GetCreatedAt().Time) {
+		return a.GetCreatedAt().Time.After(b.GetCreatedAt().Time)
+	}
+	return a.GetID() > b.GetID()
+}
+
+// releaseVersion parses the tag of the release as a strict semver after stripping prefix.
+func releaseVersion(release *github.RepositoryRelease, prefix string) (*semver.Version, bool) {
+	tag := release.GetTagName()
+	if !strings.HasPrefix(tag, prefix) {
+		return nil, false
+	}
+	v, err := semver.StrictNewVersion(strings.TrimPrefix(tag, prefix))
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// highestRelease returns the release with the highest version satisfying constraint.
+// Releases whose tag is not a semver are ignored.
+func highestRelease(releases []*github.RepositoryRelease, prefix string, constraint *semver.Constraints) *github.RepositoryRelease {
+	var ret *github.RepositoryRelease
+	var highest *semver.Version
+	for _, r := range releases {
+		v, ok := releaseVersion(r, prefix)
+		if !ok {
+			continue
+		}
+		if constraint != nil && !constraint.Check(v) {
+			continue
+		}
+		if highest == nil || v.GreaterThan(highest) {
+			ret = r
+			highest = v
+		}
+	}
+	return ret
+}
@@ -5,6 +5,14 @@ package main
 
 import "github.com/pyama86/git-assets-canary-releaser/cmd"
 
+// set by -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
 func main() {
+	cmd.SetBuildInfo(version, commit, date)
 	cmd.Execute()
 }